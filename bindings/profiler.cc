@@ -62,7 +62,7 @@ NAN_METHOD(StartSamplingHeapProfiler) {
       return Nan::ThrowTypeError("First argument type must be uint32.");
     }
     if (!info[1]->IsNumber()) {
-      return Nan::ThrowTypeError("First argument type must be Integer.");
+      return Nan::ThrowTypeError("Second argument type must be Integer.");
     }
 
 #if NODE_MODULE_VERSION > NODE_8_0_MODULE_VERSION
@@ -72,6 +72,14 @@ NAN_METHOD(StartSamplingHeapProfiler) {
     uint64_t sample_interval = info[0].As<Integer>()->Uint32Value();
     int stack_depth = info[1].As<Integer>()->IntegerValue();
 #endif
+    // V8 does not validate these, and a zero interval or stack depth results
+    // in undefined behavior.
+    if (sample_interval == 0) {
+      return Nan::ThrowRangeError("Sample interval must be positive.");
+    }
+    if (stack_depth <= 0) {
+      return Nan::ThrowRangeError("Stack depth must be positive.");
+    }
 
     info.GetIsolate()->GetHeapProfiler()->StartSamplingHeapProfiler(
         sample_interval, stack_depth);
@@ -91,19 +99,50 @@ NAN_METHOD(StopSamplingHeapProfiler) {
 NAN_METHOD(GetAllocationProfile) {
   std::unique_ptr<v8::AllocationProfile> profile(
       info.GetIsolate()->GetHeapProfiler()->GetAllocationProfile());
+  // V8 returns no profile when the sampling heap profiler is not running.
+  if (!profile) {
+    info.GetReturnValue().SetNull();
+    return;
+  }
   AllocationProfile::Node* root = profile->GetRootNode();
   info.GetReturnValue().Set(TranslateAllocationProfile(root));
 }
 
 // Time profiler
 
+// State of the time profiler for one isolate. The addon may be loaded by
+// several worker threads in one process, each with its own isolate, so this
+// state must not be shared between isolates. It is passed as data to the
+// functions created for each isolate.
+class TimeProfilerState {
+ public:
+  explicit TimeProfilerState(Isolate* isolate) {
 #if NODE_MODULE_VERSION > NODE_8_0_MODULE_VERSION
-// This profiler exists for the lifetime of the program. Not calling
-// CpuProfiler::Dispose() is intentional.
-CpuProfiler* cpuProfiler = CpuProfiler::New(v8::Isolate::GetCurrent());
+    cpuProfiler = CpuProfiler::New(isolate);
 #else
-CpuProfiler* cpuProfiler = v8::Isolate::GetCurrent()->GetCpuProfiler();
+    cpuProfiler = isolate->GetCpuProfiler();
 #endif
+  }
+
+  ~TimeProfilerState() {
+#if NODE_MODULE_VERSION > NODE_8_0_MODULE_VERSION
+    cpuProfiler->Dispose();
+#endif
+  }
+
+  // Called when the environment (main thread or worker) which loaded the
+  // addon is torn down.
+  static void Cleanup(void* arg) {
+    delete static_cast<TimeProfilerState*>(arg);
+  }
+
+  CpuProfiler* cpuProfiler;
+};
+
+CpuProfiler* GetCpuProfiler(const Nan::FunctionCallbackInfo<Value>& info) {
+  return static_cast<TimeProfilerState*>(info.Data().As<External>()->Value())
+      ->cpuProfiler;
+}
 
 Local<Object> CreateTimeNode(Local<String> name, Local<String> scriptName,
                              Local<Integer> scriptId, Local<Integer> lineNumber,
@@ -219,15 +258,39 @@ Local<Value> TranslateTimeProfileNode(const CpuProfileNode* node) {
     Nan::Set(children, i, TranslateTimeProfileNode(node->GetChild(i)));
   }
 
-  return CreateTimeNode(node->GetFunctionName(), node->GetScriptResourceName(),
-                        Nan::New<Integer>(node->GetScriptId()),
-                        Nan::New<Integer>(node->GetLineNumber()),
-                        Nan::New<Integer>(node->GetColumnNumber()),
-                        Nan::New<Integer>(node->GetHitCount()), children);
+  Local<Object> js_node = CreateTimeNode(
+      node->GetFunctionName(), node->GetScriptResourceName(),
+      Nan::New<Integer>(node->GetScriptId()),
+      Nan::New<Integer>(node->GetLineNumber()),
+      Nan::New<Integer>(node->GetColumnNumber()),
+      Nan::New<Integer>(node->GetHitCount()), children);
+  // The id identifies the node in the samples of the profile.
+  Nan::Set(js_node, Nan::New<String>("id").ToLocalChecked(),
+           Nan::New<Integer>(node->GetNodeId()));
+  return js_node;
+}
+
+// Adds the node id and timestamp of each sample of profile to js_profile.
+// Samples are only recorded when profiling was started with recordSamples.
+void TranslateTimeProfileSamples(const CpuProfile* profile,
+                                 Local<Object> js_profile) {
+  int count = profile->GetSamplesCount();
+  Local<Array> samples = Nan::New<Array>(count);
+  Local<Array> timestamps = Nan::New<Array>(count);
+  for (int i = 0; i < count; i++) {
+    Nan::Set(samples, i,
+             Nan::New<Integer>(profile->GetSample(i)->GetNodeId()));
+    Nan::Set(timestamps, i,
+             Nan::New<Number>(
+                 static_cast<double>(profile->GetSampleTimestamp(i))));
+  }
+  Nan::Set(js_profile, Nan::New<String>("samples").ToLocalChecked(), samples);
+  Nan::Set(js_profile, Nan::New<String>("timestamps").ToLocalChecked(),
+           timestamps);
 }
 
 Local<Value> TranslateTimeProfile(const CpuProfile* profile,
-                                  bool includeLineInfo) {
+                                  bool includeLineInfo, bool recordSamples) {
   Local<Object> js_profile = Nan::New<Object>();
   Nan::Set(js_profile, Nan::New<String>("title").ToLocalChecked(),
            profile->GetTitle());
@@ -248,14 +311,19 @@ Local<Value> TranslateTimeProfile(const CpuProfile* profile,
            Nan::New<Number>(profile->GetStartTime()));
   Nan::Set(js_profile, Nan::New<String>("endTime").ToLocalChecked(),
            Nan::New<Number>(profile->GetEndTime()));
+  if (recordSamples) {
+    TranslateTimeProfileSamples(profile, js_profile);
+  }
   return js_profile;
 }
 
 // Signature:
-// startProfiling(runName: string, includeLineInfo: boolean)
+// startProfiling(runName: string, includeLineInfo: boolean,
+//                recordSamples?: boolean)
 NAN_METHOD(StartProfiling) {
-  if (info.Length() != 2) {
-    return Nan::ThrowTypeError("StartProfiling must have two arguments.");
+  if (info.Length() != 2 && info.Length() != 3) {
+    return Nan::ThrowTypeError(
+        "StartProfiling must have two or three arguments.");
   }
   if (!info[0]->IsString()) {
     return Nan::ThrowTypeError("First argument must be a string.");
@@ -266,13 +334,38 @@ NAN_METHOD(StartProfiling) {
 
   Local<String> name =
       Nan::MaybeLocal<String>(info[0].As<String>()).ToLocalChecked();
+  CpuProfiler* cpuProfiler = GetCpuProfiler(info);
 
-  // Sample counts and timestamps are not used, so we do not need to record
-  // samples.
-  const bool recordSamples = false;
+  // Sample timestamps are only needed to attribute samples to labels.
+  bool recordSamples = false;
+  if (info.Length() == 3) {
+    if (!info[2]->IsBoolean()) {
+      return Nan::ThrowTypeError("Third argument must be a boolean.");
+    }
+    recordSamples = Nan::MaybeLocal<Boolean>(info[2].As<Boolean>())
+                        .ToLocalChecked()
+                        ->Value();
+  }
 
+// Since V8 8, StartProfiling() reports why profiling was not started.
+#if V8_MAJOR_VERSION >= 8
+  bool includeLineInfo =
+      Nan::MaybeLocal<Boolean>(info[1].As<Boolean>()).ToLocalChecked()->Value();
+  CpuProfilingStatus status = cpuProfiler->StartProfiling(
+      name,
+      includeLineInfo ? CpuProfilingMode::kCallerLineNumbers
+                      : CpuProfilingMode::kLeafNodeLineNumbers,
+      recordSamples);
+  // The time profiler retries on this message, since starting may succeed
+  // once other profilers stop.
+  if (status == CpuProfilingStatus::kErrorTooManyProfilers) {
+    return Nan::ThrowError("Too many profilers are running.");
+  }
+  if (status == CpuProfilingStatus::kAlreadyStarted) {
+    return Nan::ThrowError("A profile with this name is already started.");
+  }
 // Line level accurate line information is not available in Node 11 or earlier.
-#if NODE_MODULE_VERSION > NODE_11_0_MODULE_VERSION
+#elif NODE_MODULE_VERSION > NODE_11_0_MODULE_VERSION
   bool includeLineInfo =
       Nan::MaybeLocal<Boolean>(info[1].As<Boolean>()).ToLocalChecked()->Value();
   if (includeLineInfo) {
@@ -287,10 +380,12 @@ NAN_METHOD(StartProfiling) {
 }
 
 // Signature:
-// stopProfiling(runName: string, includeLineInfo: boolean): TimeProfile
+// stopProfiling(runName: string, includeLineInfo: boolean,
+//               recordSamples?: boolean): TimeProfile
 NAN_METHOD(StopProfiling) {
-  if (info.Length() != 2) {
-    return Nan::ThrowTypeError("StopProfling must have two arguments.");
+  if (info.Length() != 2 && info.Length() != 3) {
+    return Nan::ThrowTypeError(
+        "StopProfling must have two or three arguments.");
   }
   if (!info[0]->IsString()) {
     return Nan::ThrowTypeError("First argument must be a string.");
@@ -302,10 +397,11 @@ NAN_METHOD(StopProfiling) {
       Nan::MaybeLocal<String>(info[0].As<String>()).ToLocalChecked();
   bool includeLineInfo =
       Nan::MaybeLocal<Boolean>(info[1].As<Boolean>()).ToLocalChecked()->Value();
+  bool recordSamples = info.Length() == 3 && info[2]->IsTrue();
 
-  CpuProfile* profile = cpuProfiler->StopProfiling(name);
+  CpuProfile* profile = GetCpuProfiler(info)->StopProfiling(name);
   Local<Value> translated_profile =
-      TranslateTimeProfile(profile, includeLineInfo);
+      TranslateTimeProfile(profile, includeLineInfo, recordSamples);
   profile->Delete();
   info.GetReturnValue().Set(translated_profile);
 }
@@ -318,20 +414,28 @@ NAN_METHOD(SetSamplingInterval) {
 #else
   int us = info[0].As<Integer>()->IntegerValue();
 #endif
-  cpuProfiler->SetSamplingInterval(us);
+  GetCpuProfiler(info)->SetSamplingInterval(us);
 }
 
 NAN_MODULE_INIT(InitAll) {
+  Isolate* isolate = Isolate::GetCurrent();
+  TimeProfilerState* state = new TimeProfilerState(isolate);
+#if NODE_MODULE_VERSION >= NODE_10_0_MODULE_VERSION
+  node::AddEnvironmentCleanupHook(isolate, TimeProfilerState::Cleanup, state);
+#endif
+  Local<External> data = Nan::New<External>(state);
+
   Local<Object> timeProfiler = Nan::New<Object>();
   Nan::Set(timeProfiler, Nan::New("startProfiling").ToLocalChecked(),
-           Nan::GetFunction(Nan::New<FunctionTemplate>(StartProfiling))
+           Nan::GetFunction(Nan::New<FunctionTemplate>(StartProfiling, data))
                .ToLocalChecked());
   Nan::Set(timeProfiler, Nan::New("stopProfiling").ToLocalChecked(),
-           Nan::GetFunction(Nan::New<FunctionTemplate>(StopProfiling))
-               .ToLocalChecked());
-  Nan::Set(timeProfiler, Nan::New("setSamplingInterval").ToLocalChecked(),
-           Nan::GetFunction(Nan::New<FunctionTemplate>(SetSamplingInterval))
+           Nan::GetFunction(Nan::New<FunctionTemplate>(StopProfiling, data))
                .ToLocalChecked());
+  Nan::Set(
+      timeProfiler, Nan::New("setSamplingInterval").ToLocalChecked(),
+      Nan::GetFunction(Nan::New<FunctionTemplate>(SetSamplingInterval, data))
+          .ToLocalChecked());
   Nan::Set(target, Nan::New<String>("timeProfiler").ToLocalChecked(),
            timeProfiler);
 
@@ -351,4 +455,4 @@ NAN_MODULE_INIT(InitAll) {
            heapProfiler);
 }
 
-NODE_MODULE(google_cloud_profiler, InitAll);
+NAN_MODULE_WORKER_ENABLED(google_cloud_profiler, InitAll);
@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// ES module entry point. Node.js cannot detect the named exports of the
+// CommonJS entry point, so they are re-exported here. Exports added to
+// ts/src/index.ts must also be added here.
+import pprof from '../out/src/index.js';
+
+export const {
+  addProfiledThread,
+  appendProfile,
+  asyncResources,
+  availablePrebuilds,
+  collectAllThreads,
+  collectAndExport,
+  combineProfiles,
+  decode,
+  decodeSync,
+  diffProfiles,
+  enableControlSocket,
+  enableMemoryTrigger,
+  encode,
+  encodeSync,
+  findFunction,
+  getMarkers,
+  getRevision,
+  getSourceMapBaseUrl,
+  heap,
+  isTimeLimited,
+  lambdaProfiler,
+  mergeProfiles,
+  parseWasmFunctionNames,
+  printProfile,
+  profileHash,
+  profileChildProcess,
+  profileSimilarity,
+  serializeCustomProfile,
+  serveThreadProfiles,
+  shouldProfile,
+  SourceMapper,
+  stripLabels,
+  supportedProfileTypes,
+  THREAD_ID_LABEL,
+  time,
+  toFolded,
+  top,
+  triggeredProfiler,
+  writeProfile,
+} = pprof;
+
+export default pprof;
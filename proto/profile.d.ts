@@ -740,6 +740,9 @@ export namespace perftools {
 
             /** Line line */
             line?: (number|Long);
+
+            /** Line column */
+            column?: (number|Long);
         }
 
         /** Represents a Line. */
@@ -757,6 +760,9 @@ export namespace perftools {
             /** Line line. */
             public line: (number|Long);
 
+            /** Line column. */
+            public column: (number|Long);
+
             /**
              * Creates a new Line instance using the specified properties.
              * @param [properties] Properties to set
@@ -15,6 +15,7 @@
  */
 
 const fs = require('fs');
+const path = require('path');
 const pify = require('pify');
 const pprof = require('pprof');
 
@@ -46,6 +47,22 @@ function benchmark(durationSeconds) {
   busyLoop(durationSeconds);
 }
 
+/**
+ * Returns the path to which to write the profile of the given type, rendered
+ * from PROFILE_PATH_TEMPLATE as test.sh renders it, and creates its directory.
+ */
+function profilePath(type) {
+  const template = process.env.PROFILE_PATH_TEMPLATE || '{type}.pb.gz';
+  const file = template.replace(/{name}/g, process.env.BENCH_NAME || '')
+      .replace(/{type}/g, type)
+      .replace(/{node}/g, process.version)
+      .replace(/{runID}/g, process.env.PROFILE_RUN_ID || '');
+  if (path.dirname(file) !== '.') {
+    fs.mkdirSync(path.dirname(file), {recursive: true});
+  }
+  return file;
+}
+
 async function collectAndSaveTimeProfile(durationSeconds, sourceMapper,
     lineNumbers) {
   const profile = await pprof.time.profile({
@@ -54,13 +71,13 @@ async function collectAndSaveTimeProfile(durationSeconds, sourceMapper,
     sourceMapper: sourceMapper,
   });
   const buf = await pprof.encode(profile);
-  await writeFilePromise('time.pb.gz', buf);
+  await writeFilePromise(profilePath('time'), buf);
 }
 
 async function collectAndSaveHeapProfile(sourceMapper) {
   const profile = pprof.heap.profile(undefined, sourceMapper);
   const buf = await pprof.encode(profile);
-  await writeFilePromise('heap.pb.gz', buf);
+  await writeFilePromise(profilePath('heap'), buf);
 }
 
 async function collectAndSaveProfiles(collectLineNumberTimeProfile) {
@@ -14,7 +14,8 @@
  * limitations under the License.
  */
 
-import {writeFile} from 'fs';
+import {mkdirSync, writeFile} from 'fs';
+import {dirname} from 'path';
 import * as pify from 'pify';
 import {encode, heap, SourceMapper, time} from 'pprof';
 
@@ -46,19 +47,35 @@ function benchmark(durationSeconds: number) {
   busyLoop(durationSeconds);
 }
 
+/**
+ * Returns the path to which to write the profile of the given type, rendered
+ * from PROFILE_PATH_TEMPLATE as test.sh renders it, and creates its directory.
+ */
+function profilePath(type: string): string {
+  const template = process.env.PROFILE_PATH_TEMPLATE || '{type}.pb.gz';
+  const path = template.replace(/{name}/g, process.env.BENCH_NAME || '')
+                   .replace(/{type}/g, type)
+                   .replace(/{node}/g, process.version)
+                   .replace(/{runID}/g, process.env.PROFILE_RUN_ID || '');
+  if (dirname(path) !== '.') {
+    mkdirSync(dirname(path), {recursive: true});
+  }
+  return path;
+}
+
 async function collectAndSaveTimeProfile(
     durationSeconds: number, sourceMapper: SourceMapper): Promise<void> {
   const profile = await time.profile(
       {durationMillis: 1000 * durationSeconds, sourceMapper});
   const buf = await encode(profile);
-  await writeFilePromise('time.pb.gz', buf);
+  await writeFilePromise(profilePath('time'), buf);
 }
 
 async function collectAndSaveHeapProfile(sourceMapper: SourceMapper):
     Promise<void> {
   const profile = await heap.profile(undefined, sourceMapper);
   const buf = await encode(profile);
-  await writeFilePromise('heap.pb.gz', buf);
+  await writeFilePromise(profilePath('heap'), buf);
 }
 
 async function collectAndSaveProfiles(): Promise<void> {
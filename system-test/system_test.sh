@@ -10,17 +10,39 @@ set -eox pipefail
 
 cd $(dirname $0)
 
-if [[ -z "$BINARY_HOST" ]]; then
+# PPROF_NPM_VERSION tests a version of pprof published to npm, which is
+# installed with its own prebuilt binaries.
+if [[ -n "$PPROF_NPM_VERSION" ]] && \
+    [[ -n "$BINARY_HOST" || -n "$BINARY_MANIFEST" ]]; then
+  echo "PPROF_NPM_VERSION cannot be used with BINARY_HOST or BINARY_MANIFEST."
+  exit 1
+fi
+
+if [[ -z "$BINARY_HOST" ]] && [[ -z "$PPROF_NPM_VERSION" ]]; then
   ADDITIONAL_PACKAGES="python g++ make"
 fi
 
-if [[ "$RUN_ONLY_V8_CANARY_TEST" == "true" ]]; then
+# USE_NVMRC=true tests the version of Node.js pinned in busybench/.nvmrc,
+# e.g. for local runs, rather than each supported version.
+if [[ "$USE_NVMRC" == "true" ]]; then
+  if [[ "$RUN_ONLY_V8_CANARY_TEST" == "true" ]]; then
+    echo "USE_NVMRC cannot be used with RUN_ONLY_V8_CANARY_TEST."
+    exit 1
+  fi
+  if [[ ! -f busybench/.nvmrc ]]; then
+    echo "USE_NVMRC is set, but $PWD/busybench/.nvmrc does not exist."
+    exit 1
+  fi
+  NODE_VERSIONS=($(tr -d '[:space:]' < busybench/.nvmrc))
+elif [[ "$RUN_ONLY_V8_CANARY_TEST" == "true" ]]; then
   NVM_NODEJS_ORG_MIRROR="https://nodejs.org/download/v8-canary"
   NODE_VERSIONS=(node)
 else
   NODE_VERSIONS=(10 11 12)
 fi
 
+# PROFILE_PATH_TEMPLATE names the profiles written by busybench, e.g.
+# "{name}/{type}-{node}-{runID}.pb.gz"; see profile_path() in test.sh.
 for i in ${NODE_VERSIONS[@]}; do
   # Test Linux support for the given node version.
   retry docker build -f Dockerfile.linux --build-arg NODE_VERSION=$i \
@@ -28,19 +50,29 @@ for i in ${NODE_VERSIONS[@]}; do
       --build-arg  NVM_NODEJS_ORG_MIRROR="$NVM_NODEJS_ORG_MIRROR" \
       -t node$i-linux .
 
-  docker run  -v $PWD/..:/src -e BINARY_HOST="$BINARY_HOST" node$i-linux \
+  docker run  -v $PWD/..:/src -e BINARY_HOST="$BINARY_HOST" \
+      -e BINARY_MANIFEST="$BINARY_MANIFEST" \
+      -e PROFILE_PATH_TEMPLATE="$PROFILE_PATH_TEMPLATE" \
+      -e PROFILE_RUN_ID="$PROFILE_RUN_ID" \
+      -e PPROF_NPM_VERSION="$PPROF_NPM_VERSION" node$i-linux \
       /src/system-test/test.sh
 
   # Test support for accurate line numbers with node versions supporting this
   # feature.
   if [ "$i" != "10" ] && [ "$i" != "11" ]; then
     docker run  -v $PWD/..:/src -e BINARY_HOST="$BINARY_HOST" \
+        -e BINARY_MANIFEST="$BINARY_MANIFEST" \
+        -e PROFILE_PATH_TEMPLATE="$PROFILE_PATH_TEMPLATE" \
+        -e PROFILE_RUN_ID="$PROFILE_RUN_ID" \
+        -e PPROF_NPM_VERSION="$PPROF_NPM_VERSION" \
         -e VERIFY_TIME_LINE_NUMBERS="true" node$i-linux \
         /src/system-test/test.sh
   fi
 
-  # Skip running on alpine if NVM_NODEJS_ORG_MIRROR is specified.
-  if [[ ! -z "$NVM_NODEJS_ORG_MIRROR" ]]; then
+  # Skip running on alpine if NVM_NODEJS_ORG_MIRROR is specified, or if
+  # there is no alpine image for the version, e.g. one from .nvmrc.
+  if [[ ! -z "$NVM_NODEJS_ORG_MIRROR" ]] || \
+      [[ ! -f Dockerfile.node$i-alpine ]]; then
     continue
   fi
 
@@ -48,7 +80,11 @@ for i in ${NODE_VERSIONS[@]}; do
   retry docker build -f Dockerfile.node$i-alpine \
       --build-arg ADDITIONAL_PACKAGES="$ADDITIONAL_PACKAGES" -t node$i-alpine .
 
-  docker run -v $PWD/..:/src -e BINARY_HOST="$BINARY_HOST" node$i-alpine \
+  docker run -v $PWD/..:/src -e BINARY_HOST="$BINARY_HOST" \
+      -e BINARY_MANIFEST="$BINARY_MANIFEST" \
+      -e PROFILE_PATH_TEMPLATE="$PROFILE_PATH_TEMPLATE" \
+      -e PROFILE_RUN_ID="$PROFILE_RUN_ID" \
+      -e PPROF_NPM_VERSION="$PPROF_NPM_VERSION" node$i-alpine \
       /src/system-test/test.sh
 done
 
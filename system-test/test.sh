@@ -17,25 +17,43 @@ npm_install() {
   timeout_after 60 npm install "${@}"
 }
 
+# Renders PROFILE_PATH_TEMPLATE for the profile type $1, as busybench does.
+# Placeholders are {name} (the benchmark), {type}, {node} (the Node.js
+# version) and {runID}.
+function profile_path() {
+  local path="$PROFILE_PATH_TEMPLATE"
+  path="${path//\{name\}/$BENCH_NAME}"
+  path="${path//\{type\}/$1}"
+  path="${path//\{node\}/$(node -v)}"
+  path="${path//\{runID\}/$PROFILE_RUN_ID}"
+  echo "$path"
+}
+
 set -eox pipefail
 cd $(dirname $0)/..
 
 NODEDIR=$(dirname $(dirname $(which node)))
 
-# TODO: Remove when a new version of nan (current version 2.12.1) is released.
-# For v8-canary tests, we need to use the version of NAN on github, which
-# contains unreleased fixes that allow the native component to be compiled
-# with Node's V8 canary build.
-[ -z $NVM_NODEJS_ORG_MIRROR ] \
-    || retry npm_install https://github.com/nodejs/nan.git
+if [[ -n "$PPROF_NPM_VERSION" ]]; then
+  # Test the published package, rather than one built from this directory.
+  PROFILER="pprof@$PPROF_NPM_VERSION"
+else
+  # TODO: Remove when a new version of nan (current version 2.12.1) is
+  # released.
+  # For v8-canary tests, we need to use the version of NAN on github, which
+  # contains unreleased fixes that allow the native component to be compiled
+  # with Node's V8 canary build.
+  [ -z $NVM_NODEJS_ORG_MIRROR ] \
+      || retry npm_install https://github.com/nodejs/nan.git
 
-retry npm_install --nodedir="$NODEDIR" \
-    ${BINARY_HOST:+--pprof_binary_host_mirror=$BINARY_HOST} >/dev/null
+  retry npm_install --nodedir="$NODEDIR" \
+      ${BINARY_HOST:+--pprof_binary_host_mirror=$BINARY_HOST} >/dev/null
 
-npm run compile
-npm pack >/dev/null
-VERSION=$(node -e "console.log(require('./package.json').version);")
-PROFILER="$PWD/pprof-$VERSION.tgz"
+  npm run compile
+  npm pack >/dev/null
+  VERSION=$(node -e "console.log(require('./package.json').version);")
+  PROFILER="$PWD/pprof-$VERSION.tgz"
+fi
 
 if [[ "$VERIFY_TIME_LINE_NUMBERS" == "true" ]]; then
   BENCHDIR="$PWD/system-test/busybench-js"
@@ -45,15 +63,29 @@ else
   BENCHPATH="build/src/busybench.js"
 fi
 
+# Path of the profiles written by busybench, relative to its directory.
+export PROFILE_PATH_TEMPLATE="${PROFILE_PATH_TEMPLATE:-{type\}.pb.gz}"
+export PROFILE_RUN_ID="${PROFILE_RUN_ID:-$(date +%s)-$$}"
+export BENCH_NAME=$(basename "$BENCHDIR")
+
 TESTDIR=$(mktemp -d)
 cp -r "$BENCHDIR" "$TESTDIR/busybench"
 cd "$TESTDIR/busybench"
 
 retry npm_install pify @types/pify typescript gts @types/node >/dev/null
-retry npm_install --nodedir="$NODEDIR" \
-    $([ -z "$BINARY_HOST" ] && echo "--build-from-source=pprof" \
-        || echo "--pprof_binary_host_mirror=$BINARY_HOST")\
-    "$PROFILER">/dev/null
+if [[ -n "$BINARY_MANIFEST" ]]; then
+  # Install the exact prebuilt binary pinned by the manifest.
+  retry npm_install --ignore-scripts "$PROFILER" >/dev/null
+  node node_modules/pprof/out/src/binary-manifest.js \
+      --manifest="$BINARY_MANIFEST"
+elif [[ -n "$PPROF_NPM_VERSION" ]]; then
+  retry npm_install "$PROFILER" >/dev/null
+else
+  retry npm_install --nodedir="$NODEDIR" \
+      $([ -z "$BINARY_HOST" ] && echo "--build-from-source=pprof" \
+          || echo "--pprof_binary_host_mirror=$BINARY_HOST")\
+      "$PROFILER">/dev/null
+fi
 
 if [[ "$VERIFY_TIME_LINE_NUMBERS" != "true" ]]; then
   npm run compile
@@ -62,15 +94,25 @@ fi
 node -v
 node --trace-warnings "$BENCHPATH" 10 $VERIFY_TIME_LINE_NUMBERS
 
+TIME_PROFILE=$(profile_path time)
+HEAP_PROFILE=$(profile_path heap)
+# busybench renders the same template; check that it wrote the expected files.
+for profile in "$TIME_PROFILE" "$HEAP_PROFILE"; do
+  if [[ ! -f "$profile" ]]; then
+    echo "busybench did not write $profile for $PROFILE_PATH_TEMPLATE"
+    false
+  fi
+done
+
 if [[ "$VERIFY_TIME_LINE_NUMBERS" == "true" ]]; then
-  pprof -lines -top -nodecount=2 time.pb.gz | \
-      grep "busyLoop.*src/busybench.js:33"
-  pprof -filefunctions -top -nodecount=2 heap.pb.gz | \
+  pprof -lines -top -nodecount=2 "$TIME_PROFILE" | \
+      grep "busyLoop.*src/busybench.js:34"
+  pprof -filefunctions -top -nodecount=2 "$HEAP_PROFILE" | \
       grep "busyLoop.*src/busybench.js"
 else
-  pprof -filefunctions -top -nodecount=2 time.pb.gz | \
+  pprof -filefunctions -top -nodecount=2 "$TIME_PROFILE" | \
       grep "busyLoop.*src/busybench.ts"
-  pprof -filefunctions -top -nodecount=2 heap.pb.gz | \
+  pprof -filefunctions -top -nodecount=2 "$HEAP_PROFILE" | \
       grep "busyLoop.*src/busybench.ts"
 fi
 
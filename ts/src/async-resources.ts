@@ -0,0 +1,175 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as asyncHooks from 'async_hooks';
+import * as path from 'path';
+
+import { perftools } from '../../proto/profile';
+import { ProfileBuilder } from './profile-utils';
+
+const DEFAULT_STACK_DEPTH = 64;
+
+/** Label key under which the type of async resources is recorded. */
+export const RESOURCE_TYPE_LABEL = 'resource_type';
+
+export interface AsyncResourceProfileOptions {
+  /** Maximum number of frames recorded for each creation site. */
+  stackDepth?: number;
+  /**
+   * When true, only resources which have not been destroyed when the
+   * profile is stopped are counted, e.g. to find leaked handles.
+   */
+  live?: boolean;
+}
+
+interface Frame {
+  name: string;
+  file: string;
+  line: number;
+}
+
+interface CreationSite {
+  type: string;
+  frames: Frame[];
+  count: number;
+}
+
+/**
+ * @return frames of the stack at which the current async resource is being
+ * created, from the creating function to the outermost caller. Leading
+ * frames of Node.js internals, such as the implementation of setTimeout(),
+ * are omitted.
+ */
+function creationStack(
+  stackDepth: number,
+  below: (asyncId: number, type: string) => void
+): Frame[] {
+  const prepareStackTrace = Error.prepareStackTrace;
+  const stackTraceLimit = Error.stackTraceLimit;
+  // Leave room for the frames of Node.js internals which are omitted.
+  Error.stackTraceLimit = stackDepth + 16;
+  Error.prepareStackTrace = (err, callSites) => callSites;
+  const holder: { stack?: NodeJS.CallSite[] } = {};
+  let callSites: NodeJS.CallSite[];
+  try {
+    Error.captureStackTrace(holder, below);
+    callSites = holder.stack || [];
+  } finally {
+    Error.prepareStackTrace = prepareStackTrace;
+    Error.stackTraceLimit = stackTraceLimit;
+  }
+
+  const frames = callSites.map(site => ({
+    name: site.getFunctionName() || '(anonymous)',
+    file: site.getFileName() || '',
+    line: site.getLineNumber() || 0,
+  }));
+  const first = Math.max(
+    0,
+    frames.findIndex(f => !isNodeInternal(f.file))
+  );
+  return frames.slice(first, first + stackDepth);
+}
+
+// Node.js internal modules are not loaded from absolute paths.
+function isNodeInternal(file: string): boolean {
+  return !path.isAbsolute(file) && !file.startsWith('file:');
+}
+
+/**
+ * Starts counting the async resources (timers, sockets, promises, ...)
+ * created, by type and by the stack at which they are created.
+ *
+ * @return function which stops counting and returns a profile with sample
+ * type async_resources/count, with a resource_type label on each sample.
+ */
+export function start(
+  options: AsyncResourceProfileOptions = {}
+): () => perftools.profiles.IProfile {
+  const stackDepth = options.stackDepth || DEFAULT_STACK_DEPTH;
+  const startTime = Date.now();
+  const sites = new Map<string, CreationSite>();
+  // Creation sites of the resources that are alive, by async id.
+  const liveSites = new Map<number, CreationSite>();
+  const init = (asyncId: number, type: string) => {
+    const frames = creationStack(stackDepth, init);
+    const key = `${type}|${frames
+      .map(f => `${f.name}:${f.file}:${f.line}`)
+      .join(';')}`;
+    let site = sites.get(key);
+    if (!site) {
+      site = { type, frames, count: 0 };
+      sites.set(key, site);
+    }
+    site.count++;
+    if (options.live) {
+      liveSites.set(asyncId, site);
+    }
+  };
+  const destroy = (asyncId: number) => {
+    const site = liveSites.get(asyncId);
+    if (site) {
+      site.count--;
+      liveSites.delete(asyncId);
+    }
+  };
+  const hook = asyncHooks.createHook({ init, destroy });
+  hook.enable();
+
+  return () => {
+    hook.disable();
+    const builder = new ProfileBuilder();
+    const sampleType = new perftools.profiles.ValueType({
+      type: builder.addString('async_resources'),
+      unit: builder.addString('count'),
+    });
+    const typeKey = builder.addString(RESOURCE_TYPE_LABEL);
+    for (const site of sites.values()) {
+      if (site.count === 0) {
+        continue;
+      }
+      const locationId = site.frames.map(f =>
+        builder.addLocation([
+          {
+            functionId: builder.addFunction(f.name, f.name, f.file),
+            line: f.line,
+          },
+        ])
+      );
+      builder.samples.push(
+        new perftools.profiles.Sample({
+          locationId,
+          value: [site.count],
+          label: [
+            new perftools.profiles.Label({
+              key: typeKey,
+              str: builder.addString(site.type),
+            }),
+          ],
+        })
+      );
+    }
+    return {
+      sampleType: [sampleType],
+      sample: builder.samples,
+      location: builder.locations,
+      function: builder.functions,
+      stringTable: builder.stringTable,
+      timeNanos: startTime * 1000 * 1000,
+      durationNanos: (Date.now() - startTime) * 1000 * 1000,
+    };
+  };
+}
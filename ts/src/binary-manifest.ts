@@ -0,0 +1,225 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as crypto from 'crypto';
+import * as fs from 'fs';
+import * as http from 'http';
+import * as https from 'https';
+import * as os from 'os';
+import * as path from 'path';
+
+import { installedTargets } from './binding';
+
+const binary = require('node-pre-gyp');
+const tar = require('tar');
+
+const PACKAGE_JSON = path.resolve(path.join(__dirname, '../../package.json'));
+const MANIFEST_FLAG = '--manifest=';
+const TARGET_REGEX = /^node-v(\d+)-([^-]+)-([^-]+)-([^-]+)$/;
+
+export interface BinaryManifestEntry {
+  /** URL of the prebuilt binary tarball. */
+  url: string;
+  /** Hex encoded SHA-256 digest of the tarball. */
+  sha256: string;
+}
+
+/**
+ * Maps a binary target, named like the prebuilt tarballs
+ * ({node_abi}-{platform}-{arch}-{libc}, e.g. node-v72-linux-x64-glibc), to
+ * the prebuilt binary to install for that target.
+ */
+export interface BinaryManifest {
+  [target: string]: BinaryManifestEntry;
+}
+
+/** The platform, architecture and Node ABI of a prebuilt binary. */
+export interface Prebuild {
+  platform: string;
+  arch: string;
+  /** Node ABI, as in process.versions.modules. */
+  abi: number;
+  /** C library the binary is linked against, e.g. glibc or musl. */
+  libc: string;
+}
+
+/**
+ * @return prebuild described by target, e.g. node-v72-linux-x64-glibc, or
+ * undefined if target is not named like a binary target.
+ */
+export function parseTarget(target: string): Prebuild | undefined {
+  const match = TARGET_REGEX.exec(target);
+  if (!match) {
+    return undefined;
+  }
+  const [, abi, platform, arch, libc] = match;
+  return { platform, arch, abi: Number(abi), libc };
+}
+
+/**
+ * @param manifestPath - path of a binary manifest. When not specified, the
+ * binaries installed with this package are listed instead.
+ * @return prebuilt binaries pinned by the manifest or installed.
+ */
+export function availablePrebuilds(manifestPath?: string): Prebuild[] {
+  const targets = manifestPath
+    ? Object.keys(readManifest(manifestPath))
+    : installedTargets(binary.find(PACKAGE_JSON));
+  const prebuilds: Prebuild[] = [];
+  for (const target of targets) {
+    const prebuild = parseTarget(target);
+    if (prebuild) {
+      prebuilds.push(prebuild);
+    }
+  }
+  return prebuilds;
+}
+
+/**
+ * @return binary target of the running process, e.g.
+ * node-v72-linux-x64-glibc.
+ */
+export function currentTarget(): string {
+  return path.basename(path.dirname(binary.find(PACKAGE_JSON)));
+}
+
+export function readManifest(manifestPath: string): BinaryManifest {
+  let contents;
+  try {
+    contents = fs.readFileSync(manifestPath, 'utf8');
+  } catch (e) {
+    throw new Error(`Could not read binary manifest ${manifestPath}: ${e}`);
+  }
+  try {
+    return JSON.parse(contents);
+  } catch (e) {
+    throw new Error(`Could not parse binary manifest ${manifestPath}: ${e}`);
+  }
+}
+
+/**
+ * @return entry for target in manifest. Throws if manifest does not pin a
+ * binary for target.
+ */
+export function resolveBinary(
+  manifest: BinaryManifest,
+  target: string = currentTarget()
+): BinaryManifestEntry {
+  const entry = manifest[target];
+  if (!entry || !entry.url || !entry.sha256) {
+    throw new Error(`Binary manifest has no entry for target ${target}.`);
+  }
+  return entry;
+}
+
+/**
+ * Throws if the SHA-256 digest of contents does not match sha256.
+ */
+export function verifyChecksum(contents: Buffer, sha256: string) {
+  const digest = crypto
+    .createHash('sha256')
+    .update(contents)
+    .digest('hex');
+  if (digest !== sha256.toLowerCase()) {
+    throw new Error(
+      `Checksum mismatch: expected sha256 ${sha256}, got ${digest}.`
+    );
+  }
+}
+
+function download(url: string): Promise<Buffer> {
+  return new Promise((resolve, reject) => {
+    const get: (
+      url: string,
+      callback: (res: http.IncomingMessage) => void
+    ) => http.ClientRequest = url.startsWith('https:') ? https.get : http.get;
+    get(url, res => {
+      if (res.statusCode !== 200) {
+        res.resume();
+        reject(new Error(`Failed to download ${url}: ${res.statusCode}`));
+        return;
+      }
+      const chunks: Buffer[] = [];
+      res.on('data', (chunk: Buffer) => chunks.push(chunk));
+      res.on('end', () => resolve(Buffer.concat(chunks)));
+      res.on('error', reject);
+    }).on('error', reject);
+  });
+}
+
+function mkdirp(dir: string) {
+  if (fs.existsSync(dir)) {
+    return;
+  }
+  mkdirp(path.dirname(dir));
+  fs.mkdirSync(dir);
+}
+
+/**
+ * Installs the prebuilt binary pinned for the running process by the
+ * manifest at manifestPath. The tarball is downloaded and its checksum is
+ * verified before it is extracted to the location where the binary is
+ * loaded from.
+ *
+ * @return path of the installed binary.
+ */
+export async function installFromManifest(
+  manifestPath: string
+): Promise<string> {
+  const entry = resolveBinary(readManifest(manifestPath));
+  const contents = await download(entry.url);
+  verifyChecksum(contents, entry.sha256);
+
+  const bindingPath = binary.find(PACKAGE_JSON);
+  const modulePath = path.dirname(bindingPath);
+  mkdirp(modulePath);
+  const tarball = path.join(
+    fs.mkdtempSync(path.join(os.tmpdir(), 'pprof-')),
+    path.basename(entry.url)
+  );
+  fs.writeFileSync(tarball, contents);
+  try {
+    // Prebuilt tarballs contain a single top-level directory named after
+    // the target.
+    await tar.x({ file: tarball, cwd: modulePath, strip: 1 });
+  } finally {
+    fs.unlinkSync(tarball);
+    fs.rmdirSync(path.dirname(tarball));
+  }
+  return bindingPath;
+}
+
+// Usage: node binary-manifest.js --manifest=<path>
+// The manifest may also be specified with npm's
+// --pprof_binary_manifest=<path> flag.
+if (require.main === module) {
+  const arg = process.argv.find(a => a.startsWith(MANIFEST_FLAG));
+  const manifestPath = arg
+    ? arg.slice(MANIFEST_FLAG.length)
+    : process.env.npm_config_pprof_binary_manifest;
+  if (!manifestPath) {
+    console.error(`usage: binary-manifest.js ${MANIFEST_FLAG}<path>`);
+    process.exit(1);
+  } else {
+    installFromManifest(manifestPath).then(
+      bindingPath => console.log(`Installed ${bindingPath}`),
+      err => {
+        console.error(`${err}`);
+        process.exit(1);
+      }
+    );
+  }
+}
@@ -0,0 +1,94 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as fs from 'fs';
+import * as path from 'path';
+
+const binary = require('node-pre-gyp');
+
+const PACKAGE_JSON = path.resolve(path.join(__dirname, '../../package.json'));
+
+// Node ABI of a binary target directory, e.g. 72 for node-v72-linux-x64-glibc.
+const TARGET_ABI_REGEX = /^node-v(\d+)-/;
+// Node ABI in the error thrown when loading a binary built for another one.
+const MODULE_VERSION_REGEX = /compiled against .*?NODE_MODULE_VERSION (\d+)/;
+
+/**
+ * Loads the native profiler binding.
+ *
+ * Throws an error explaining how to fix it when the binding cannot be
+ * loaded, e.g. when the installed binary was built for another version of
+ * Node.js than the running one.
+ */
+// tslint:disable-next-line no-any
+export function loadBinding(): any {
+  const bindingPath = binary.find(PACKAGE_JSON);
+  try {
+    return require(bindingPath);
+  } catch (err) {
+    throw bindingLoadError(err, bindingPath, installedTargets(bindingPath));
+  }
+}
+
+/**
+ * @return binary targets installed next to the one expected at bindingPath.
+ */
+export function installedTargets(bindingPath: string): string[] {
+  try {
+    return fs
+      .readdirSync(path.dirname(path.dirname(bindingPath)))
+      .filter(name => TARGET_ABI_REGEX.test(name));
+  } catch (err) {
+    return [];
+  }
+}
+
+/**
+ * @param err - error thrown when requiring the binding.
+ * @param bindingPath - path from which the binding was required.
+ * @param installed - binary targets which are installed.
+ * @return error describing why the binding could not be loaded and how to
+ * install one for the running Node.js.
+ */
+export function bindingLoadError(
+  err: Error,
+  bindingPath: string,
+  installed: string[]
+): Error {
+  const running = process.versions.modules;
+  const fix = 'run npm rebuild pprof';
+  const versionMatch = MODULE_VERSION_REGEX.exec(err.message);
+  if (versionMatch && versionMatch[1] !== running) {
+    const built = versionMatch[1];
+    return new Error(
+      `pprof binary ${bindingPath} was built for Node ABI ${built}, ` +
+        `running ${running} (Node.js ${process.version}); ${fix}.`
+    );
+  }
+  const abis = installed
+    .map(target => TARGET_ABI_REGEX.exec(target)![1])
+    .filter(abi => abi !== running);
+  if (!fs.existsSync(bindingPath) && abis.length > 0) {
+    return new Error(
+      `pprof binary built for Node ABI ${abis.join(', ')}, running ` +
+        `${running} (Node.js ${process.version}); ${fix}.`
+    );
+  }
+  return new Error(
+    `Could not load pprof binary ${bindingPath} (${fix} if it was ` +
+      `installed for another platform or Node.js version): ${err.message}`
+  );
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { spawn, SpawnOptions } from 'child_process';
+import * as fs from 'fs';
+import * as os from 'os';
+import * as path from 'path';
+
+import { perftools } from '../../proto/profile';
+import { decodeSync } from './profile-encoder';
+import { exitProfileName } from './profile-writer';
+
+/**
+ * Environment variable specifying the directory to which a process started
+ * with --require pprof writes its profile. Defaults to the working directory.
+ */
+export const PROFILE_DIR_ENV = 'PPROF_PROFILE_DIR';
+
+// Module which starts profiling when loaded with --require.
+const PRELOAD_PATH = path.join(__dirname, 'index.js');
+
+/**
+ * Runs command in a child process with pprof loaded in each Node.js process
+ * it starts (via NODE_OPTIONS=--require), and returns the time profile of the
+ * child collected from its start until it exits.
+ *
+ * Since NODE_OPTIONS cannot quote paths on all Node.js versions, pprof must
+ * be installed at a path without spaces.
+ *
+ * @param command - command to run, e.g. process.execPath.
+ * @param args - arguments for command.
+ * @param options - options for child_process.spawn(). Output of the child is
+ * inherited by default.
+ */
+export async function profileChildProcess(
+  command: string,
+  args: string[] = [],
+  options: SpawnOptions = {}
+): Promise<perftools.profiles.IProfile> {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'pprof-'));
+  const env = { ...process.env, ...options.env };
+  env.NODE_OPTIONS = `${env.NODE_OPTIONS || ''} --require ${PRELOAD_PATH}`;
+  env[PROFILE_DIR_ENV] = dir;
+
+  try {
+    const child = spawn(command, args, {
+      stdio: 'inherit',
+      ...options,
+      env,
+    });
+    await new Promise((resolve, reject) => {
+      child.on('error', reject);
+      child.on('exit', resolve);
+    });
+
+    // When command is not node itself (e.g. a shell script), the profiled
+    // process is a descendant of the child. Use its profile when it is the
+    // only one written.
+    const files = fs.readdirSync(dir);
+    let file = exitProfileName('time', child.pid);
+    if (files.indexOf(file) === -1) {
+      if (files.length !== 1) {
+        throw new Error(
+          `Expected one profile from ${command}, found ${files.length}.`
+        );
+      }
+      file = files[0];
+    }
+    return decodeSync(fs.readFileSync(path.join(dir, file)));
+  } finally {
+    for (const file of fs.readdirSync(dir)) {
+      fs.unlinkSync(path.join(dir, file));
+    }
+    fs.rmdirSync(dir);
+  }
+}
@@ -0,0 +1,73 @@
+#!/usr/bin/env node
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as fs from 'fs';
+
+import { diffProfiles } from './profile-combiner';
+import { decodeSync, encodeSync } from './profile-encoder';
+
+const USAGE = `Usage:
+  pprof-nodejs diff <before.pb.gz> <after.pb.gz> -o <delta.pb.gz>
+      Writes the change from the first to the second profile.
+`;
+
+/**
+ * Runs the diff subcommand with args, the arguments after "diff".
+ */
+function diff(args: string[]) {
+  const files: string[] = [];
+  let output: string | undefined;
+  for (let i = 0; i < args.length; i++) {
+    if (args[i] === '-o' || args[i] === '--output') {
+      output = args[++i];
+    } else {
+      files.push(args[i]);
+    }
+  }
+  if (files.length !== 2 || !output) {
+    throw new Error('diff requires two profiles and an output file.');
+  }
+  const [before, after] = files.map(f => decodeSync(fs.readFileSync(f)));
+  fs.writeFileSync(output, encodeSync(diffProfiles(before, after)));
+}
+
+/**
+ * Runs the command line interface with args, the arguments after the
+ * program name.
+ * @return exit code.
+ */
+export function main(args: string[]): number {
+  const [command, ...rest] = args;
+  try {
+    switch (command) {
+      case 'diff':
+        diff(rest);
+        return 0;
+      default:
+        throw new Error(
+          command ? `Unknown command ${command}.` : 'No command given.'
+        );
+    }
+  } catch (err) {
+    process.stderr.write(`pprof-nodejs: ${err.message}\n${USAGE}`);
+    return 1;
+  }
+}
+
+if (require.main === module) {
+  process.exitCode = main(process.argv.slice(2));
+}
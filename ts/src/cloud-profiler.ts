@@ -0,0 +1,91 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { getSampleTypes, SampleType } from './profile-combiner';
+import { getString } from './profile-utils';
+
+/**
+ * Sample types of the profiles which Cloud Profiler accepts from Node.js, by
+ * Cloud Profiler profile type. These are the sample types of time and heap
+ * profiles collected by this module.
+ */
+export const CLOUD_PROFILER_SAMPLE_TYPES: { [type: string]: SampleType[] } = {
+  WALL: [
+    { type: 'sample', unit: 'count' },
+    { type: 'wall', unit: 'microseconds' },
+  ],
+  HEAP: [
+    { type: 'objects', unit: 'count' },
+    { type: 'space', unit: 'bytes' },
+  ],
+};
+
+function formatSampleTypes(sampleTypes: SampleType[]): string {
+  return `[${sampleTypes.map(st => `${st.type}/${st.unit}`).join(', ')}]`;
+}
+
+function sameSampleTypes(a: SampleType[], b: SampleType[]): boolean {
+  return (
+    a.length === b.length &&
+    a.every((st, i) => st.type === b[i].type && st.unit === b[i].unit)
+  );
+}
+
+/**
+ * @return Cloud Profiler profile type of profile. Throws if profile cannot be
+ * uploaded to Cloud Profiler without transformation: if its sample types are
+ * not those of a single supported profile type, if its period type is not
+ * the last sample type, or if it has a label without a key.
+ */
+export function checkCloudProfilerProfile(
+  profile: perftools.profiles.IProfile
+): string {
+  const sampleTypes = getSampleTypes(profile);
+  const profileType = Object.keys(CLOUD_PROFILER_SAMPLE_TYPES).find(t =>
+    sameSampleTypes(sampleTypes, CLOUD_PROFILER_SAMPLE_TYPES[t])
+  );
+  if (profileType === undefined) {
+    const expected = Object.keys(CLOUD_PROFILER_SAMPLE_TYPES)
+      .map(t => formatSampleTypes(CLOUD_PROFILER_SAMPLE_TYPES[t]))
+      .join(' or ');
+    throw new Error(
+      `Cloud Profiler does not accept sample types ` +
+        `${formatSampleTypes(sampleTypes)}; expected ${expected}.`
+    );
+  }
+
+  const periodType = profile.periodType;
+  const lastType = sampleTypes[sampleTypes.length - 1];
+  if (
+    !periodType ||
+    getString(profile, periodType.type) !== lastType.type ||
+    getString(profile, periodType.unit) !== lastType.unit
+  ) {
+    throw new Error(
+      `Cloud Profiler requires period type ${lastType.type}/${lastType.unit}.`
+    );
+  }
+
+  for (const sample of profile.sample || []) {
+    for (const label of sample.label || []) {
+      if (!getString(profile, label.key)) {
+        throw new Error('Cloud Profiler does not accept labels without keys.');
+      }
+    }
+  }
+  return profileType;
+}
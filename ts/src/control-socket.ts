@@ -0,0 +1,117 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as net from 'net';
+
+import { perftools } from '../../proto/profile';
+import * as heapProfiler from './heap-profiler';
+import { encode } from './profile-encoder';
+import * as timeProfiler from './time-profiler';
+
+export interface ControlSocketOptions {
+  /** Path of the Unix domain socket on which to listen. */
+  path: string;
+  /**
+   * Options for time profiles requested over the socket. The duration is
+   * given by each request.
+   */
+  timeOptions?: timeProfiler.StartOptions;
+}
+
+/** A request for a profile sent over the control socket. */
+export interface ControlCommand {
+  type: 'time' | 'heap';
+  /** Time profiles only. Time for which to collect the profile. */
+  durationMillis?: number;
+}
+
+/**
+ * @return profile requested by command. Time profiles are collected with
+ * timeOptions.
+ */
+export async function collectProfile(
+  command: ControlCommand,
+  timeOptions?: timeProfiler.StartOptions
+): Promise<perftools.profiles.IProfile> {
+  switch (command.type) {
+    case 'time':
+      return timeProfiler.profile({
+        ...timeOptions,
+        durationMillis: command.durationMillis,
+      });
+    case 'heap':
+      return heapProfiler.profile();
+    default:
+      throw new Error(`Unknown profile type "${command.type}".`);
+  }
+}
+
+/**
+ * Serves one request read from socket: a JSON encoded ControlCommand
+ * followed by a newline. The encoded profile, or a line starting with
+ * "Error: " if it could not be collected, is written back and the socket is
+ * closed.
+ */
+function serve(socket: net.Socket, options: ControlSocketOptions) {
+  let data = '';
+  socket.setEncoding('utf8');
+  socket.on('data', (chunk: string) => {
+    data += chunk;
+    const end = data.indexOf('\n');
+    if (end === -1) {
+      return;
+    }
+    socket.removeAllListeners('data');
+    Promise.resolve()
+      .then(() =>
+        collectProfile(JSON.parse(data.slice(0, end)), options.timeOptions)
+      )
+      .then(profile => encode(profile))
+      .then(
+        buffer => socket.end(buffer),
+        err => socket.end(`Error: ${err.message}\n`)
+      );
+  });
+  socket.on('error', () => {
+    // The requester may go away before its profile is written.
+  });
+}
+
+/**
+ * Listens on a Unix domain socket for requests for profiles, so that
+ * profiles can be collected on demand where signals cannot be sent to the
+ * process. Each connection sends one request, a JSON encoded ControlCommand
+ * followed by a newline such as {"type":"time","durationMillis":10000}, and
+ * receives the gzipped profile, or a line starting with "Error: ". Heap
+ * profiles require the heap profiler to have been started with heap.start().
+ *
+ * The server does not keep the process alive.
+ *
+ * @return the server, once it is listening.
+ */
+export function enableControlSocket(
+  options: ControlSocketOptions
+): Promise<net.Server> {
+  const server = net.createServer(socket => serve(socket, options));
+  return new Promise((resolve, reject) => {
+    server.once('error', reject);
+    server.listen(options.path, () => {
+      server.removeListener('error', reject);
+      server.unref();
+      resolve(server);
+    });
+  });
+}
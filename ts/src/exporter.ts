@@ -0,0 +1,210 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { getString, toNumber } from './profile-utils';
+
+const DEFAULT_SIMILARITY_THRESHOLD = 0.95;
+const DEFAULT_TOP_STACKS = 10;
+const DEFAULT_RETRY_DELAY_MILLIS = 1000;
+const MAX_RETRY_DELAY_MILLIS = 60 * 1000;
+
+export interface CollectAndExportOptions {
+  /**
+   * Collects a profile, e.g. () => time.profile({durationMillis: 10000}).
+   * The next profile is collected as soon as the previous one is exported or
+   * skipped.
+   */
+  collect: () => Promise<perftools.profiles.IProfile>;
+  /** Exports a profile, e.g. by uploading it. */
+  exportProfile: (profile: perftools.profiles.IProfile) => Promise<void> | void;
+  /**
+   * When set, a profile is not exported if it is similar to the last
+   * exported profile and that was exported less than this many milliseconds
+   * ago, e.g. to skip profiles of an idle process.
+   */
+  dedupeWindow?: number;
+  /**
+   * Similarity, between 0 and 1, from which a profile counts as similar to
+   * the last exported one; see profileSimilarity(). Defaults to 0.95.
+   */
+  similarityThreshold?: number;
+  /** Number of stacks compared by profileSimilarity(). Defaults to 10. */
+  topStacks?: number;
+  /**
+   * Called when a profile cannot be collected or exported. Defaults to
+   * console.error.
+   */
+  onError?: (err: Error) => void;
+  /**
+   * Time in milliseconds to wait before collecting again after a profile
+   * cannot be collected or exported. The delay doubles with each
+   * consecutive failure, up to a minute. Defaults to 1000.
+   */
+  retryDelayMillis?: number;
+}
+
+/**
+ * @return share of the first value of profile, by stack of function names
+ * from leaf to root.
+ */
+function stackShares(
+  profile: perftools.profiles.IProfile
+): Map<string, number> {
+  const functionNames = new Map<number, string>();
+  for (const f of profile.function || []) {
+    functionNames.set(toNumber(f.id), getString(profile, f.name));
+  }
+  const locationNames = new Map<number, string>();
+  for (const loc of profile.location || []) {
+    locationNames.set(
+      toNumber(loc.id),
+      (loc.line || [])
+        .map(l => functionNames.get(toNumber(l.functionId)))
+        .join('\0')
+    );
+  }
+  const shares = new Map<string, number>();
+  let total = 0;
+  for (const sample of profile.sample || []) {
+    const key = (sample.locationId || [])
+      .map(id => locationNames.get(toNumber(id)))
+      .join('\0');
+    const value = toNumber((sample.value || [])[0]);
+    shares.set(key, (shares.get(key) || 0) + value);
+    total += value;
+  }
+  for (const [key, value] of shares) {
+    shares.set(key, total > 0 ? value / total : 0);
+  }
+  return shares;
+}
+
+function topShares(
+  shares: Map<string, number>,
+  n: number
+): Map<string, number> {
+  return new Map(
+    Array.from(shares.entries())
+      .sort((a, b) => b[1] - a[1])
+      .slice(0, n)
+  );
+}
+
+/**
+ * @return similarity of profiles a and b, between 0 and 1, from the share of
+ * the first sample value of each of their topStacks stacks with the highest
+ * values. Stacks are compared by function names, so profiles of the same
+ * process with the same hot stacks in the same proportions have a similarity
+ * of 1 and profiles without common hot stacks a similarity of 0. Two
+ * profiles without samples are identical.
+ */
+export function profileSimilarity(
+  a: perftools.profiles.IProfile,
+  b: perftools.profiles.IProfile,
+  topStacks = DEFAULT_TOP_STACKS
+): number {
+  const sharesA = topShares(stackShares(a), topStacks);
+  const sharesB = topShares(stackShares(b), topStacks);
+  if (sharesA.size === 0 && sharesB.size === 0) {
+    return 1;
+  }
+  let similarity = 0;
+  for (const [key, share] of sharesA) {
+    similarity += Math.min(share, sharesB.get(key) || 0);
+  }
+  return similarity;
+}
+
+/**
+ * Repeatedly collects a profile with options.collect() and exports it with
+ * options.exportProfile(). With dedupeWindow, profiles similar to the last
+ * exported one are skipped, so that polling an idle process does not export
+ * many identical profiles.
+ *
+ * @return function which stops collecting profiles, and resolves once the
+ * profile being collected, if any, has been exported or skipped.
+ */
+export function collectAndExport(
+  options: CollectAndExportOptions
+): () => Promise<void> {
+  const onError = options.onError || ((err: Error) => console.error(err));
+  const threshold =
+    options.similarityThreshold === undefined
+      ? DEFAULT_SIMILARITY_THRESHOLD
+      : options.similarityThreshold;
+  const retryDelayMillis =
+    options.retryDelayMillis === undefined
+      ? DEFAULT_RETRY_DELAY_MILLIS
+      : options.retryDelayMillis;
+  let stopped = false;
+  let retryTimer: NodeJS.Timer | undefined;
+  let wakeUp: (() => void) | undefined;
+  let lastExported: perftools.profiles.IProfile | undefined;
+  let lastExportMillis = 0;
+
+  const isDuplicate = (profile: perftools.profiles.IProfile) =>
+    options.dedupeWindow !== undefined &&
+    lastExported !== undefined &&
+    Date.now() - lastExportMillis < options.dedupeWindow &&
+    profileSimilarity(lastExported, profile, options.topStacks) >= threshold;
+
+  const collectOnce = async () => {
+    const profile = await options.collect();
+    if (isDuplicate(profile)) {
+      return;
+    }
+    await options.exportProfile(profile);
+    lastExported = profile;
+    lastExportMillis = Date.now();
+  };
+
+  const sleep = (millis: number) =>
+    new Promise<void>(resolve => {
+      wakeUp = resolve;
+      retryTimer = setTimeout(resolve, millis);
+    });
+
+  const loop = async () => {
+    let failures = 0;
+    while (!stopped) {
+      try {
+        await collectOnce();
+        failures = 0;
+      } catch (err) {
+        onError(err);
+        // Back off, so that a collect() or exportProfile() which keeps
+        // failing right away does not keep the event loop busy.
+        await sleep(
+          Math.min(
+            retryDelayMillis * Math.pow(2, failures),
+            MAX_RETRY_DELAY_MILLIS
+          )
+        );
+        failures++;
+      }
+    }
+  };
+  const done = loop();
+  return () => {
+    stopped = true;
+    if (retryTimer) {
+      clearTimeout(retryTimer);
+      wakeUp!();
+    }
+    return done;
+  };
+}
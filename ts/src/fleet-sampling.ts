@@ -0,0 +1,57 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as os from 'os';
+
+export interface ShouldProfileOptions {
+  /** Fraction of processes which should profile, between 0 and 1. */
+  rate: number;
+  /**
+   * Value identifying the process. Defaults to the host name and process id.
+   */
+  seed?: string;
+}
+
+/**
+ * @return 32-bit FNV-1a hash of str.
+ */
+function hash(str: string): number {
+  let h = 0x811c9dc5;
+  for (let i = 0; i < str.length; i++) {
+    h ^= str.charCodeAt(i);
+    h = Math.imul(h, 0x01000193);
+  }
+  return h >>> 0;
+}
+
+/**
+ * Decides whether this process should profile, so that profiling can be
+ * enabled for a fraction of the processes of a fleet. The decision is derived
+ * from the seed, so it is the same each time it is made for a process.
+ *
+ * @return true for approximately options.rate of all seeds.
+ */
+export function shouldProfile(options: ShouldProfileOptions): boolean {
+  const rate = options.rate;
+  if (!(rate >= 0 && rate <= 1)) {
+    throw new Error(`rate must be between 0 and 1, got ${rate}.`);
+  }
+  const seed =
+    options.seed === undefined
+      ? `${os.hostname()}:${process.pid}`
+      : options.seed;
+  return hash(seed) / 0x100000000 < rate;
+}
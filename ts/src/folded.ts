@@ -0,0 +1,88 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { formatNumber, getString, toNumber } from './profile-utils';
+
+export interface FoldedOptions {
+  /**
+   * When true, each stack starts with the leaf frame. Defaults to false,
+   * which starts each stack with the root frame as flamegraph.pl expects.
+   */
+  leafFirst?: boolean;
+  /**
+   * Index in each sample's values of the value to print. Defaults to 0, the
+   * sample count for time profiles and the object count for heap profiles.
+   */
+  valueIndex?: number;
+}
+
+/**
+ * Renders profile in the folded stacks format read by flamegraph tools such
+ * as flamegraph.pl: one line per distinct stack, with the names of its
+ * frames separated by semicolons, a space, and the total value of the
+ * stack's samples, formatted independently of the locale. Semicolons and
+ * whitespace in function names are replaced, since they separate frames and
+ * fields.
+ */
+export function toFolded(
+  profile: perftools.profiles.IProfile,
+  options: FoldedOptions = {}
+): string {
+  const valueIndex = options.valueIndex || 0;
+  const functionNames = new Map<number, string>();
+  for (const f of profile.function || []) {
+    const name = getString(profile, f.name) || '(anonymous)';
+    functionNames.set(
+      toNumber(f.id),
+      name.replace(/;/g, ':').replace(/\s/g, '_')
+    );
+  }
+  // Frames of each location, leaf first. Within a location, the first line
+  // is that of the innermost inlined function.
+  const locationFrames = new Map<number, string[]>();
+  for (const loc of profile.location || []) {
+    locationFrames.set(
+      toNumber(loc.id),
+      (loc.line || []).map(
+        l => functionNames.get(toNumber(l.functionId)) || '(unknown)'
+      )
+    );
+  }
+
+  const totals = new Map<string, number>();
+  for (const sample of profile.sample || []) {
+    const value = toNumber((sample.value || [])[valueIndex]);
+    if (value === 0) {
+      continue;
+    }
+    let frames: string[] = [];
+    for (const id of sample.locationId || []) {
+      frames = frames.concat(locationFrames.get(toNumber(id)) || []);
+    }
+    if (!options.leafFirst) {
+      frames.reverse();
+    }
+    const stack = frames.join(';');
+    totals.set(stack, (totals.get(stack) || 0) + value);
+  }
+
+  let folded = '';
+  for (const [stack, total] of totals) {
+    folded += `${stack} ${formatNumber(total)}\n`;
+  }
+  return folded;
+}
@@ -14,15 +14,11 @@
  * limitations under the License.
  */
 
-import * as path from 'path';
-
+import { loadBinding } from './binding';
+import { currentThreadId } from './thread-id';
 import { AllocationProfileNode } from './v8-types';
 
-const binary = require('node-pre-gyp');
-const bindingPath = binary.find(
-  path.resolve(path.join(__dirname, '../../package.json'))
-);
-const profiler = require(bindingPath);
+const profiler = loadBinding();
 
 // Wrappers around native heap profiler functions.
 
@@ -40,6 +36,15 @@ export function stopSamplingHeapProfiler() {
   profiler.heapProfiler.stopSamplingHeapProfiler();
 }
 
-export function getAllocationProfile(): AllocationProfileNode {
-  return profiler.heapProfiler.getAllocationProfile();
+/**
+ * @return root of the allocation profile, or null if V8 has no profile
+ * because the sampling heap profiler is not running.
+ */
+export function getAllocationProfile(): AllocationProfileNode | null {
+  const root = profiler.heapProfiler.getAllocationProfile();
+  if (!root) {
+    return null;
+  }
+  root.threadId = currentThreadId();
+  return root;
 }
@@ -14,6 +14,8 @@
  * limitations under the License.
  */
 
+import * as v8 from 'v8';
+
 import { perftools } from '../../proto/profile';
 
 import {
@@ -21,13 +23,158 @@ import {
   startSamplingHeapProfiler,
   stopSamplingHeapProfiler,
 } from './heap-profiler-bindings';
-import { serializeHeapProfile } from './profile-serializer';
+import { AllocationLabelsProvider } from './label-setter';
+import { MetricsCallback, millisSince, reportMetrics } from './metrics';
+import { checkOptionKeys, OptionKeys } from './options';
+import { metadataComments, ProfileMetadata } from './profile-metadata';
+import {
+  NameMapper,
+  serializeHeapProfile,
+  SourceMapStats,
+} from './profile-serializer';
 import { SourceMapper } from './sourcemapper/sourcemapper';
+import { currentThreadId } from './thread-id';
 import { AllocationProfileNode } from './v8-types';
 
 let enabled = false;
 let heapIntervalBytes = 0;
 let heapStackDepth = 0;
+let heapDeterministic = false;
+
+// V8 flag which makes the sampling heap profiler take a sample after exactly
+// each sampling interval, rather than after a randomized interval.
+const SUPPRESS_RANDOMNESS_FLAG = 'sampling-heap-profiler-suppress-randomness';
+
+/**
+ * Largest sampling interval, in bytes, accepted by the binding, which
+ * requires the interval to be a uint32. Larger intervals are clamped to this.
+ */
+export const MAX_INTERVAL_BYTES = 0xffffffff;
+
+export interface HeapStartOptions {
+  /**
+   * Average number of bytes between samples. Intervals larger than
+   * MAX_INTERVAL_BYTES, including Infinity, are clamped to it rather than
+   * rejected by the binding.
+   */
+  intervalBytes: number;
+  /** Maximum stack depth for samples collected. */
+  stackDepth: number;
+  /**
+   * When true, V8's --sampling-heap-profiler-suppress-randomness flag is set
+   * while profiling, asking V8 to sample at a fixed interval of
+   * intervalBytes rather than a random interval averaging intervalBytes.
+   * The flag is cleared again by stop(). Intended for tests: with a fixed
+   * interval, allocations of regular size can be systematically over or
+   * under counted.
+   * This defaults to false.
+   */
+  deterministic?: boolean;
+}
+
+export interface HeapProfileOptions {
+  /**
+   * Samples from scripts whose path contains this string are not included in
+   * the profile.
+   */
+  ignoreSamplePath?: string;
+  sourceMapper?: SourceMapper;
+
+  /**
+   * When set to false, sourceMapper is not used and locations are recorded
+   * as they are in the generated code, which makes serialization faster.
+   * This defaults to true.
+   */
+  sourceMap?: boolean;
+
+  /**
+   * Called with the stack of each sampled allocation when the profile is
+   * serialized, to get the labels to attach to its samples, e.g. the
+   * subsystem owning the allocating code. V8 cannot run JavaScript while it
+   * samples an allocation, so labels can only be derived from the stack and
+   * not from the context, such as the active request, in which the
+   * allocation was made.
+   */
+  labels?: AllocationLabelsProvider;
+
+  /**
+   * Returns the name to record for a function given its name and file, e.g.
+   * to rename helpers emitted by TypeScript or Babel. Applied after source
+   * mapping.
+   */
+  nameMapper?: NameMapper;
+
+  /** Information about the profiled application to record in the profile. */
+  profileMetadata?: ProfileMetadata;
+
+  /**
+   * When true, a full garbage collection runs before the profile is read, so
+   * that samples of objects which are garbage but not yet collected drop
+   * out. This requires Node.js to be run with --expose-gc, and pauses the
+   * application for the duration of the collection.
+   * This defaults to false.
+   */
+  forceGc?: boolean;
+
+  /**
+   * Called with measurements of the profiler's own overhead after each
+   * profile is collected. Reporting metrics requires encoding the profile
+   * once, which adds to the overhead.
+   */
+  onMetrics?: MetricsCallback;
+}
+
+const HEAP_PROFILE_OPTION_KEYS: OptionKeys<
+  HeapProfileOptions & { includeHeapStats?: boolean }
+> = {
+  ignoreSamplePath: true,
+  sourceMapper: true,
+  sourceMap: true,
+  labels: true,
+  nameMapper: true,
+  profileMetadata: true,
+  forceGc: true,
+  onMetrics: true,
+  includeHeapStats: true,
+};
+
+/**
+ * Runs a full garbage collection. Throws unless Node.js was run with
+ * --expose-gc.
+ */
+function collectGarbage() {
+  // tslint:disable-next-line no-any
+  const gc = (global as any).gc;
+  if (typeof gc !== 'function') {
+    throw new Error('forceGc requires Node.js to be run with --expose-gc.');
+  }
+  gc();
+}
+
+/**
+ * Heap statistics of the isolate and process, in bytes.
+ */
+export interface HeapStats {
+  totalHeapSize: number;
+  usedHeapSize: number;
+  heapSizeLimit: number;
+  /** Memory used by C++ objects bound to JavaScript objects. */
+  externalMemory: number;
+  /** Resident set size of the process. */
+  rss: number;
+}
+
+// Fields of process.memoryUsage() which are used.
+interface MemoryUsage {
+  external: number;
+  rss: number;
+}
+
+export interface HeapProfileWithStats {
+  profile: perftools.profiles.IProfile;
+  /** Heap statistics at the time the profile was collected. */
+  heapStats: HeapStats;
+}
 
 /*
  * Collects a heap profile when heapProfiler is enabled. Otherwise throws
@@ -39,9 +186,41 @@ export function v8Profile(): AllocationProfileNode {
   if (!enabled) {
     throw new Error('Heap profiler is not enabled.');
   }
-  return getAllocationProfile();
+  // Without a profile from V8, e.g. when the sampler was reset, return a
+  // root without allocations so that an empty profile is serialized.
+  return (
+    getAllocationProfile() || {
+      name: '(root)',
+      scriptName: '',
+      scriptId: 0,
+      lineNumber: 0,
+      columnNumber: 0,
+      allocations: [],
+      children: [],
+      threadId: currentThreadId(),
+    }
+  );
 }
 
+/**
+ * Collects a profile and returns it serialized in pprof format, together
+ * with heap statistics collected at the same time.
+ * Throws if heap profiler is not enabled.
+ *
+ * @param options
+ */
+export function profile(
+  options: HeapProfileOptions & { includeHeapStats: true }
+): HeapProfileWithStats;
+/**
+ * Collects a profile and returns it serialized in pprof format.
+ * Throws if heap profiler is not enabled.
+ *
+ * @param options
+ */
+export function profile(
+  options?: HeapProfileOptions
+): perftools.profiles.IProfile;
 /**
  * Collects a profile and returns it serialized in pprof format.
  * Throws if heap profiler is not enabled.
@@ -52,14 +231,31 @@ export function v8Profile(): AllocationProfileNode {
 export function profile(
   ignoreSamplePath?: string,
   sourceMapper?: SourceMapper
-): perftools.profiles.IProfile {
+): perftools.profiles.IProfile;
+export function profile(
+  ignoreSamplePathOrOptions?:
+    | string
+    | (HeapProfileOptions & { includeHeapStats?: boolean }),
+  sourceMapper?: SourceMapper
+): perftools.profiles.IProfile | HeapProfileWithStats {
+  const options: HeapProfileOptions & { includeHeapStats?: boolean } =
+    typeof ignoreSamplePathOrOptions === 'object'
+      ? ignoreSamplePathOrOptions
+      : { ignoreSamplePath: ignoreSamplePathOrOptions, sourceMapper };
+  checkOptionKeys(options, HEAP_PROFILE_OPTION_KEYS, 'heap.profile()');
+  if (options.forceGc) {
+    collectGarbage();
+  }
   const startTimeNanos = Date.now() * 1000 * 1000;
+  const collectStart = process.hrtime();
   const result = v8Profile();
+  const collectMillis = millisSince(collectStart);
   // Add node for external memory usage.
   // Current type definitions do not have external.
   // TODO: remove any once type definition is updated to include external.
   // tslint:disable-next-line: no-any
-  const { external }: { external: number } = process.memoryUsage() as any;
+  const memoryUsage: MemoryUsage = process.memoryUsage() as any;
+  const external = memoryUsage.external;
   if (external > 0) {
     const externalNode: AllocationProfileNode = {
       name: '(external)',
@@ -69,15 +265,56 @@ export function profile(
     };
     result.children.push(externalNode);
   }
-  return serializeHeapProfile(
+  const serializeStart = process.hrtime();
+  const mapper = options.sourceMap === false ? undefined : options.sourceMapper;
+  let sourceMapStats: SourceMapStats | undefined;
+  const profile = serializeHeapProfile(
     result,
     startTimeNanos,
     heapIntervalBytes,
-    ignoreSamplePath,
-    sourceMapper
+    options.ignoreSamplePath,
+    mapper,
+    {
+      comments: metadataComments(options.profileMetadata),
+      allocationLabels: options.labels,
+      nameMapper: options.nameMapper,
+      onSourceMapStats: mapper ? stats => (sourceMapStats = stats) : undefined,
+    }
   );
+  const serializeMillis = millisSince(serializeStart);
+  if (options.onMetrics) {
+    reportMetrics(
+      options.onMetrics,
+      profile,
+      collectMillis,
+      serializeMillis,
+      sourceMapStats
+    );
+  }
+  if (options.includeHeapStats) {
+    const stats = v8.getHeapStatistics();
+    return {
+      profile,
+      heapStats: {
+        totalHeapSize: stats.total_heap_size,
+        usedHeapSize: stats.used_heap_size,
+        heapSizeLimit: stats.heap_size_limit,
+        externalMemory: external,
+        rss: memoryUsage.rss,
+      },
+    };
+  }
+  return profile;
 }
 
+/**
+ * Starts heap profiling. If heap profiling has already been started with
+ * the same parameters, this is a noop. If heap profiler has already been
+ * started with different parameters, this throws an error.
+ *
+ * @param options
+ */
+export function start(options: HeapStartOptions): void;
 /**
  * Starts heap profiling. If heap profiling has already been started with
  * the same parameters, this is a noop. If heap profiler has already been
@@ -86,15 +323,45 @@ export function profile(
  * @param intervalBytes - average number of bytes between samples.
  * @param stackDepth - maximum stack depth for samples collected.
  */
-export function start(intervalBytes: number, stackDepth: number) {
+export function start(intervalBytes: number, stackDepth: number): void;
+export function start(
+  intervalBytesOrOptions: number | HeapStartOptions,
+  stackDepthArg?: number
+) {
+  const options: HeapStartOptions =
+    typeof intervalBytesOrOptions === 'number'
+      ? { intervalBytes: intervalBytesOrOptions, stackDepth: stackDepthArg! }
+      : intervalBytesOrOptions;
+  const { intervalBytes, stackDepth } = options;
+  if (!(intervalBytes > 0)) {
+    throw new Error(
+      `intervalBytes must be a positive number, got ${intervalBytes}.`
+    );
+  }
+  if (!(stackDepth > 0)) {
+    throw new Error(`stackDepth must be a positive number, got ${stackDepth}.`);
+  }
   if (enabled) {
     throw new Error(
       `Heap profiler is already started  with intervalBytes ${heapIntervalBytes} and stackDepth ${stackDepth}`
     );
   }
-  heapIntervalBytes = intervalBytes;
+  heapIntervalBytes = Math.min(intervalBytes, MAX_INTERVAL_BYTES);
   heapStackDepth = stackDepth;
-  startSamplingHeapProfiler(heapIntervalBytes, heapStackDepth);
+  heapDeterministic = options.deterministic || false;
+  if (heapDeterministic) {
+    v8.setFlagsFromString(`--${SUPPRESS_RANDOMNESS_FLAG}`);
+  }
+  try {
+    startSamplingHeapProfiler(heapIntervalBytes, heapStackDepth);
+  } catch (err) {
+    // stop() only clears the flag once profiling has started.
+    if (heapDeterministic) {
+      heapDeterministic = false;
+      v8.setFlagsFromString(`--no-${SUPPRESS_RANDOMNESS_FLAG}`);
+    }
+    throw err;
+  }
   enabled = true;
 }
 
@@ -103,5 +370,9 @@ export function stop() {
   if (enabled) {
     enabled = false;
     stopSamplingHeapProfiler();
+    if (heapDeterministic) {
+      heapDeterministic = false;
+      v8.setFlagsFromString(`--no-${SUPPRESS_RANDOMNESS_FLAG}`);
+    }
   }
 }
@@ -13,23 +13,123 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
-import { writeFileSync } from 'fs';
-
+import * as asyncResourceProfiler from './async-resources';
+import { PROFILE_DIR_ENV } from './child-process';
 import * as heapProfiler from './heap-profiler';
-import { encodeSync } from './profile-encoder';
+import { profileOnExit, profileToFile } from './profile-writer';
+import { dumpRingBuffer, startRingBuffer, stopRingBuffer } from './ring-buffer';
 import * as timeProfiler from './time-profiler';
+export { AsyncResourceProfileOptions } from './async-resources';
 export {
   AllocationProfileNode,
   TimeProfileNode,
   ProfileNode,
 } from './v8-types';
 
-export { encode, encodeSync } from './profile-encoder';
-export { SourceMapper } from './sourcemapper/sourcemapper';
+export {
+  decode,
+  decodeSync,
+  DeferSourceMap,
+  encode,
+  EncodeOptions,
+  encodeSync,
+  MainMapping,
+  profileHash,
+  ProfileTransform,
+} from './profile-encoder';
+export { availablePrebuilds, Prebuild } from './binary-manifest';
+export { profileChildProcess } from './child-process';
+export {
+  collectAndExport,
+  CollectAndExportOptions,
+  profileSimilarity,
+} from './exporter';
+export {
+  appendProfile,
+  ProfileSidecar,
+  writeProfile,
+  WriteProfileOptions,
+} from './profile-writer';
+export {
+  ControlCommand,
+  ControlSocketOptions,
+  enableControlSocket,
+} from './control-socket';
+export { FoldedOptions, toFolded } from './folded';
+export {
+  LambdaProfiler,
+  lambdaProfiler,
+  LambdaProfilerOptions,
+} from './lambda';
+export {
+  AllocationFrame,
+  AllocationLabelsProvider,
+  LabelSet,
+  LabelsProvider,
+  LabelValue,
+  NumericLabel,
+} from './label-setter';
+export { printProfile } from './profile-printer';
+export {
+  CustomProfileNode,
+  NameMapper,
+  serializeCustomProfile,
+  SourceMapStats,
+} from './profile-serializer';
+export {
+  getMarkers,
+  getRevision,
+  getSourceMapBaseUrl,
+  isTimeLimited,
+  ProfileMarker,
+  ProfileMetadata,
+} from './profile-metadata';
+export {
+  combineProfiles,
+  diffProfiles,
+  mergeProfiles,
+  SampleType,
+} from './profile-combiner';
+export { shouldProfile, ShouldProfileOptions } from './fleet-sampling';
+export { stripLabels, StripLabelsOptions } from './profile-filters';
+export {
+  addProfiledThread,
+  collectAllThreads,
+  serveThreadProfiles,
+  THREAD_ID_LABEL,
+  ThreadPort,
+} from './threads';
+export {
+  findFunction,
+  FindFunctionOptions,
+  FoundFunction,
+  top,
+  TopFunction,
+  TopOptions,
+} from './profile-utils';
+export { supportedProfileTypes } from './profile-types';
+export { SourceMapEntry, SourceMapper } from './sourcemapper/sourcemapper';
+export {
+  enableMemoryTrigger,
+  MemoryTriggerOptions,
+  triggeredProfiler,
+  TriggeredProfilerOptions,
+} from './triggered-profiler';
+export { parseWasmFunctionNames, WasmFunctionNames } from './wasm';
 
 export const time = {
   profile: timeProfiler.profile,
   start: timeProfiler.start,
+  addMarker: timeProfiler.addMarker,
+  profileRequire: timeProfiler.profileRequire,
+  profilePromise: timeProfiler.profilePromise,
+  serialize: timeProfiler.serialize,
+  resetAdaptiveInterval: timeProfiler.resetAdaptiveInterval,
+  profileOnExit,
+  profileToFile,
+  startRingBuffer,
+  dumpRingBuffer,
+  stopRingBuffer,
 };
 
 export const heap = {
@@ -39,14 +139,11 @@ export const heap = {
   v8Profile: heapProfiler.v8Profile,
 };
 
+export const asyncResources = {
+  start: asyncResourceProfiler.start,
+};
+
 // If loaded with --require, start profiling.
 if (module.parent && module.parent.id === 'internal/preload') {
-  const stop = time.start();
-  process.on('exit', () => {
-    // The process is going to terminate imminently. All work here needs to
-    // be synchronous.
-    const profile = stop();
-    const buffer = encodeSync(profile);
-    writeFileSync(`pprof-profile-${process.pid}.pb.gz`, buffer);
-  });
+  profileOnExit({ dir: process.env[PROFILE_DIR_ENV] });
 }
@@ -0,0 +1,159 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as asyncHooks from 'async_hooks';
+
+import { nowMicros } from './metrics';
+
+/** Value of a numeric label, such as a number of bytes. */
+export interface NumericLabel {
+  num: number;
+  /** Unit of num, e.g. "bytes". */
+  unit?: string;
+}
+
+/** Value of a label: a string, or a number with an optional unit. */
+export type LabelValue = string | NumericLabel;
+
+/** Labels to attach to samples, from label key to value. */
+export interface LabelSet {
+  [key: string]: LabelValue;
+}
+
+/**
+ * Returns the labels for the code which is about to run or undefined if it
+ * has none, e.g. labels derived from the active trace context.
+ */
+export type LabelsProvider = () => LabelSet | undefined;
+
+/** A frame of the stack at which a sampled allocation was made. */
+export interface AllocationFrame {
+  name: string;
+  file: string;
+  line: number;
+}
+
+/**
+ * Returns the labels for heap samples allocated at the given stack, ordered
+ * from the allocating function to the outermost caller, or undefined if
+ * they have none.
+ */
+export type AllocationLabelsProvider = (
+  stack: AllocationFrame[]
+) => LabelSet | undefined;
+
+interface TimelineEntry {
+  /** Time in microseconds, on the clock of process.hrtime(). */
+  timestamp: number;
+  labels?: LabelSet;
+}
+
+/**
+ * @return string which is the same for equal sets of labels.
+ */
+export function labelsKey(labels?: LabelSet): string {
+  if (!labels) {
+    return '';
+  }
+  return Object.keys(labels)
+    .sort()
+    .map(k => {
+      const value = labels[k];
+      return typeof value === 'string'
+        ? `${k}=${value}`
+        : `${k}#${value.num}${value.unit || ''}`;
+    })
+    .join(',');
+}
+
+/**
+ * Records, while a time profile is collected, the labels returned by the
+ * providers each time the current labels may change, so that each sample of
+ * the profile can later be attributed the labels which were current when it
+ * was taken.
+ *
+ * Labels are read when the profile starts and before and after each
+ * asynchronous callback runs. A change of labels within a synchronous run of
+ * code, such as a span started and ended in the same callback, is only seen
+ * at the next callback boundary.
+ */
+export class LabelSetter {
+  private readonly timeline: TimelineEntry[] = [];
+  private lastKey = '';
+  private readonly hook: asyncHooks.AsyncHook;
+
+  constructor(private readonly providers: LabelsProvider[]) {
+    const update = () => this.update();
+    this.hook = asyncHooks.createHook({ before: update, after: update });
+  }
+
+  start() {
+    this.update();
+    this.hook.enable();
+  }
+
+  stop() {
+    this.hook.disable();
+  }
+
+  /**
+   * Reads the current labels from the providers and records them if they
+   * differ from the last labels recorded.
+   */
+  update() {
+    let labels: LabelSet | undefined;
+    for (const provider of this.providers) {
+      let provided: LabelSet | undefined;
+      try {
+        provided = provider();
+      } catch (err) {
+        // Errors thrown from async hooks terminate the process, so a failing
+        // provider contributes no labels instead.
+      }
+      if (provided) {
+        labels = { ...labels, ...provided };
+      }
+    }
+    const key = labelsKey(labels);
+    if (this.timeline.length > 0 && key === this.lastKey) {
+      return;
+    }
+    this.lastKey = key;
+    this.timeline.push({ timestamp: nowMicros(), labels });
+  }
+
+  /**
+   * @param timestamp - time in microseconds, on the clock of
+   * process.hrtime().
+   * @return labels which were current at timestamp.
+   */
+  labelsAt(timestamp: number): LabelSet | undefined {
+    // Binary search for the last entry recorded at or before timestamp.
+    let lo = 0;
+    let hi = this.timeline.length - 1;
+    let found = -1;
+    while (lo <= hi) {
+      const mid = (lo + hi) >>> 1;
+      if (this.timeline[mid].timestamp <= timestamp) {
+        found = mid;
+        lo = mid + 1;
+      } else {
+        hi = mid - 1;
+      }
+    }
+    return found === -1 ? undefined : this.timeline[found].labels;
+  }
+}
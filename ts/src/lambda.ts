@@ -0,0 +1,111 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { mergeProfiles } from './profile-combiner';
+import * as timeProfiler from './time-profiler';
+
+export interface LambdaProfilerOptions extends timeProfiler.StartOptions {
+  /**
+   * Minimum time in milliseconds between flushes of the merged profile. The
+   * profile is only flushed when an invocation ends, since the execution
+   * environment is frozen between invocations.
+   */
+  flushIntervalMillis: number;
+  /** Receives the profile merged from the invocations since the last flush. */
+  sink: (profile: perftools.profiles.IProfile) => void | Promise<void>;
+  /**
+   * Called when profiling an invocation or the sink fails. Defaults to
+   * console.error.
+   */
+  onError?: (err: Error) => void;
+}
+
+export interface LambdaProfiler {
+  /**
+   * @return handler which runs handler with a time profile of each
+   * invocation, merged into the profile flushed to the sink.
+   */
+  wrap<Event, Context, Result>(
+    handler: (event: Event, context: Context) => Promise<Result>
+  ): (event: Event, context: Context) => Promise<Result>;
+  /** Flushes the invocations profiled since the last flush, if any. */
+  flush(): Promise<void>;
+}
+
+/**
+ * Creates a profiler for AWS Lambda functions, or other environments which
+ * are frozen between invocations. Each invocation of a wrapped handler is
+ * profiled from when it is called until its promise settles, and profiles
+ * are merged across invocations so that memory use is bounded by the number
+ * of distinct stacks. Invocations which overlap one already being profiled
+ * are not profiled.
+ */
+export function lambdaProfiler(options: LambdaProfilerOptions): LambdaProfiler {
+  const { flushIntervalMillis, sink, onError, ...startOptions } = options;
+  const reportError = onError || ((err: Error) => console.error(err));
+  let merged: perftools.profiles.IProfile | undefined;
+  let lastFlush = Date.now();
+  let profiling = false;
+
+  const flush = async () => {
+    const profile = merged;
+    merged = undefined;
+    lastFlush = Date.now();
+    if (profile) {
+      try {
+        await sink(profile);
+      } catch (err) {
+        reportError(err);
+      }
+    }
+  };
+
+  const wrap = <Event, Context, Result>(
+    handler: (event: Event, context: Context) => Promise<Result>
+  ) => async (event: Event, context: Context): Promise<Result> => {
+    if (profiling) {
+      return handler(event, context);
+    }
+    let stop: () => perftools.profiles.IProfile;
+    try {
+      stop = timeProfiler.start(startOptions);
+    } catch (err) {
+      // Profiling must not fail the invocation.
+      reportError(err);
+      return handler(event, context);
+    }
+    profiling = true;
+    try {
+      return await handler(event, context);
+    } finally {
+      profiling = false;
+      // Errors are reported rather than thrown, so that the result or error
+      // of the handler is returned.
+      try {
+        const profile = stop();
+        merged = merged ? mergeProfiles([merged, profile]) : profile;
+      } catch (err) {
+        reportError(err);
+      }
+      if (Date.now() - lastFlush >= flushIntervalMillis) {
+        await flush();
+      }
+    }
+  };
+
+  return { wrap, flush };
+}
@@ -0,0 +1,93 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { LabelsProvider } from './label-setter';
+import { nowMicros } from './metrics';
+
+/** Label key under which the event loop lag bucket is recorded. */
+export const LOOP_LAG_LABEL = 'loop_lag_ms';
+
+/**
+ * Returns the current event loop lag in milliseconds, e.g. read from a
+ * histogram created with perf_hooks.monitorEventLoopDelay().
+ */
+export type LoopLagReader = () => number;
+
+// Lower bounds of the buckets into which lags are grouped, in milliseconds,
+// so that samples are split into a few groups rather than by exact lag.
+const LAG_BUCKETS_MILLIS = [0, 10, 50, 100, 500, 1000];
+
+const DEFAULT_RESOLUTION_MILLIS = 10;
+
+/**
+ * @return lower bound of the bucket of lagMillis.
+ */
+export function lagBucket(lagMillis: number): number {
+  let bucket = LAG_BUCKETS_MILLIS[0];
+  for (const bound of LAG_BUCKETS_MILLIS) {
+    if (lagMillis >= bound) {
+      bucket = bound;
+    }
+  }
+  return bucket;
+}
+
+/**
+ * @return labels provider which returns the bucket of the lag returned by
+ * readLag as the loop_lag_ms label.
+ */
+export function loopLagLabelsProvider(readLag: LoopLagReader): LabelsProvider {
+  return () => ({
+    [LOOP_LAG_LABEL]: { num: lagBucket(readLag()), unit: 'ms' },
+  });
+}
+
+/**
+ * Measures the event loop lag with a timer: the lag is how much later than
+ * scheduled the timer last ran. A lag is thus only known once the loop is no
+ * longer blocked, and the lag reported is the one last measured.
+ */
+export class LoopLagMonitor {
+  private lag = 0;
+  private timer?: NodeJS.Timer;
+
+  constructor(
+    private readonly resolutionMillis: number = DEFAULT_RESOLUTION_MILLIS
+  ) {}
+
+  start() {
+    let last = nowMicros();
+    this.timer = setInterval(() => {
+      const now = nowMicros();
+      this.lag = Math.max(0, (now - last) / 1000 - this.resolutionMillis);
+      last = now;
+    }, this.resolutionMillis);
+    // Monitoring should not keep the process alive.
+    this.timer.unref();
+  }
+
+  stop() {
+    if (this.timer) {
+      clearInterval(this.timer);
+      this.timer = undefined;
+    }
+  }
+
+  /** @return lag in milliseconds last measured. */
+  lagMillis(): number {
+    return this.lag;
+  }
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { encodeSync } from './profile-encoder';
+import { SourceMapStats } from './profile-serializer';
+
+/**
+ * Measurements of the profiler's own work for a single collection.
+ */
+export interface ProfilerMetrics {
+  /** Time spent retrieving the profile from V8, in milliseconds. */
+  collectMillis: number;
+  /** Time spent converting the V8 profile to pprof format, in milliseconds. */
+  serializeMillis: number;
+  /** Time spent encoding the pprof profile, in milliseconds. */
+  encodeMillis: number;
+  /** Number of samples in the pprof profile. */
+  sampleCount: number;
+  /** Size of the encoded profile, in bytes. */
+  bytes: number;
+  /**
+   * Number of distinct locations in JavaScript files on disk which were
+   * source mapped. Only set when the profile was serialized with a source
+   * mapper.
+   */
+  mappedFrames?: number;
+  /**
+   * Number of distinct locations in JavaScript files on disk which could not
+   * be source mapped. Only set with mappedFrames.
+   */
+  unmappedFrames?: number;
+}
+
+export type MetricsCallback = (metrics: ProfilerMetrics) => void;
+
+/**
+ * @return milliseconds elapsed since start, a result of process.hrtime().
+ */
+export function millisSince(start: [number, number]): number {
+  const [seconds, nanos] = process.hrtime(start);
+  return seconds * 1e3 + nanos / 1e6;
+}
+
+/**
+ * @return current time in microseconds, on the clock of process.hrtime().
+ */
+export function nowMicros(): number {
+  const [seconds, nanos] = process.hrtime();
+  return seconds * 1e6 + nanos / 1e3;
+}
+
+/**
+ * Invokes onMetrics with metrics for a collected profile.
+ *
+ * The profile is encoded once to measure the encode time and encoded size,
+ * so reporting metrics adds the cost of one encode to each collection.
+ */
+export function reportMetrics(
+  onMetrics: MetricsCallback,
+  profile: perftools.profiles.IProfile,
+  collectMillis: number,
+  serializeMillis: number,
+  sourceMapStats?: SourceMapStats
+) {
+  const start = process.hrtime();
+  const bytes = encodeSync(profile).length;
+  onMetrics({
+    collectMillis,
+    serializeMillis,
+    encodeMillis: millisSince(start),
+    sampleCount: (profile.sample || []).length,
+    bytes,
+    ...sourceMapStats,
+  });
+}
@@ -0,0 +1,49 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * Object with a key for each option of T, whether required or optional.
+ * Declaring valid option names this way makes the compiler check that they
+ * match the options interface.
+ */
+export type OptionKeys<T> = { [K in keyof Required<T>]: true };
+
+/**
+ * Throws if options has a key which is not a valid option, e.g. a misspelled
+ * option name which would otherwise be ignored.
+ *
+ * @param options - options passed to fnName.
+ * @param validKeys - valid option names.
+ * @param fnName - name of the function the options were passed to, used in
+ * the error message.
+ */
+export function checkOptionKeys<T>(
+  options: T,
+  validKeys: OptionKeys<T>,
+  fnName: string
+) {
+  const unknown = Object.keys(options).filter(
+    k => !Object.prototype.hasOwnProperty.call(validKeys, k)
+  );
+  if (unknown.length > 0) {
+    const valid = Object.keys(validKeys).sort();
+    throw new Error(
+      `Unknown option${unknown.length > 1 ? 's' : ''} ` +
+        `${unknown.map(k => `"${k}"`).join(', ')} for ${fnName}. ` +
+        `Valid options are: ${valid.join(', ')}.`
+    );
+  }
+}
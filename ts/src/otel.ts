@@ -0,0 +1,60 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { LabelsProvider } from './label-setter';
+
+/** Label keys under which the ids of the active span are recorded. */
+export const TRACE_ID_LABEL = 'trace_id';
+export const SPAN_ID_LABEL = 'span_id';
+
+// The subset of the @opentelemetry/api package used to find the active span.
+export interface OtelApi {
+  context: { active(): unknown };
+  trace: {
+    getSpan(context: unknown):
+      | { spanContext(): { traceId: string; spanId: string } }
+      | undefined;
+  };
+}
+
+/**
+ * @return the @opentelemetry/api package of the application. Throws if it
+ * cannot be loaded, as pprof does not depend on it.
+ */
+export function loadOtelApi(): OtelApi {
+  try {
+    return require('@opentelemetry/api');
+  } catch (err) {
+    throw new Error(
+      `otelContext requires the @opentelemetry/api package: ${err.message}`
+    );
+  }
+}
+
+/**
+ * @return labels provider which returns the trace and span ids of the
+ * active OpenTelemetry span, if any.
+ */
+export function otelLabelsProvider(api: OtelApi): LabelsProvider {
+  return () => {
+    const span = api.trace.getSpan(api.context.active());
+    if (!span) {
+      return undefined;
+    }
+    const { traceId, spanId } = span.spanContext();
+    return { [TRACE_ID_LABEL]: traceId, [SPAN_ID_LABEL]: spanId };
+  };
+}
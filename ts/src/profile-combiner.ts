@@ -0,0 +1,302 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import {
+  getString,
+  isSourceMapped,
+  markSourceMapped,
+  ProfileBuilder,
+  toNumber,
+} from './profile-utils';
+
+export interface SampleType {
+  type: string;
+  unit: string;
+}
+
+/**
+ * Canonical order of the sample types produced by the time and heap
+ * serializers. Profiles with several kinds of samples order their sample
+ * types this way, with time sample types before heap sample types. Sample
+ * types not in this list are placed after these.
+ */
+export const CANONICAL_SAMPLE_TYPES: SampleType[] = [
+  { type: 'sample', unit: 'count' },
+  { type: 'wall', unit: 'microseconds' },
+  { type: 'objects', unit: 'count' },
+  { type: 'space', unit: 'bytes' },
+];
+
+function sampleTypeKey(st: SampleType): string {
+  return `${st.type}/${st.unit}`;
+}
+
+/**
+ * @return sample types of profile, as strings.
+ */
+export function getSampleTypes(
+  profile: perftools.profiles.IProfile
+): SampleType[] {
+  return (profile.sampleType || []).map(st => ({
+    type: getString(profile, st.type),
+    unit: getString(profile, st.unit),
+  }));
+}
+
+/**
+ * @return union of the sample types of all profiles, in canonical order.
+ */
+function canonicalSampleTypes(
+  profiles: perftools.profiles.IProfile[]
+): SampleType[] {
+  const rank = (st: SampleType) => {
+    const key = sampleTypeKey(st);
+    const idx = CANONICAL_SAMPLE_TYPES.findIndex(c => sampleTypeKey(c) === key);
+    return idx === -1 ? CANONICAL_SAMPLE_TYPES.length : idx;
+  };
+  const seen = new Set<string>();
+  const sampleTypes: SampleType[] = [];
+  for (const profile of profiles) {
+    for (const st of getSampleTypes(profile)) {
+      if (!seen.has(sampleTypeKey(st))) {
+        seen.add(sampleTypeKey(st));
+        sampleTypes.push(st);
+      }
+    }
+  }
+  // Array.prototype.sort is not guaranteed to be stable, so ties are broken
+  // by order of first appearance.
+  return sampleTypes
+    .map((st, idx) => ({ st, idx }))
+    .sort((a, b) => rank(a.st) - rank(b.st) || a.idx - b.idx)
+    .map(e => e.st);
+}
+
+/**
+ * Copies samples of profiles into builder, placing each sample's values in
+ * the column for its sample type, and zero-filling all other columns.
+ */
+function addSamples(
+  builder: ProfileBuilder,
+  profiles: perftools.profiles.IProfile[],
+  sampleTypes: SampleType[]
+) {
+  const columns = sampleTypes.map(sampleTypeKey);
+  for (const profile of profiles) {
+    const locationIds = builder.addLocationsOf(profile);
+    const columnIdx = getSampleTypes(profile).map(st =>
+      columns.indexOf(sampleTypeKey(st))
+    );
+    for (const sample of profile.sample || []) {
+      const values = new Array<number>(columns.length).fill(0);
+      (sample.value || []).forEach((v, i) => {
+        values[columnIdx[i]] += toNumber(v);
+      });
+      builder.addSample(profile, sample, locationIds, values);
+    }
+  }
+}
+
+/**
+ * Combines a time profile and a heap profile into a single profile with the
+ * sample types of both, in canonical order. Each sample keeps the values for
+ * its own sample types; values for the other profile's sample types are 0.
+ *
+ * The period and period type of the combined profile are those of the time
+ * profile.
+ *
+ * @param time - time profile, as returned by time.profile().
+ * @param heap - heap profile, as returned by heap.profile().
+ */
+export function combineProfiles(
+  time: perftools.profiles.IProfile,
+  heap: perftools.profiles.IProfile
+): perftools.profiles.IProfile {
+  const profiles = [time, heap];
+  const builder = new ProfileBuilder();
+  const sampleTypes = canonicalSampleTypes(profiles);
+  const sampleType = sampleTypes.map(st => builder.valueType(st.type, st.unit));
+  addSamples(builder, profiles, sampleTypes);
+
+  const timeNanos = profiles
+    .map(p => toNumber(p.timeNanos))
+    .filter(t => t > 0)
+    .reduce((min, t) => (min === 0 || t < min ? t : min), 0);
+  const comment: number[] = [];
+  for (const p of profiles) {
+    for (const c of p.comment || []) {
+      comment.push(builder.addString(getString(p, c)));
+    }
+  }
+  const periodType = time.periodType
+    ? builder.valueType(
+        getString(time, time.periodType.type),
+        getString(time, time.periodType.unit)
+      )
+    : undefined;
+
+  return {
+    sampleType,
+    sample: builder.samples,
+    location: builder.locations,
+    function: builder.functions,
+    stringTable: builder.stringTable,
+    timeNanos,
+    durationNanos: toNumber(time.durationNanos),
+    periodType,
+    period: toNumber(time.period),
+    comment,
+  };
+}
+
+/**
+ * Throws if profiles do not all have the same sample types.
+ * @param verb - operation on the profiles, used in the error message.
+ */
+function checkSameSampleTypes(
+  profiles: perftools.profiles.IProfile[],
+  verb: string
+) {
+  const key = getSampleTypes(profiles[0])
+    .map(sampleTypeKey)
+    .join(',');
+  for (const profile of profiles) {
+    const otherKey = getSampleTypes(profile)
+      .map(sampleTypeKey)
+      .join(',');
+    if (otherKey !== key) {
+      throw new Error(
+        `Cannot ${verb} profiles with sample types [${otherKey}] and [${key}].`
+      );
+    }
+  }
+}
+
+/**
+ * Merges profiles with the same sample types, such as consecutive time
+ * profiles, into a single profile. Values of samples with the same stack and
+ * labels are summed.
+ *
+ * The merged profile starts at the earliest start time of the profiles, and
+ * its duration is the sum of their durations. Its period and period type are
+ * those of the first profile.
+ */
+export function mergeProfiles(
+  profiles: perftools.profiles.IProfile[]
+): perftools.profiles.IProfile {
+  if (profiles.length === 0) {
+    throw new Error('At least one profile is required.');
+  }
+  const first = profiles[0];
+  const sampleTypes = getSampleTypes(first);
+  checkSameSampleTypes(profiles, 'merge');
+
+  const builder = new ProfileBuilder();
+  const sampleType = sampleTypes.map(st => builder.valueType(st.type, st.unit));
+  let durationNanos = 0;
+  const comments = new Set<string>();
+  for (const profile of profiles) {
+    const locationIds = builder.addLocationsOf(profile);
+    for (const sample of profile.sample || []) {
+      const values = (sample.value || []).map(toNumber);
+      builder.mergeSample(profile, sample, locationIds, values);
+    }
+    durationNanos += toNumber(profile.durationNanos);
+    for (const c of profile.comment || []) {
+      comments.add(getString(profile, c));
+    }
+  }
+  const timeNanos = profiles
+    .map(p => toNumber(p.timeNanos))
+    .filter(t => t > 0)
+    .reduce((min, t) => (min === 0 || t < min ? t : min), 0);
+  const comment = Array.from(comments).map(c => builder.addString(c));
+  const periodType = first.periodType
+    ? builder.valueType(
+        getString(first, first.periodType.type),
+        getString(first, first.periodType.unit)
+      )
+    : undefined;
+
+  const merged = {
+    sampleType,
+    sample: builder.samples,
+    location: builder.locations,
+    function: builder.functions,
+    stringTable: builder.stringTable,
+    timeNanos,
+    durationNanos,
+    periodType,
+    period: toNumber(first.period),
+    comment,
+  };
+  if (profiles.some(isSourceMapped)) {
+    markSourceMapped(merged);
+  }
+  return merged;
+}
+
+/**
+ * Computes the change from profile before to profile after, which must have
+ * the same sample types. Each sample of the result has the values of after
+ * minus those of before for one stack and set of labels, so values are
+ * negative where before has more. Stacks whose values did not change are
+ * omitted.
+ *
+ * The result has the start time, duration, period and period type of after.
+ * As with `pprof -diff_base`, positive values show what after added.
+ */
+export function diffProfiles(
+  before: perftools.profiles.IProfile,
+  after: perftools.profiles.IProfile
+): perftools.profiles.IProfile {
+  checkSameSampleTypes([after, before], 'diff');
+  const builder = new ProfileBuilder();
+  const sampleType = getSampleTypes(after).map(st =>
+    builder.valueType(st.type, st.unit)
+  );
+  for (const [profile, sign] of [
+    [after, 1],
+    [before, -1],
+  ] as Array<[perftools.profiles.IProfile, number]>) {
+    const locationIds = builder.addLocationsOf(profile);
+    for (const sample of profile.sample || []) {
+      const values = (sample.value || []).map(v => sign * toNumber(v));
+      builder.mergeSample(profile, sample, locationIds, values);
+    }
+  }
+  const periodType = after.periodType
+    ? builder.valueType(
+        getString(after, after.periodType.type),
+        getString(after, after.periodType.unit)
+      )
+    : undefined;
+
+  return {
+    sampleType,
+    sample: builder.samples.filter(s =>
+      s.value.some(v => toNumber(v) !== 0)
+    ),
+    location: builder.locations,
+    function: builder.functions,
+    stringTable: builder.stringTable,
+    timeNanos: toNumber(after.timeNanos),
+    durationNanos: toNumber(after.durationNanos),
+    periodType,
+    period: toNumber(after.period),
+  };
+}
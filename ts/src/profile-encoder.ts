@@ -14,21 +14,298 @@
  * limitations under the License.
  */
 
+import { createHash } from 'crypto';
 import * as pify from 'pify';
-import { gzip, gzipSync } from 'zlib';
+import {
+  brotliCompress,
+  brotliCompressSync,
+  brotliDecompress,
+  brotliDecompressSync,
+  gunzip,
+  gunzipSync,
+  gzip,
+  gzipSync,
+} from 'zlib';
 
 import { perftools } from '../../proto/profile';
+import { checkCloudProfilerProfile } from './cloud-profiler';
+import { sourceMapBaseComment } from './profile-metadata';
+import { copyStringTable, isSourceMapped, withComment } from './profile-utils';
 
 const gzipPromise = pify(gzip);
+const gunzipPromise = pify(gunzip);
 
-export async function encode(
+export interface EncodeOptions {
+  /**
+   * Compression of the encoded profile. This defaults to 'gzip', which is
+   * what pprof reads. 'br' (Brotli) compresses better, e.g. for archiving
+   * profiles, and requires Node.js 10.16 or later; decode() and decodeSync()
+   * read both.
+   */
+  algorithm?: 'gzip' | 'br';
+  /**
+   * Consumer of the encoded profile. With 'cloud-profiler', encoding throws
+   * unless the profile can be uploaded to Google Cloud Profiler as is.
+   * This defaults to 'pprof', which accepts any profile.
+   */
+  target?: 'pprof' | 'cloud-profiler';
+  /**
+   * When true, a Buffer or Uint8Array passed in place of a profile is
+   * gzipped as is, even if it is already gzipped. Otherwise encoding a buffer
+   * throws a TypeError, since it usually means encode() was called on its
+   * own output.
+   */
+  reGzip?: boolean;
+  /**
+   * When set, the first mapping of the profile, which pprof treats as the
+   * main binary, describes this binary instead, e.g. the Node.js binary
+   * which produced the profile as it is found on the host analyzing it.
+   */
+  mainMapping?: MainMapping;
+  /**
+   * Regular expression, in the syntax of pprof, matching frames which pprof
+   * hides by default along with their callees, e.g. framework internals.
+   * Recorded as the drop_frames field of the profile.
+   */
+  dropFrames?: string;
+  /**
+   * Regular expression matching frames which pprof keeps even if they match
+   * dropFrames. Recorded as the keep_frames field of the profile.
+   */
+  keepFrames?: string;
+  /**
+   * Function applied to the profile before it is encoded, e.g. to relabel
+   * samples or scrub file names. It may modify the profile or return a new
+   * one, and runs before the other options are applied.
+   */
+  transform?: ProfileTransform;
+  /**
+   * When set, the profile is marked as not source mapped, with the location
+   * of its source maps recorded as a profile comment (see
+   * getSourceMapBaseUrl()), so that the server receiving it can apply them.
+   * Encoding does not source map profiles, so to save the cost of mapping in
+   * the profiled process, collect the profile with sourceMap: false.
+   */
+  deferSourceMap?: DeferSourceMap;
+}
+
+/** Location of the source maps to be applied to a profile by its consumer. */
+export interface DeferSourceMap {
+  /**
+   * URL under which the source maps of the generated files of the profile
+   * are found, e.g. https://example.com/maps/<build id>/.
+   */
+  mapBaseUrl: string;
+}
+
+export type ProfileTransform = (
   profile: perftools.profiles.IProfile
+) => perftools.profiles.IProfile;
+
+/** The binary to record as the main mapping of a profile. */
+export interface MainMapping {
+  /** Path of the binary. */
+  filename: string;
+  /** Build ID of the binary. */
+  buildId?: string;
+  /** Address at which the binary is loaded. */
+  start?: number;
+  /** Address following the last address of the binary. */
+  limit?: number;
+}
+
+// First two bytes of gzipped data.
+const GZIP_MAGIC = [0x1f, 0x8b];
+
+function isGzipped(buffer: Uint8Array): boolean {
+  return (
+    buffer.length >= 2 &&
+    buffer[0] === GZIP_MAGIC[0] &&
+    buffer[1] === GZIP_MAGIC[1]
+  );
+}
+
+function checkBrotli() {
+  if (typeof brotliCompressSync !== 'function') {
+    throw new Error(
+      `Brotli requires Node.js 10.16 or later, running ${process.version}.`
+    );
+  }
+}
+
+/**
+ * @return serialized profile to be compressed.
+ */
+function serialize(
+  profile: perftools.profiles.IProfile | Uint8Array,
+  options: EncodeOptions
+): Uint8Array {
+  if (profile instanceof Uint8Array) {
+    if (options.reGzip) {
+      return profile;
+    }
+    const kind = isGzipped(profile) ? 'a gzipped buffer' : 'a buffer';
+    throw new TypeError(
+      `Expected a profile object, got ${kind}. Buffers returned by encode() ` +
+        'are already encoded; pass {reGzip: true} to gzip a buffer anyway.'
+    );
+  }
+  if (options.deferSourceMap && isSourceMapped(profile)) {
+    // Its consumer would then apply source maps twice.
+    throw new Error(
+      'deferSourceMap requires a profile which is not source mapped; ' +
+        'collect it with sourceMap: false.'
+    );
+  }
+  if (options.transform) {
+    profile = applyTransform(profile, options.transform);
+  }
+  if (options.mainMapping) {
+    profile = withMainMapping(profile, options.mainMapping);
+  }
+  if (options.dropFrames !== undefined || options.keepFrames !== undefined) {
+    profile = withFrameFilters(profile, options);
+  }
+  if (options.deferSourceMap) {
+    profile = withSourceMapBase(profile, options.deferSourceMap.mapBaseUrl);
+  }
+  checkTarget(profile, options);
+  return perftools.profiles.Profile.encode(profile).finish();
+}
+
+function applyTransform(
+  profile: perftools.profiles.IProfile,
+  transform: ProfileTransform
+): perftools.profiles.IProfile {
+  let result: perftools.profiles.IProfile;
+  try {
+    result = transform(profile);
+  } catch (err) {
+    throw new Error(`Profile transform failed: ${err.message || err}`);
+  }
+  if (typeof result !== 'object' || result === null) {
+    throw new TypeError(
+      `Profile transform must return a profile, got ${result}.`
+    );
+  }
+  return result;
+}
+
+/**
+ * @return copy of profile whose first mapping describes main. An existing
+ * first mapping is replaced, keeping its id.
+ */
+function withMainMapping(
+  profile: perftools.profiles.IProfile,
+  main: MainMapping
+): perftools.profiles.IProfile {
+  const { stringTable, addString } = copyStringTable(profile);
+  const mapping = (profile.mapping || []).slice();
+  mapping[0] = new perftools.profiles.Mapping({
+    id: mapping.length > 0 ? mapping[0].id : 1,
+    memoryStart: main.start,
+    memoryLimit: main.limit,
+    filename: addString(main.filename),
+    buildId: main.buildId ? addString(main.buildId) : undefined,
+  });
+  return { ...profile, stringTable, mapping };
+}
+
+/**
+ * @return copy of profile whose drop_frames and keep_frames fields are set
+ * to the regular expressions of options, when specified.
+ */
+function withFrameFilters(
+  profile: perftools.profiles.IProfile,
+  options: EncodeOptions
+): perftools.profiles.IProfile {
+  const { stringTable, addString } = copyStringTable(profile);
+  const result = { ...profile, stringTable };
+  if (options.dropFrames !== undefined) {
+    result.dropFrames = addString(options.dropFrames);
+  }
+  if (options.keepFrames !== undefined) {
+    result.keepFrames = addString(options.keepFrames);
+  }
+  return result;
+}
+
+/**
+ * @return copy of profile with a comment recording mapBaseUrl.
+ */
+function withSourceMapBase(
+  profile: perftools.profiles.IProfile,
+  mapBaseUrl: string
+): perftools.profiles.IProfile {
+  return withComment(profile, sourceMapBaseComment(mapBaseUrl));
+}
+
+function checkTarget(
+  profile: perftools.profiles.IProfile,
+  options: EncodeOptions
+) {
+  if (options.target === 'cloud-profiler') {
+    checkCloudProfilerProfile(profile);
+  }
+}
+
+export async function encode(
+  profile: perftools.profiles.IProfile | Uint8Array,
+  options: EncodeOptions = {}
 ): Promise<Buffer> {
-  const buffer = perftools.profiles.Profile.encode(profile).finish();
-  return gzipPromise(buffer);
+  const serialized = serialize(profile, options);
+  if (options.algorithm === 'br') {
+    checkBrotli();
+    return pify(brotliCompress)(serialized);
+  }
+  return gzipPromise(serialized);
+}
+
+export function encodeSync(
+  profile: perftools.profiles.IProfile | Uint8Array,
+  options: EncodeOptions = {}
+): Buffer {
+  const serialized = serialize(profile, options);
+  if (options.algorithm === 'br') {
+    checkBrotli();
+    return brotliCompressSync(serialized);
+  }
+  return gzipSync(serialized);
+}
+
+/**
+ * @return hex encoded SHA-256 digest of the serialized profile. Unlike a
+ * digest of the output of encode(), which depends on gzip, it is the same for
+ * equal profiles, including a profile and the result of decoding it.
+ */
+export function profileHash(profile: perftools.profiles.IProfile): string {
+  return createHash('sha256')
+    .update(perftools.profiles.Profile.encode(profile).finish())
+    .digest('hex');
+}
+
+/**
+ * Decodes a gzipped profile, as produced by encode() or written by pprof, or
+ * a profile encoded with {algorithm: 'br'}. Data which does not start like
+ * gzipped data is decompressed as Brotli, since Brotli has no header.
+ */
+export async function decode(
+  buffer: Buffer
+): Promise<perftools.profiles.Profile> {
+  let unzipped: Buffer;
+  if (isGzipped(buffer)) {
+    unzipped = await gunzipPromise(buffer);
+  } else {
+    checkBrotli();
+    unzipped = await pify(brotliDecompress)(buffer);
+  }
+  return perftools.profiles.Profile.decode(unzipped);
 }
 
-export function encodeSync(profile: perftools.profiles.IProfile): Buffer {
-  const buffer = perftools.profiles.Profile.encode(profile).finish();
-  return gzipSync(buffer);
+export function decodeSync(buffer: Buffer): perftools.profiles.Profile {
+  if (isGzipped(buffer)) {
+    return perftools.profiles.Profile.decode(gunzipSync(buffer));
+  }
+  checkBrotli();
+  return perftools.profiles.Profile.decode(brotliDecompressSync(buffer));
 }
@@ -0,0 +1,68 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { getString, ProfileBuilder, toNumber } from './profile-utils';
+
+export interface StripLabelsOptions {
+  /** Keys of labels to keep. All other labels are removed. */
+  keep?: string[];
+}
+
+/**
+ * Returns a copy of profile without sample labels, except those whose key is
+ * in options.keep. Samples which only differed by removed labels are merged,
+ * and strings which were only used by removed labels are dropped from the
+ * string table.
+ */
+export function stripLabels(
+  profile: perftools.profiles.IProfile,
+  options: StripLabelsOptions = {}
+): perftools.profiles.IProfile {
+  const keep = new Set(options.keep || []);
+  const builder = new ProfileBuilder();
+  const valueType = (vt: perftools.profiles.IValueType) =>
+    builder.valueType(getString(profile, vt.type), getString(profile, vt.unit));
+  const sampleType = (profile.sampleType || []).map(valueType);
+
+  const locationIds = builder.addLocationsOf(profile);
+  for (const sample of profile.sample || []) {
+    const label = (sample.label || []).filter(l =>
+      keep.has(getString(profile, l.key))
+    );
+    const values = (sample.value || []).map(toNumber);
+    builder.mergeSample(profile, { ...sample, label }, locationIds, values);
+  }
+  const comment = (profile.comment || []).map(c =>
+    builder.addString(getString(profile, c))
+  );
+
+  return {
+    sampleType,
+    sample: builder.samples,
+    location: builder.locations,
+    function: builder.functions,
+    stringTable: builder.stringTable,
+    timeNanos: toNumber(profile.timeNanos),
+    durationNanos: toNumber(profile.durationNanos),
+    periodType: profile.periodType ? valueType(profile.periodType) : undefined,
+    period: toNumber(profile.period),
+    comment,
+    defaultSampleType: profile.defaultSampleType
+      ? builder.addString(getString(profile, profile.defaultSampleType))
+      : undefined,
+  };
+}
@@ -0,0 +1,124 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { formatNumber } from './profile-utils';
+
+/**
+ * Environment variable from which the revision of the profiled application
+ * is read when it is not specified in ProfileMetadata.
+ */
+export const REVISION_ENV = 'PPROF_REVISION';
+
+const REVISION_PREFIX = 'revision=';
+const MARKER_PREFIX = 'marker=';
+const MARKER_REGEX = /^marker=(\d+)ms:([^]*)$/;
+const TIME_LIMITED_PREFIX = 'time_limited=';
+const SOURCE_MAP_BASE_PREFIX = 'source_map_base=';
+
+/** A named point in time during a profile, e.g. a deploy. */
+export interface ProfileMarker {
+  name: string;
+  /** Time since the start of the profile, in milliseconds. */
+  offsetMillis: number;
+}
+
+/**
+ * Information about the profiled application which is recorded in each
+ * profile, as profile comments.
+ */
+export interface ProfileMetadata {
+  /**
+   * Revision (e.g. git commit) or build id of the profiled application.
+   * Defaults to the value of the PPROF_REVISION environment variable.
+   */
+  revision?: string;
+}
+
+/**
+ * @return profile comments recording metadata.
+ */
+export function metadataComments(metadata: ProfileMetadata = {}): string[] {
+  const revision = metadata.revision || process.env[REVISION_ENV];
+  return revision ? [`${REVISION_PREFIX}${revision}`] : [];
+}
+
+/**
+ * @return profile comment recording marker.
+ */
+export function markerComment(marker: ProfileMarker): string {
+  const offset = formatNumber(Math.round(marker.offsetMillis));
+  return `${MARKER_PREFIX}${offset}ms:${marker.name}`;
+}
+
+/**
+ * @return markers recorded in the given profile comments, in order.
+ */
+export function getMarkers(comments: string[]): ProfileMarker[] {
+  const markers: ProfileMarker[] = [];
+  for (const comment of comments) {
+    const match = MARKER_REGEX.exec(comment);
+    if (match) {
+      markers.push({ name: match[2], offsetMillis: Number(match[1]) });
+    }
+  }
+  return markers;
+}
+
+/**
+ * @return profile comment recording that a profile requested for
+ * requestedMillis was shortened to end before the process is terminated.
+ */
+export function timeLimitedComment(requestedMillis: number): string {
+  const requested = formatNumber(Math.round(requestedMillis));
+  return `${TIME_LIMITED_PREFIX}requested ${requested}ms`;
+}
+
+/**
+ * @return whether the given profile comments record that the profile was
+ * shortened by maxProcessLifetimeMillis.
+ */
+export function isTimeLimited(comments: string[]): boolean {
+  return comments.some(c => c.startsWith(TIME_LIMITED_PREFIX));
+}
+
+/**
+ * @return profile comment recording that source maps of the profile are to
+ * be applied by the consumer of the profile, which finds them at mapBaseUrl.
+ */
+export function sourceMapBaseComment(mapBaseUrl: string): string {
+  return `${SOURCE_MAP_BASE_PREFIX}${mapBaseUrl}`;
+}
+
+/**
+ * @return base URL of the source maps to apply to a profile, recorded in the
+ * given profile comments when it was encoded with deferSourceMap, if any.
+ */
+export function getSourceMapBaseUrl(comments: string[]): string | undefined {
+  const comment = comments.find(c => c.startsWith(SOURCE_MAP_BASE_PREFIX));
+  return comment === undefined
+    ? undefined
+    : comment.slice(SOURCE_MAP_BASE_PREFIX.length);
+}
+
+/**
+ * @return revision recorded in the given profile comments, if any.
+ */
+export function getRevision(comments: string[]): string | undefined {
+  const comment = comments.find(c => c.startsWith(REVISION_PREFIX));
+  return comment === undefined
+    ? undefined
+    : comment.slice(REVISION_PREFIX.length);
+}
@@ -0,0 +1,45 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { encodeSync } from './profile-encoder';
+
+export const DEFAULT_PRINT_PREFIX = 'PPROF_PROFILE';
+
+export interface PrintOptions {
+  /**
+   * Marker at the start of the printed line, separated from the profile by a
+   * single space. Defaults to PPROF_PROFILE.
+   */
+  prefix?: string;
+}
+
+/**
+ * Writes profile to stdout as a single line containing prefix, a space, and
+ * the base64 encoded gzipped profile, so that it can be extracted from logs
+ * in environments without a writable filesystem.
+ *
+ * The write is synchronous when stdout is a file or pipe, so this may be
+ * called from a process 'exit' handler.
+ */
+export function printProfile(
+  profile: perftools.profiles.IProfile,
+  options: PrintOptions = {}
+) {
+  const prefix = options.prefix || DEFAULT_PRINT_PREFIX;
+  const encoded = encodeSync(profile).toString('base64');
+  process.stdout.write(`${prefix} ${encoded}\n`);
+}
@@ -14,7 +14,18 @@
  * limitations under the License.
  */
 
+import * as path from 'path';
+
 import { perftools } from '../../proto/profile';
+import {
+  AllocationFrame,
+  AllocationLabelsProvider,
+  labelsKey,
+  LabelSet,
+  LabelValue,
+} from './label-setter';
+import { SampleType } from './profile-combiner';
+import { markSourceMapped } from './profile-utils';
 import {
   GeneratedLocation,
   SourceLocation,
@@ -26,6 +37,13 @@ import {
   TimeProfile,
   TimeProfileNode,
 } from './v8-types';
+import { wasmFunctionIndex, WasmFunctionNames } from './wasm';
+
+/**
+ * Name of the label holding the time at which a sample of a timeline was
+ * taken, in nanoseconds.
+ */
+export const TIMESTAMP_LABEL = 'timestamp_ns';
 
 /**
  * A stack of function IDs.
@@ -41,6 +59,179 @@ type AppendEntryToSamples<T extends ProfileNode> = (
   samples: perftools.profiles.Sample[]
 ) => void;
 
+/**
+ * Options which control how a v8 profile is converted to a profile proto.
+ */
+export interface SerializeOptions {
+  /**
+   * When true, the column number of each location is recorded in its line
+   * information, along with the line number.
+   */
+  columnNumbers?: boolean;
+
+  /**
+   * When true, the system name of each function records the id of its
+   * script in V8, as "<name> [script <id>]", and relative file names are
+   * resolved to absolute paths, so that functions of different files with
+   * the same name can be told apart.
+   */
+  scriptIds?: boolean;
+
+  /**
+   * Time profiles only. When true, frames of Node.js internal modules, whose
+   * file name starts with "node:" or "internal/", are removed and their
+   * samples are attributed to the nearest caller outside of them.
+   */
+  stripNodeInternals?: boolean;
+
+  /**
+   * Time profiles only. Leaf frames with fewer than this many samples of
+   * their own are removed and their samples are attributed to their caller.
+   * Pruning proceeds bottom up, so a caller left without callees may in turn
+   * be removed. Top-level frames are never removed.
+   */
+  minSelfSamples?: number;
+
+  /**
+   * Comments recorded in the profile, such as metadata about the profiled
+   * application.
+   */
+  comments?: string[];
+
+  /**
+   * Time profiles with recorded samples only. Returns the labels to attach
+   * to a sample taken at the given time, in microseconds.
+   */
+  labelsAt?: (timestamp: number) => LabelSet | undefined;
+
+  /**
+   * Time profiles with recorded samples only. Samples taken before this
+   * time, in microseconds on the clock of process.hrtime(), are excluded,
+   * and the profile's duration starts at this time.
+   */
+  cutoffTimestamp?: number;
+
+  /**
+   * Time profiles with recorded samples only. When true, each sample is
+   * serialized separately, with a timestamp_ns label holding the time at
+   * which it was taken in nanoseconds since the epoch.
+   */
+  timeline?: boolean;
+
+  /**
+   * With timeline, timestamp_ns labels hold the time since the start of the
+   * profile instead of since the epoch.
+   */
+  relativeTimestamps?: boolean;
+
+  /**
+   * Time profiles only. Time at which the profile was collected, in
+   * nanoseconds since the epoch, recorded as its time_nanos and, with
+   * timeline, used as the time at which its last sample was taken. Defaults
+   * to the time of serialization.
+   */
+  timeNanos?: number;
+
+  /**
+   * Time profiles only. When set, only the samples of the topStacks stacks
+   * with the most samples are kept. The samples of all other stacks are
+   * attributed to a single "(other)" frame, so totals are unchanged.
+   */
+  topStacks?: number;
+
+  /**
+   * Time profiles only. When set, only the samples of stacks with at least
+   * this percentage of all samples are kept. As with topStacks, the samples
+   * of all other stacks are attributed to a single "(other)" frame. With
+   * both, only the stacks which satisfy both are kept.
+   */
+  minCumulativePercent?: number;
+
+  /**
+   * Time profiles only. When set, the stack of each sample is truncated to
+   * its maxFrames frames closest to the leaf, and the frames removed are
+   * replaced by a single "(truncated)" frame as the root of the stack.
+   */
+  maxFrames?: number;
+
+  /**
+   * Returns names for WebAssembly functions which V8 did not name, e.g. from
+   * the name section of their module. Frames of functions without a name
+   * keep the name wasm-function[<index>] given by V8.
+   */
+  wasmFunctionNames?: WasmFunctionNames;
+
+  /**
+   * Returns the name to record for a function given its name and file, after
+   * source mapping, e.g. to rename helpers emitted by TypeScript or Babel
+   * such as __awaiter.
+   */
+  nameMapper?: NameMapper;
+
+  /**
+   * Heap profiles only. Returns the labels to attach to the samples
+   * allocated at a stack.
+   */
+  allocationLabels?: AllocationLabelsProvider;
+
+  /**
+   * When true, serialization throws if the leaf frame of a sample is in a
+   * JavaScript file on disk and its location could not be mapped to a
+   * source location, e.g. because the source map of the file is missing.
+   */
+  requireSourceMaps?: boolean;
+
+  /**
+   * Called once the profile is serialized with the number of locations in
+   * JavaScript files on disk which were and were not source mapped, e.g. to
+   * detect source maps missing from a deployment.
+   */
+  onSourceMapStats?: (stats: SourceMapStats) => void;
+}
+
+/**
+ * Number of distinct locations of a profile in JavaScript files on disk, by
+ * whether a source map gave their source location.
+ */
+export interface SourceMapStats {
+  mappedFrames: number;
+  unmappedFrames: number;
+}
+
+/**
+ * Node of a profile of custom values, as serialized by
+ * serializeCustomProfile().
+ */
+export interface CustomProfileNode extends ProfileNode {
+  /**
+   * Values of the samples of this node, one per sample type of the profile.
+   * No sample is recorded for a node whose values are all zero.
+   */
+  values: number[];
+  /** Labels of the sample of this node. */
+  labels?: LabelSet;
+  children: CustomProfileNode[];
+}
+
+/**
+ * Returns the name to record for a function named name in file. Anonymous
+ * functions are named ''.
+ */
+export type NameMapper = (name: string, file: string) => string;
+
+/**
+ * Number of hits of a node with the same labels.
+ */
+interface LabeledHits {
+  labels: LabelSet;
+  count: number;
+}
+
+/**
+ * Map from node id to the hits of that node, grouped by labels.
+ */
+type LabeledHitsMap = Map<number, Map<string, LabeledHits>>;
+
 /**
  * Profile node and stack trace to that node.
  */
@@ -62,6 +253,11 @@ function isGeneratedLocation(
 /**
  * Used to build string table and access strings and their ids within the table
  * when serializing a profile.
+ *
+ * Strings are interned by their JavaScript value, not by their UTF-8 bytes,
+ * so a name with multibyte characters gets a single entry however often it
+ * occurs. Names are sanitized before they are interned, so that each entry
+ * encodes to UTF-8 and decodes to the same string.
  */
 class StringTable {
   strings: string[];
@@ -99,6 +295,10 @@ class StringTable {
  * @param appendToSamples - function which converts entry to sample(s)  and
  * appends these to end of an array of samples.
  * @param stringTable - string table for the existing profile.
+ * @param ignoreSamplesPath - samples from scripts whose path contains this
+ * string are not included in the profile.
+ * @param sourceMapper - used to map generated locations to source locations.
+ * @param options - options controlling serialization.
  */
 function serialize<T extends ProfileNode>(
   profile: perftools.profiles.IProfile,
@@ -106,7 +306,8 @@ function serialize<T extends ProfileNode>(
   appendToSamples: AppendEntryToSamples<T>,
   stringTable: StringTable,
   ignoreSamplesPath?: string,
-  sourceMapper?: SourceMapper
+  sourceMapper?: SourceMapper,
+  options: SerializeOptions = {}
 ) {
   const samples: perftools.profiles.Sample[] = [];
   const locations: perftools.profiles.Location[] = [];
@@ -115,6 +316,9 @@ function serialize<T extends ProfileNode>(
   const functionMap: Map<number, perftools.profiles.Function> = new Map();
   const functionIdMap = new Map<string, number>();
   const locationIdMap = new Map<string, number>();
+  // Files of locations which could not be source mapped, by location id.
+  const unmappedFiles = new Map<number, string>();
+  let mappedFrames = 0;
 
   const entries: Array<Entry<T>> = (root.children as T[]).map((n: T) => ({
     node: n,
@@ -135,6 +339,21 @@ function serialize<T extends ProfileNode>(
     }
   }
 
+  if (options.onSourceMapStats) {
+    options.onSourceMapStats({
+      mappedFrames,
+      unmappedFrames: unmappedFiles.size,
+    });
+  }
+  if (options.requireSourceMaps) {
+    checkLeavesMapped(samples, unmappedFiles);
+  }
+  if (options.comments && options.comments.length > 0) {
+    profile.comment = options.comments.map(c => stringTable.getIndexOrAdd(c));
+  }
+  if (mappedFrames > 0) {
+    markSourceMapped(profile);
+  }
   profile.sample = samples;
   profile.location = locations;
   profile.function = functions;
@@ -145,17 +364,35 @@ function serialize<T extends ProfileNode>(
     sourceMapper?: SourceMapper
   ): perftools.profiles.Location {
     let profLoc: SourceLocation = {
-      file: node.scriptName || '',
+      file: scriptFileName(node),
       line: node.lineNumber,
       column: node.columnNumber,
-      name: node.name,
+      name: functionName(node, options.wasmFunctionNames),
     };
 
+    let unmappedFile: string | undefined;
+    let mapped = false;
     if (profLoc.line) {
-      if (sourceMapper && isGeneratedLocation(profLoc)) {
-        profLoc = sourceMapper.mappingInfo(profLoc);
+      if (isGeneratedLocation(profLoc)) {
+        const generated = profLoc;
+        if (sourceMapper) {
+          profLoc = sourceMapper.mappingInfo(generated);
+        }
+        if (path.isAbsolute(generated.file)) {
+          if (profLoc === generated) {
+            unmappedFile = generated.file;
+          } else {
+            mapped = true;
+          }
+        }
       }
     }
+    if (options.nameMapper) {
+      profLoc = {
+        ...profLoc,
+        name: options.nameMapper(profLoc.name || '', profLoc.file || ''),
+      };
+    }
     const keyStr = `${node.scriptId}:${profLoc.line}:${profLoc.column}:${profLoc.name}`;
     let id = locationIdMap.get(keyStr);
     if (id !== undefined) {
@@ -168,10 +405,17 @@ function serialize<T extends ProfileNode>(
       node.scriptId,
       profLoc.file,
       profLoc.name,
-      profLoc.line
+      profLoc.line,
+      options.columnNumbers ? profLoc.column : undefined
     );
     const location = new perftools.profiles.Location({ id, line: [line] });
     locations.push(location);
+    if (unmappedFile !== undefined) {
+      unmappedFiles.set(id, unmappedFile);
+    }
+    if (mapped) {
+      mappedFrames++;
+    }
     return location;
   }
 
@@ -179,11 +423,13 @@ function serialize<T extends ProfileNode>(
     scriptId?: number,
     scriptName?: string,
     name?: string,
-    line?: number
+    line?: number,
+    column?: number
   ): perftools.profiles.Line {
     return new perftools.profiles.Line({
       functionId: getFunction(scriptId, scriptName, name).id,
       line,
+      column,
     });
   }
 
@@ -200,18 +446,193 @@ function serialize<T extends ProfileNode>(
     }
     id = functions.length + 1;
     functionIdMap.set(keyStr, id);
-    const nameId = stringTable.getIndexOrAdd(name || '(anonymous)');
+    const functionName = sanitizeName(name || '(anonymous)');
+    const nameId = stringTable.getIndexOrAdd(functionName);
+    let systemNameId = nameId;
+    let filename = scriptName || '';
+    if (options.scriptIds && scriptId) {
+      systemNameId = stringTable.getIndexOrAdd(
+        `${functionName} [script ${scriptId}]`
+      );
+      filename = absoluteFileName(filename);
+    }
     const f = new perftools.profiles.Function({
       id,
       name: nameId,
-      systemName: nameId,
-      filename: stringTable.getIndexOrAdd(scriptName || ''),
+      systemName: systemNameId,
+      filename: stringTable.getIndexOrAdd(sanitizeName(filename)),
     });
     functions.push(f);
     return f;
   }
 }
 
+// Characters which sanitizeName() replaces.
+const UNSAFE_NAME_CHARS = /[\u0000-\u001f\u007f\ud800-\udfff]/;
+
+/**
+ * @return name with control characters escaped as \xNN, and unpaired
+ * surrogates, which cannot be encoded as UTF-8, replaced with U+FFFD. Names
+ * of functions in obfuscated code may contain either, which breaks tools
+ * reading the profile.
+ */
+function sanitizeName(name: string): string {
+  if (!UNSAFE_NAME_CHARS.test(name)) {
+    return name;
+  }
+  let result = '';
+  for (let i = 0; i < name.length; i++) {
+    const c = name.charCodeAt(i);
+    if (c < 0x20 || c === 0x7f) {
+      result += `\\x${c < 0x10 ? '0' : ''}${c.toString(16)}`;
+    } else if (c >= 0xd800 && c <= 0xdbff && isLowSurrogate(name, i + 1)) {
+      result += name.substr(i, 2);
+      i++;
+    } else if (c >= 0xd800 && c <= 0xdfff) {
+      result += '\ufffd';
+    } else {
+      result += name.charAt(i);
+    }
+  }
+  return result;
+}
+
+function isLowSurrogate(str: string, index: number): boolean {
+  const c = str.charCodeAt(index);
+  return c >= 0xdc00 && c <= 0xdfff;
+}
+
+// File names which are URLs, such as node:fs, or which name scripts which
+// are not files, such as "(script 3)" or "evalmachine.<anonymous>".
+const NON_FILE_NAME = /^[a-z][a-z0-9+.-]*:|^\(|</i;
+
+/**
+ * @return file resolved to an absolute path, unless it is not the name of a
+ * file.
+ */
+function absoluteFileName(file: string): string {
+  if (!file || path.isAbsolute(file) || NON_FILE_NAME.test(file)) {
+    return file;
+  }
+  return path.resolve(file);
+}
+
+/**
+ * @return file name of the script of node. Scripts without a name, such as
+ * code passed to eval(), are named by their id so that their frames remain
+ * distinguishable.
+ */
+function scriptFileName(node: ProfileNode): string {
+  if (!node.scriptName && node.scriptId) {
+    return `(script ${node.scriptId})`;
+  }
+  return node.scriptName || '';
+}
+
+function isNode(value: unknown): value is ProfileNode {
+  return typeof value === 'object' && value !== null;
+}
+
+/**
+ * @return whether each node of the tree has an array of children which are
+ * nodes, and no node appears twice in the tree, e.g. in a cycle.
+ */
+function isWellFormed(root: ProfileNode): boolean {
+  const visited = new Set<ProfileNode>();
+  const nodes = [root];
+  while (nodes.length > 0) {
+    const node = nodes.pop()!;
+    if (visited.has(node) || !Array.isArray(node.children)) {
+      return false;
+    }
+    visited.add(node);
+    for (const child of node.children) {
+      if (!isNode(child)) {
+        return false;
+      }
+      nodes.push(child);
+    }
+  }
+  return true;
+}
+
+function wellFormedCopy<T extends ProfileNode>(root: T): T {
+  const visited = new Set<ProfileNode>();
+  const copies: T[] = [];
+  // Nodes left to copy, each with the children of the copy of its parent.
+  // Children are pushed in reverse and checked when popped, so that nodes
+  // are visited depth first and in order, and the first occurrence of a node
+  // is the one which is kept.
+  const entries: Array<{ node: unknown; siblings: T[] }> = [
+    { node: root, siblings: copies },
+  ];
+  while (entries.length > 0) {
+    const { node, siblings } = entries.pop()!;
+    if (!isNode(node) || visited.has(node)) {
+      continue;
+    }
+    visited.add(node);
+    const children: T[] = [];
+    siblings.push({ ...(node as T), children });
+    const nodeChildren = Array.isArray(node.children) ? node.children : [];
+    for (let i = nodeChildren.length - 1; i >= 0; i--) {
+      entries.push({ node: nodeChildren[i], siblings: children });
+    }
+  }
+  return copies[0];
+}
+
+/**
+ * @return root if the tree is well formed. Otherwise, a copy of the tree
+ * without the children which are not nodes and without the nodes which were
+ * already visited, so that a malformed or cyclic tree from V8 yields the
+ * valid part of the profile instead of an error or an endless loop.
+ */
+function wellFormedTree<T extends ProfileNode>(root: T): T {
+  return isWellFormed(root) ? root : wellFormedCopy(root);
+}
+
+/**
+ * Throws if the leaf location of a sample is in unmappedFiles.
+ */
+function checkLeavesMapped(
+  samples: perftools.profiles.Sample[],
+  unmappedFiles: Map<number, string>
+) {
+  const files = new Set<string>();
+  for (const sample of samples) {
+    const file = unmappedFiles.get(sample.locationId[0] as number);
+    if (file !== undefined) {
+      files.add(file);
+    }
+  }
+  if (files.size > 0) {
+    const list = Array.from(files).sort();
+    const more = list.length > 3 ? ` and ${list.length - 3} more` : '';
+    throw new Error(
+      `Source maps are required, but samples in ${list.length} file(s) ` +
+        `could not be mapped: ${list.slice(0, 3).join(', ')}${more}.`
+    );
+  }
+}
+
+/**
+ * @return name of the function of node, looking up the names of WebAssembly
+ * functions which V8 did not name with wasmFunctionNames.
+ */
+function functionName(
+  node: ProfileNode,
+  wasmFunctionNames?: WasmFunctionNames
+): string | undefined {
+  if (wasmFunctionNames) {
+    const index = wasmFunctionIndex(node.name || '');
+    if (index !== undefined) {
+      return wasmFunctionNames(node.scriptName, index) || node.name;
+    }
+  }
+  return node.name;
+}
+
 /**
  * @return value type for sample counts (type:sample, units:count), and
  * adds strings used in this value type to the table.
@@ -262,26 +683,753 @@ function createAllocationValueType(
   });
 }
 
+/**
+ * Throws if a profile collected in the thread with id profileThreadId would
+ * be serialized with a source mapper created in a different thread, in which
+ * case locations could be mapped using another thread's source maps.
+ */
+function checkSourceMapperThread(
+  profileThreadId?: number,
+  sourceMapper?: SourceMapper
+) {
+  if (
+    sourceMapper &&
+    profileThreadId !== undefined &&
+    profileThreadId !== sourceMapper.threadId
+  ) {
+    throw new Error(
+      `Profile collected in thread ${profileThreadId} cannot be serialized ` +
+        `with a SourceMapper created in thread ${sourceMapper.threadId}.`
+    );
+  }
+}
+
+/**
+ * @return label with the given key and value, and adds its strings to the
+ * table. Numeric values are written as num and num_unit.
+ */
+function createLabel(
+  table: StringTable,
+  key: string,
+  value: LabelValue
+): perftools.profiles.Label {
+  if (typeof value === 'string') {
+    return new perftools.profiles.Label({
+      key: table.getIndexOrAdd(key),
+      str: table.getIndexOrAdd(value),
+    });
+  }
+  return new perftools.profiles.Label({
+    key: table.getIndexOrAdd(key),
+    num: value.num,
+    numUnit: value.unit ? table.getIndexOrAdd(value.unit) : undefined,
+  });
+}
+
+/**
+ * Attaches the labels returned by allocationLabels for the stack of each
+ * sample of a serialized heap profile to the sample.
+ */
+function labelAllocations(
+  profile: perftools.profiles.IProfile,
+  stringTable: StringTable,
+  allocationLabels: AllocationLabelsProvider
+) {
+  // Location and function ids are index+1.
+  const frameOf = (locationId: number): AllocationFrame => {
+    const line = profile.location![locationId - 1].line![0];
+    const fn = profile.function![(line.functionId as number) - 1];
+    return {
+      name: stringTable.strings[fn.name as number],
+      file: stringTable.strings[fn.filename as number],
+      line: (line.line as number) || 0,
+    };
+  };
+  // Samples of allocations of different sizes share stacks.
+  const labelsByStack = new Map<string, perftools.profiles.Label[]>();
+  for (const sample of profile.sample!) {
+    const stack = sample.locationId as number[];
+    const key = stack.join(',');
+    let label = labelsByStack.get(key);
+    if (!label) {
+      const labels = allocationLabels(stack.map(frameOf)) || {};
+      label = Object.keys(labels).map(k =>
+        createLabel(stringTable, k, labels[k])
+      );
+      labelsByStack.set(key, label);
+    }
+    sample.label = label;
+  }
+}
+
+/**
+ * @return copy of prof without the samples taken before cutoffTimestamp,
+ * with the hit counts of its nodes counting only the remaining samples.
+ */
+function profileAfter(prof: TimeProfile, cutoffTimestamp: number): TimeProfile {
+  if (!prof.samples || !prof.timestamps) {
+    throw new Error('Samples must be recorded to exclude early samples.');
+  }
+  const samples: number[] = [];
+  const timestamps: number[] = [];
+  const hitCounts = new Map<number, number>();
+  prof.samples.forEach((nodeId, i) => {
+    const timestamp = prof.timestamps![i];
+    if (timestamp < cutoffTimestamp) {
+      return;
+    }
+    samples.push(nodeId);
+    timestamps.push(timestamp);
+    hitCounts.set(nodeId, (hitCounts.get(nodeId) || 0) + 1);
+  });
+  // Nodes left to copy, each with the children of the copy of its parent.
+  // Children are pushed in reverse, so that they are copied in order, without
+  // recursing as deep as the tree.
+  const copies: TimeProfileNode[] = [];
+  const entries = [{ node: prof.topDownRoot, siblings: copies }];
+  while (entries.length > 0) {
+    const { node, siblings } = entries.pop()!;
+    const children: TimeProfileNode[] = [];
+    siblings.push({
+      ...node,
+      hitCount: node.id === undefined ? 0 : hitCounts.get(node.id) || 0,
+      children,
+    });
+    const nodeChildren = node.children as TimeProfileNode[];
+    for (let i = nodeChildren.length - 1; i >= 0; i--) {
+      entries.push({ node: nodeChildren[i], siblings: children });
+    }
+  }
+  return {
+    ...prof,
+    startTime: Math.max(prof.startTime, cutoffTimestamp),
+    topDownRoot: copies[0],
+    samples,
+    timestamps,
+  };
+}
+
+/**
+ * @return function returning the labels of a sample in a timeline: those
+ * returned by labelsAt, and the time at which the sample was taken.
+ */
+function timelineLabelsAt(
+  prof: TimeProfile,
+  timeNanos: number,
+  relativeTimestamps: boolean,
+  labelsAt?: (timestamp: number) => LabelSet | undefined
+): (timestamp: number) => LabelSet {
+  if (!prof.samples || !prof.timestamps) {
+    throw new Error('Samples must be recorded to serialize a timeline.');
+  }
+  // Timestamps are in microseconds, on the clock of prof.endTime.
+  const zeroMicros = relativeTimestamps
+    ? prof.startTime
+    : prof.endTime - timeNanos / 1000;
+  return timestamp => {
+    const labels = labelsAt && labelsAt(timestamp);
+    return {
+      ...(labels || {}),
+      [TIMESTAMP_LABEL]: {
+        num: Math.round((timestamp - zeroMicros) * 1000),
+        unit: 'nanoseconds',
+      },
+    };
+  };
+}
+
+/**
+ * @return hits of each node of prof with labels, grouped by labels.
+ */
+function labeledHitsByNode(
+  prof: TimeProfile,
+  labelsAt: (timestamp: number) => LabelSet | undefined
+): LabeledHitsMap {
+  const result: LabeledHitsMap = new Map();
+  const samples = prof.samples || [];
+  const timestamps = prof.timestamps || [];
+  samples.forEach((nodeId, i) => {
+    const labels = labelsAt(timestamps[i]);
+    if (!labels) {
+      return;
+    }
+    addLabeledHits(result, nodeId, labels, 1);
+  });
+  return result;
+}
+
+function addLabeledHits(
+  hits: LabeledHitsMap,
+  nodeId: number,
+  labels: LabelSet,
+  count: number
+) {
+  let byLabels = hits.get(nodeId);
+  if (!byLabels) {
+    byLabels = new Map();
+    hits.set(nodeId, byLabels);
+  }
+  const key = labelsKey(labels);
+  const existing = byLabels.get(key);
+  if (existing) {
+    existing.count += count;
+  } else {
+    byLabels.set(key, { labels, count });
+  }
+}
+
+/**
+ * Attributes the labeled hits of from to to, as done with their hit counts.
+ */
+function moveLabeledHits(
+  labeledHits: LabeledHitsMap | undefined,
+  from: TimeProfileNode,
+  to: TimeProfileNode
+) {
+  if (!labeledHits || from.id === undefined || to.id === undefined) {
+    return;
+  }
+  const fromHits = labeledHits.get(from.id);
+  if (fromHits) {
+    for (const h of fromHits.values()) {
+      addLabeledHits(labeledHits, to.id, h.labels, h.count);
+    }
+    labeledHits.delete(from.id);
+  }
+}
+
+/**
+ * @return true if scriptName is the name of a Node.js internal module.
+ */
+function isNodeInternal(scriptName: string): boolean {
+  return scriptName.startsWith('node:') || scriptName.startsWith('internal/');
+}
+
+/**
+ * Removes the Node.js internal frames below node, attributing their hits to
+ * copy, which takes the place of node, and appends copies of the frames
+ * called from node which are not internal to children.
+ */
+function stripInternalCallees(
+  node: TimeProfileNode,
+  copy: TimeProfileNode,
+  children: TimeProfileNode[],
+  labeledHits?: LabeledHitsMap
+) {
+  // Frames left to visit, each with the copy of its nearest caller which is
+  // not internal and the children of that copy. Children are pushed in
+  // reverse, so that frames are visited depth first and in order, without
+  // recursing as deep as the stack.
+  const entries: Array<{
+    node: TimeProfileNode;
+    copy: TimeProfileNode;
+    children: TimeProfileNode[];
+  }> = [];
+  const pushChildren = (
+    n: TimeProfileNode,
+    c: TimeProfileNode,
+    siblings: TimeProfileNode[]
+  ) => {
+    const nodeChildren = n.children as TimeProfileNode[];
+    for (let i = nodeChildren.length - 1; i >= 0; i--) {
+      entries.push({ node: nodeChildren[i], copy: c, children: siblings });
+    }
+  };
+  pushChildren(node, copy, children);
+  while (entries.length > 0) {
+    const entry = entries.pop()!;
+    const child = entry.node;
+    if (isNodeInternal(child.scriptName)) {
+      entry.copy.hitCount += child.hitCount;
+      moveLabeledHits(labeledHits, child, entry.copy);
+      pushChildren(child, entry.copy, entry.children);
+    } else {
+      const childCopy: TimeProfileNode = { ...child, children: [] };
+      entry.children.push(childCopy);
+      pushChildren(child, childCopy, childCopy.children as TimeProfileNode[]);
+    }
+  }
+}
+
+/**
+ * @return copy of node in which Node.js internal frames are removed, with
+ * their hits attributed to the nearest caller which is not internal.
+ */
+function withoutNodeInternals(
+  node: TimeProfileNode,
+  labeledHits?: LabeledHitsMap
+): TimeProfileNode {
+  const copy: TimeProfileNode = { ...node, children: [] };
+  const children = copy.children as TimeProfileNode[];
+  stripInternalCallees(node, copy, children, labeledHits);
+  return copy;
+}
+
+/**
+ * @return copy of the top-level frames in root with Node.js internal frames
+ * removed. Top-level internal frames have no caller to attribute their hits
+ * to, so they are kept as leaves with the hits of the internal frames they
+ * call, and the other frames they call become top-level frames.
+ */
+function stripNodeInternals(
+  root: TimeProfileNode,
+  labeledHits?: LabeledHitsMap
+): TimeProfileNode[] {
+  const children: TimeProfileNode[] = [];
+  for (const node of root.children as TimeProfileNode[]) {
+    if (!isNodeInternal(node.scriptName)) {
+      children.push(withoutNodeInternals(node, labeledHits));
+      continue;
+    }
+    const leaf: TimeProfileNode = { ...node, children: [] };
+    stripInternalCallees(node, leaf, children, labeledHits);
+    if (leaf.hitCount > 0) {
+      children.push(leaf);
+    }
+  }
+  return children;
+}
+
+/**
+ * @return copy of node in which descendant leaves with fewer than
+ * minSelfSamples hits are removed, with their hits added to their parent.
+ * Labeled hits of removed leaves are moved to their parent in labeledHits.
+ */
+function pruneTimeNode(
+  node: TimeProfileNode,
+  minSelfSamples: number,
+  labeledHits?: LabeledHitsMap
+): TimeProfileNode {
+  // Every node comes before its descendants in preorder, so walking it
+  // backwards prunes the children of each node before the node itself,
+  // without recursing as deep as the stack.
+  const preorder: TimeProfileNode[] = [];
+  const stack = [node];
+  while (stack.length > 0) {
+    const n = stack.pop()!;
+    preorder.push(n);
+    for (const child of n.children as TimeProfileNode[]) {
+      stack.push(child);
+    }
+  }
+  const prunedNodes = new Map<TimeProfileNode, TimeProfileNode>();
+  for (let i = preorder.length - 1; i >= 0; i--) {
+    const n = preorder[i];
+    let hitCount = n.hitCount;
+    const children: TimeProfileNode[] = [];
+    for (const child of n.children as TimeProfileNode[]) {
+      const pruned = prunedNodes.get(child)!;
+      if (pruned.children.length === 0 && pruned.hitCount < minSelfSamples) {
+        hitCount += pruned.hitCount;
+        moveLabeledHits(labeledHits, pruned, n);
+      } else {
+        children.push(pruned);
+      }
+    }
+    prunedNodes.set(n, { ...n, hitCount, children });
+  }
+  return prunedNodes.get(node)!;
+}
+
+function stackKey(sample: perftools.profiles.ISample): string {
+  return (sample.locationId || []).join(',');
+}
+
+/**
+ * @return sum of the first values of the samples of each stack, in order of
+ * first appearance.
+ */
+function stackTotals(samples: perftools.profiles.ISample[]) {
+  const totals = new Map<string, number>();
+  for (const sample of samples) {
+    const key = stackKey(sample);
+    totals.set(key, (totals.get(key) || 0) + (sample.value![0] as number));
+  }
+  return totals;
+}
+
+/**
+ * Keeps the samples of the stacks of profile which are among its topStacks
+ * stacks with the highest first sample value, and whose first sample value is
+ * at least minCumulativePercent percent of the total, when these are defined.
+ * The samples of all other stacks are replaced with one sample whose only
+ * frame is "(other)" and whose values are their sums, so that applying both
+ * limits yields a single "(other)" sample.
+ */
+function keepHotStacks(
+  profile: perftools.profiles.IProfile,
+  stringTable: StringTable,
+  topStacks?: number,
+  minCumulativePercent?: number
+) {
+  if (
+    topStacks !== undefined &&
+    (!(topStacks >= 0) || Math.floor(topStacks) !== topStacks)
+  ) {
+    throw new Error(
+      `topStacks must be a non-negative integer, got ${topStacks}.`
+    );
+  }
+  if (
+    minCumulativePercent !== undefined &&
+    !(minCumulativePercent >= 0 && minCumulativePercent <= 100)
+  ) {
+    throw new Error(
+      'minCumulativePercent must be between 0 and 100, got ' +
+        `${minCumulativePercent}.`
+    );
+  }
+  const totals = stackTotals(profile.sample || []);
+  let kept = Array.from(totals.keys());
+  if (minCumulativePercent !== undefined) {
+    let total = 0;
+    for (const value of totals.values()) {
+      total += value;
+    }
+    const threshold = (total * minCumulativePercent) / 100;
+    kept = kept.filter(key => totals.get(key)! >= threshold);
+  }
+  if (topStacks !== undefined && kept.length > topStacks) {
+    // Ties are broken by order of first appearance, since sort() is not
+    // guaranteed to be stable.
+    kept = kept
+      .map((key, idx) => ({ key, idx, total: totals.get(key)! }))
+      .sort((a, b) => b.total - a.total || a.idx - b.idx)
+      .slice(0, topStacks)
+      .map(e => e.key);
+  }
+  if (kept.length < totals.size) {
+    keepStacks(profile, stringTable, new Set(kept));
+  }
+}
+
+/**
+ * Keeps the samples of profile whose stack is in kept, and replaces all
+ * other samples with one sample whose only frame is "(other)" and whose
+ * values are their sums.
+ */
+function keepStacks(
+  profile: perftools.profiles.IProfile,
+  stringTable: StringTable,
+  kept: Set<string>
+) {
+  const samples = profile.sample || [];
+  const functions = profile.function || [];
+  const locations = profile.location || [];
+  const nameId = stringTable.getIndexOrAdd('(other)');
+  const fn = new perftools.profiles.Function({
+    id: functions.length + 1,
+    name: nameId,
+    systemName: nameId,
+    filename: stringTable.getIndexOrAdd(''),
+  });
+  functions.push(fn);
+  const location = new perftools.profiles.Location({
+    id: locations.length + 1,
+    line: [new perftools.profiles.Line({ functionId: fn.id })],
+  });
+  locations.push(location);
+
+  const other = new perftools.profiles.Sample({
+    locationId: [location.id],
+    value: (samples[0].value || []).map(() => 0),
+  });
+  const result: perftools.profiles.ISample[] = [];
+  for (const sample of samples) {
+    if (kept.has(stackKey(sample))) {
+      result.push(sample);
+    } else {
+      sample.value!.forEach((v, i) => {
+        other.value[i] = (other.value[i] as number) + (v as number);
+      });
+    }
+  }
+  result.push(other);
+  profile.sample = result;
+  profile.function = functions;
+  profile.location = locations;
+}
+
+/**
+ * Truncates the stacks of the samples of profile to their maxFrames frames
+ * closest to the leaf, followed by a "(truncated)" frame. Samples with the
+ * same stack and labels after truncation are merged.
+ */
+function truncateStacks(
+  profile: perftools.profiles.IProfile,
+  stringTable: StringTable,
+  maxFrames: number
+) {
+  if (!(maxFrames > 0) || Math.floor(maxFrames) !== maxFrames) {
+    throw new Error(`maxFrames must be a positive integer, got ${maxFrames}.`);
+  }
+  const samples = profile.sample || [];
+  if (samples.every(s => (s.locationId || []).length <= maxFrames)) {
+    return;
+  }
+
+  const functions = profile.function || [];
+  const locations = profile.location || [];
+  const nameId = stringTable.getIndexOrAdd('(truncated)');
+  const fn = new perftools.profiles.Function({
+    id: functions.length + 1,
+    name: nameId,
+    systemName: nameId,
+    filename: stringTable.getIndexOrAdd(''),
+  });
+  functions.push(fn);
+  const location = new perftools.profiles.Location({
+    id: locations.length + 1,
+    line: [new perftools.profiles.Line({ functionId: fn.id })],
+  });
+  locations.push(location);
+
+  const result: perftools.profiles.ISample[] = [];
+  // Index in result of the truncated sample with each stack and labels.
+  const truncatedIdxs = new Map<string, number>();
+  for (const sample of samples) {
+    const stack = sample.locationId || [];
+    if (stack.length <= maxFrames) {
+      result.push(sample);
+      continue;
+    }
+    const locationId = [...stack.slice(0, maxFrames), location.id];
+    const key = [
+      locationId.join(','),
+      ...(sample.label || []).map(
+        l => `${l.key}:${l.str}:${l.num}:${l.numUnit}`
+      ),
+    ].join('|');
+    const idx = truncatedIdxs.get(key);
+    if (idx === undefined) {
+      truncatedIdxs.set(key, result.length);
+      result.push(
+        new perftools.profiles.Sample({
+          ...sample,
+          locationId,
+          value: (sample.value || []).slice(),
+        })
+      );
+    } else {
+      const value = result[idx].value!;
+      sample.value!.forEach((v, i) => {
+        value[i] = (value[i] as number) + (v as number);
+      });
+    }
+  }
+  profile.sample = result;
+  profile.function = functions;
+  profile.location = locations;
+}
+
+/**
+ * Removes the samples of profile whose values are all zero, then the
+ * locations, functions and strings which are no longer referenced. Ids and
+ * string indexes are only renumbered when something is removed, and the
+ * order of what remains is kept.
+ */
+function compactProfile(profile: perftools.profiles.IProfile) {
+  const samples = (profile.sample || []).filter(s =>
+    (s.value || []).some(v => v !== 0)
+  );
+  profile.sample = samples;
+
+  const usedLocations = new Set<number>();
+  for (const sample of samples) {
+    for (const id of sample.locationId as number[]) {
+      usedLocations.add(id);
+    }
+  }
+  const locations = (profile.location || []).filter(l =>
+    usedLocations.has(l.id as number)
+  );
+  if (locations.length !== (profile.location || []).length) {
+    const locationIds = renumber(locations);
+    for (const sample of samples) {
+      sample.locationId = (sample.locationId as number[]).map(
+        id => locationIds.get(id)!
+      );
+    }
+    profile.location = locations;
+  }
+
+  const usedFunctions = new Set<number>();
+  for (const location of locations) {
+    for (const line of location.line || []) {
+      usedFunctions.add(line.functionId as number);
+    }
+  }
+  const functions = (profile.function || []).filter(f =>
+    usedFunctions.has(f.id as number)
+  );
+  if (functions.length !== (profile.function || []).length) {
+    const functionIds = renumber(functions);
+    for (const location of locations) {
+      for (const line of location.line || []) {
+        line.functionId = functionIds.get(line.functionId as number)!;
+      }
+    }
+    profile.function = functions;
+  }
+
+  compactStrings(profile);
+}
+
+/**
+ * Assigns ids 1, 2, ... to entries in order.
+ * @return map from previous to new ids.
+ */
+function renumber(entries: Array<{ id?: number | Long | null }>) {
+  const ids = new Map<number, number>();
+  entries.forEach((entry, i) => {
+    ids.set(entry.id as number, i + 1);
+    entry.id = i + 1;
+  });
+  return ids;
+}
+
+/**
+ * Removes the strings of profile which are not referenced, keeping the
+ * order of the others.
+ */
+function compactStrings(profile: perftools.profiles.IProfile) {
+  const strings = profile.stringTable || [];
+  const used = new Set<number>([0]);
+  const use = (idx?: number | Long | null) => {
+    if (idx) {
+      used.add(idx as number);
+    }
+  };
+  const valueTypes = [...(profile.sampleType || [])];
+  if (profile.periodType) {
+    valueTypes.push(profile.periodType);
+  }
+  for (const vt of valueTypes) {
+    use(vt.type);
+    use(vt.unit);
+  }
+  for (const sample of profile.sample || []) {
+    for (const label of sample.label || []) {
+      use(label.key);
+      use(label.str);
+      use(label.numUnit);
+    }
+  }
+  for (const fn of profile.function || []) {
+    use(fn.name);
+    use(fn.systemName);
+    use(fn.filename);
+  }
+  (profile.comment || []).forEach(use);
+  if (used.size === strings.length) {
+    return;
+  }
+
+  const indexes = new Map<number, number>();
+  profile.stringTable = strings.filter((str, idx) => {
+    if (!used.has(idx)) {
+      return false;
+    }
+    indexes.set(idx, indexes.size);
+    return true;
+  });
+  const index = (idx?: number | Long | null) =>
+    idx ? indexes.get(idx as number)! : 0;
+  // Value types and labels may be shared, so they are replaced rather than
+  // updated.
+  const valueType = (vt: perftools.profiles.IValueType) =>
+    new perftools.profiles.ValueType({
+      type: index(vt.type),
+      unit: index(vt.unit),
+    });
+  profile.sampleType = (profile.sampleType || []).map(valueType);
+  if (profile.periodType) {
+    profile.periodType = valueType(profile.periodType);
+  }
+  for (const sample of profile.sample || []) {
+    sample.label = (sample.label || []).map(
+      l =>
+        new perftools.profiles.Label({
+          key: index(l.key),
+          str: index(l.str),
+          num: l.num,
+          numUnit: index(l.numUnit),
+        })
+    );
+  }
+  for (const fn of profile.function || []) {
+    fn.name = index(fn.name);
+    fn.systemName = index(fn.systemName);
+    fn.filename = index(fn.filename);
+  }
+  profile.comment = (profile.comment || []).map(index);
+}
+
 /**
  * Converts v8 time profile into into a profile proto.
  * (https://github.com/google/pprof/blob/master/proto/profile.proto)
  *
  * @param prof - profile to be converted.
  * @param intervalMicros - average time (microseconds) between samples.
+ * @param sourceMapper - used to map generated locations to source locations.
+ * @param options - options controlling serialization.
  */
 export function serializeTimeProfile(
   prof: TimeProfile,
   intervalMicros: number,
-  sourceMapper?: SourceMapper
+  sourceMapper?: SourceMapper,
+  options: SerializeOptions = {}
 ): perftools.profiles.IProfile {
+  checkSourceMapperThread(prof.threadId, sourceMapper);
+  prof = { ...prof, topDownRoot: wellFormedTree(prof.topDownRoot) };
+  if (options.cutoffTimestamp !== undefined) {
+    prof = profileAfter(prof, options.cutoffTimestamp);
+  }
+  const timeNanos =
+    options.timeNanos !== undefined
+      ? options.timeNanos
+      : Date.now() * 1000 * 1000;
+  const labelsAt = options.timeline
+    ? timelineLabelsAt(
+        prof,
+        timeNanos,
+        !!options.relativeTimestamps,
+        options.labelsAt
+      )
+    : options.labelsAt;
+  const labeledHits =
+    labelsAt && prof.samples ? labeledHitsByNode(prof, labelsAt) : undefined;
   const appendTimeEntryToSamples: AppendEntryToSamples<TimeProfileNode> = (
     entry: Entry<TimeProfileNode>,
     samples: perftools.profiles.Sample[]
   ) => {
-    if (entry.node.hitCount > 0) {
+    const node = entry.node;
+    if (node.hitCount === 0) {
+      return;
+    }
+    let unlabeledCount = node.hitCount;
+    const byLabels =
+      labeledHits && node.id !== undefined
+        ? labeledHits.get(node.id)
+        : undefined;
+    if (byLabels) {
+      for (const { labels, count } of byLabels.values()) {
+        samples.push(
+          new perftools.profiles.Sample({
+            locationId: entry.stack,
+            value: [count, count * intervalMicros],
+            label: Object.keys(labels).map(key =>
+              createLabel(stringTable, key, labels[key])
+            ),
+          })
+        );
+        unlabeledCount -= count;
+      }
+    }
+    if (unlabeledCount > 0) {
       const sample = new perftools.profiles.Sample({
         locationId: entry.stack,
-        value: [entry.node.hitCount, entry.node.hitCount * intervalMicros],
+        value: [unlabeledCount, unlabeledCount * intervalMicros],
       });
       samples.push(sample);
     }
@@ -293,20 +1441,45 @@ export function serializeTimeProfile(
 
   const profile = {
     sampleType: [sampleValueType, timeValueType],
-    timeNanos: Date.now() * 1000 * 1000,
+    timeNanos,
     durationNanos: (prof.endTime - prof.startTime) * 1000,
     periodType: timeValueType,
     period: intervalMicros,
   };
 
+  let root = prof.topDownRoot;
+  if (options.stripNodeInternals) {
+    root = { ...root, children: stripNodeInternals(root, labeledHits) };
+  }
+  if (options.minSelfSamples) {
+    const minSelfSamples = options.minSelfSamples;
+    root = {
+      ...root,
+      children: (root.children as TimeProfileNode[]).map(n =>
+        pruneTimeNode(n, minSelfSamples, labeledHits)
+      ),
+    };
+  }
+
   serialize(
     profile,
-    prof.topDownRoot,
+    root,
     appendTimeEntryToSamples,
     stringTable,
     undefined,
-    sourceMapper
+    sourceMapper,
+    options
+  );
+  if (options.maxFrames !== undefined) {
+    truncateStacks(profile, stringTable, options.maxFrames);
+  }
+  keepHotStacks(
+    profile,
+    stringTable,
+    options.topStacks,
+    options.minCumulativePercent
   );
+  compactProfile(profile);
 
   return profile;
 }
@@ -320,14 +1493,21 @@ export function serializeTimeProfile(
  * @param durationsNanos - duration of the profile (wall clock time) in
  * nanoseconds.
  * @param intervalBytes - bytes allocated between samples.
+ * @param ignoreSamplesPath - samples from scripts whose path contains this
+ * string are not included in the profile.
+ * @param sourceMapper - used to map generated locations to source locations.
+ * @param options - options controlling serialization.
  */
 export function serializeHeapProfile(
   prof: AllocationProfileNode,
   startTimeNanos: number,
   intervalBytes: number,
   ignoreSamplesPath?: string,
-  sourceMapper?: SourceMapper
+  sourceMapper?: SourceMapper,
+  options: SerializeOptions = {}
 ): perftools.profiles.IProfile {
+  checkSourceMapperThread(prof.threadId, sourceMapper);
+  prof = wellFormedTree(prof);
   const appendHeapEntryToSamples: AppendEntryToSamples<AllocationProfileNode> = (
     entry: Entry<AllocationProfileNode>,
     samples: perftools.profiles.Sample[]
@@ -361,7 +1541,85 @@ export function serializeHeapProfile(
     appendHeapEntryToSamples,
     stringTable,
     ignoreSamplesPath,
-    sourceMapper
+    sourceMapper,
+    options
+  );
+  if (options.allocationLabels) {
+    labelAllocations(profile, stringTable, options.allocationLabels);
+  }
+  compactProfile(profile);
+  return profile;
+}
+
+/**
+ * Converts a tree of nodes with custom values into a profile proto with the
+ * given sample types, e.g. for profiles of several metrics collected outside
+ * of V8.
+ *
+ * @param root - root of the tree, which has no sample of its own.
+ * @param sampleTypes - type and unit of each value of the samples. Each node
+ * must have a value for each of them.
+ * @param sourceMapper - used to map generated locations to source locations.
+ * @param options - options controlling serialization.
+ */
+export function serializeCustomProfile(
+  root: CustomProfileNode,
+  sampleTypes: SampleType[],
+  sourceMapper?: SourceMapper,
+  options: SerializeOptions = {}
+): perftools.profiles.IProfile {
+  if (sampleTypes.length === 0) {
+    throw new Error('At least one sample type is required.');
+  }
+  root = wellFormedTree(root);
+  const stringTable = new StringTable();
+  const appendCustomEntryToSamples: AppendEntryToSamples<CustomProfileNode> = (
+    entry: Entry<CustomProfileNode>,
+    samples: perftools.profiles.Sample[]
+  ) => {
+    const node = entry.node;
+    const values = node.values || [];
+    if (values.length !== sampleTypes.length) {
+      throw new Error(
+        `Node ${node.name || '(anonymous)'} has ${values.length} values, ` +
+          `but the profile has ${sampleTypes.length} sample types.`
+      );
+    }
+    if (values.every(v => v === 0)) {
+      return;
+    }
+    const labels = node.labels || {};
+    samples.push(
+      new perftools.profiles.Sample({
+        locationId: entry.stack,
+        value: values,
+        label: Object.keys(labels).map(key =>
+          createLabel(stringTable, key, labels[key])
+        ),
+      })
+    );
+  };
+
+  const profile = {
+    sampleType: sampleTypes.map(
+      st =>
+        new perftools.profiles.ValueType({
+          type: stringTable.getIndexOrAdd(st.type),
+          unit: stringTable.getIndexOrAdd(st.unit),
+        })
+    ),
+    timeNanos: Date.now() * 1000 * 1000,
+  };
+
+  serialize(
+    profile,
+    root,
+    appendCustomEntryToSamples,
+    stringTable,
+    undefined,
+    sourceMapper,
+    options
   );
+  compactProfile(profile);
   return profile;
 }
@@ -0,0 +1,25 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @return types of profiles which can be collected by this build of pprof
+ * on the current platform.
+ */
+export function supportedProfileTypes(): string[] {
+  // Both profilers are provided by the native binding, which is loaded when
+  // pprof is loaded, so they are available wherever pprof can be loaded.
+  return ['time', 'heap'];
+}
@@ -0,0 +1,471 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+
+// Profiles in which frames were source mapped when they were serialized.
+// They are tracked here rather than recorded in the profiles, so that the
+// profiles themselves are the same whether or not frames were mapped.
+const sourceMappedProfiles = new WeakSet<perftools.profiles.IProfile>();
+
+/**
+ * Records that frames of profile were source mapped.
+ */
+export function markSourceMapped(profile: perftools.profiles.IProfile) {
+  sourceMappedProfiles.add(profile);
+}
+
+/**
+ * @return whether frames of profile, or of a profile which it was copied or
+ * merged from, were source mapped when it was serialized.
+ */
+export function isSourceMapped(profile: perftools.profiles.IProfile): boolean {
+  return sourceMappedProfiles.has(profile);
+}
+
+/**
+ * @return value as a number. Decoded profiles contain Longs where serialized
+ * profiles contain numbers; both are accepted. Missing values are 0.
+ */
+export function toNumber(value: number | Long | null | undefined): number {
+  if (value === undefined || value === null) {
+    return 0;
+  }
+  return typeof value === 'number' ? value : value.toNumber();
+}
+
+/**
+ * @return value in plain decimal notation, e.g. "1234.5", for text meant to
+ * be parsed by other tools. String() and template literals are already
+ * independent of the locale, but use an exponent for very large or small
+ * values, which this avoids.
+ */
+export function formatNumber(value: number): string {
+  const str = String(value);
+  const e = str.indexOf('e');
+  if (e === -1) {
+    return str;
+  }
+  const sign = str[0] === '-' ? '-' : '';
+  const mantissa = str.slice(sign.length, e);
+  const exponent = Number(str.slice(e + 1));
+  const dot = mantissa.indexOf('.');
+  const digits = mantissa.replace('.', '');
+  const point = (dot === -1 ? mantissa.length : dot) + exponent;
+  if (point >= digits.length) {
+    return sign + digits + '0'.repeat(point - digits.length);
+  }
+  if (point <= 0) {
+    return `${sign}0.${'0'.repeat(-point)}${digits}`;
+  }
+  return `${sign}${digits.slice(0, point)}.${digits.slice(point)}`;
+}
+
+/**
+ * @return string at index idx of the profile's string table.
+ */
+export function getString(
+  profile: perftools.profiles.IProfile,
+  idx: number | Long | null | undefined
+): string {
+  const strings = profile.stringTable || [];
+  return strings[toNumber(idx)] || '';
+}
+
+/**
+ * @return copy of the string table of profile, to which strings can be added
+ * for a copy of profile without modifying profile, and a function which
+ * returns the index of a string in the copy, adding it if it is missing.
+ */
+export function copyStringTable(
+  profile: perftools.profiles.IProfile
+): { stringTable: string[]; addString: (str: string) => number } {
+  const stringTable = (profile.stringTable || ['']).slice();
+  const addString = (str: string) => {
+    const idx = stringTable.indexOf(str);
+    return idx === -1 ? stringTable.push(str) - 1 : idx;
+  };
+  return { stringTable, addString };
+}
+
+/**
+ * @return copy of profile with comment added to its comments.
+ */
+export function withComment(
+  profile: perftools.profiles.IProfile,
+  comment: string
+): perftools.profiles.IProfile {
+  const { stringTable, addString } = copyStringTable(profile);
+  const copy = {
+    ...profile,
+    stringTable,
+    comment: [...(profile.comment || []), addString(comment)],
+  };
+  if (isSourceMapped(profile)) {
+    markSourceMapped(copy);
+  }
+  return copy;
+}
+
+export interface FindFunctionOptions {
+  /** Name of the function. */
+  name: string;
+  /**
+   * When set, only functions whose file name is file or ends with file
+   * preceded by a path separator match.
+   */
+  file?: string;
+}
+
+export interface FoundFunction {
+  /** Whether a matching function is on the stack of any sample. */
+  found: boolean;
+  /**
+   * Sum of the first value, e.g. the sample count, of the samples with a
+   * matching function on their stack.
+   */
+  samples: number;
+}
+
+/**
+ * Finds the samples of profile in which a function is on the stack, e.g. to
+ * check in a test that a busy function was profiled.
+ */
+export function findFunction(
+  profile: perftools.profiles.IProfile,
+  options: FindFunctionOptions
+): FoundFunction {
+  const fileMatches = (filename: string) =>
+    options.file === undefined ||
+    filename === options.file ||
+    filename.endsWith(`/${options.file}`) ||
+    filename.endsWith(`\\${options.file}`);
+  const functionIds = new Set<number>();
+  for (const f of profile.function || []) {
+    if (
+      getString(profile, f.name) === options.name &&
+      fileMatches(getString(profile, f.filename))
+    ) {
+      functionIds.add(toNumber(f.id));
+    }
+  }
+  const locationIds = new Set<number>();
+  for (const loc of profile.location || []) {
+    if ((loc.line || []).some(l => functionIds.has(toNumber(l.functionId)))) {
+      locationIds.add(toNumber(loc.id));
+    }
+  }
+
+  let found = false;
+  let samples = 0;
+  for (const sample of profile.sample || []) {
+    if ((sample.locationId || []).some(id => locationIds.has(toNumber(id)))) {
+      found = true;
+      samples += toNumber((sample.value || [])[0]);
+    }
+  }
+  return { found, samples };
+}
+
+export interface TopOptions {
+  /** Maximum number of functions to return. Defaults to 10. */
+  n?: number;
+  /**
+   * Whether to rank functions by the value of the samples in which they are
+   * the leaf ('self', the default) or on the stack ('cumulative').
+   */
+  by?: 'self' | 'cumulative';
+  /** Index of the sample value to sum. Defaults to 0. */
+  valueIndex?: number;
+}
+
+export interface TopFunction {
+  function: string;
+  file: string;
+  /** Sum of the values of the samples in which this is the leaf. */
+  self: number;
+  /** Sum of the values of the samples with this function on the stack. */
+  cumulative: number;
+}
+
+/**
+ * @return the functions of profile with the highest values, like
+ * pprof -top. Functions with the same name and file are combined.
+ */
+export function top(
+  profile: perftools.profiles.IProfile,
+  options: TopOptions = {}
+): TopFunction[] {
+  const n = options.n === undefined ? 10 : options.n;
+  const by = options.by || 'self';
+  const valueIndex = options.valueIndex || 0;
+
+  const keys = new Map<number, string>();
+  const entries = new Map<string, TopFunction>();
+  for (const f of profile.function || []) {
+    const name = getString(profile, f.name);
+    const file = getString(profile, f.filename);
+    const key = `${name}\0${file}`;
+    keys.set(toNumber(f.id), key);
+    if (!entries.has(key)) {
+      entries.set(key, { function: name, file, self: 0, cumulative: 0 });
+    }
+  }
+  // Keys of the functions of each location, from leaf to caller.
+  const locationKeys = new Map<number, string[]>();
+  for (const loc of profile.location || []) {
+    locationKeys.set(
+      toNumber(loc.id),
+      (loc.line || []).map(l => keys.get(toNumber(l.functionId))!)
+    );
+  }
+
+  for (const sample of profile.sample || []) {
+    const value = toNumber((sample.value || [])[valueIndex]);
+    const stack: string[] = [];
+    for (const id of sample.locationId || []) {
+      stack.push(...(locationKeys.get(toNumber(id)) || []));
+    }
+    if (stack.length > 0) {
+      entries.get(stack[0])!.self += value;
+    }
+    for (const key of new Set(stack)) {
+      entries.get(key)!.cumulative += value;
+    }
+  }
+
+  const other = by === 'self' ? 'cumulative' : 'self';
+  return Array.from(entries.values())
+    .filter(e => e.cumulative !== 0)
+    .sort(
+      (a, b) =>
+        b[by] - a[by] ||
+        b[other] - a[other] ||
+        compareStrings(a.function, b.function) ||
+        compareStrings(a.file, b.file)
+    )
+    .slice(0, n);
+}
+
+/**
+ * Orders strings by their UTF-16 code units, so that the order does not
+ * depend on the locale, unlike with localeCompare().
+ */
+function compareStrings(a: string, b: string): number {
+  return a < b ? -1 : a > b ? 1 : 0;
+}
+
+/**
+ * Used to build a new profile out of the samples, locations and functions of
+ * one or more existing profiles. Strings, functions and locations are
+ * interned, so identical entries from different profiles share an id.
+ */
+export class ProfileBuilder {
+  stringTable: string[] = [];
+  functions: perftools.profiles.Function[] = [];
+  locations: perftools.profiles.Location[] = [];
+  samples: perftools.profiles.Sample[] = [];
+
+  private stringIds = new Map<string, number>();
+  private functionIds = new Map<string, number>();
+  private locationIds = new Map<string, number>();
+  // Index in samples of the sample added by mergeSample() for each stack
+  // and set of labels.
+  private sampleIdxs = new Map<string, number>();
+
+  constructor() {
+    this.addString('');
+  }
+
+  /**
+   * @return index of str within the string table. Also adds str to the
+   * string table if str is not in the table already.
+   */
+  addString(str: string): number {
+    let idx = this.stringIds.get(str);
+    if (idx !== undefined) {
+      return idx;
+    }
+    idx = this.stringTable.push(str) - 1;
+    this.stringIds.set(str, idx);
+    return idx;
+  }
+
+  /**
+   * Adds a function with the given attributes.
+   * @return id of the function.
+   */
+  addFunction(
+    name: string,
+    systemName: string,
+    filename: string,
+    startLine = 0
+  ): number {
+    const keyStr = `${name}\0${systemName}\0${filename}\0${startLine}`;
+    let id = this.functionIds.get(keyStr);
+    if (id !== undefined) {
+      return id;
+    }
+    // id is index+1, since 0 is not valid id.
+    id = this.functions.length + 1;
+    this.functionIds.set(keyStr, id);
+    this.functions.push(
+      new perftools.profiles.Function({
+        id,
+        name: this.addString(name),
+        systemName: this.addString(systemName),
+        filename: this.addString(filename),
+        startLine,
+      })
+    );
+    return id;
+  }
+
+  /**
+   * Adds a location whose lines reference functions already added to this
+   * builder.
+   * @return id of the location.
+   */
+  addLocation(lines: perftools.profiles.ILine[]): number {
+    const keyStr = lines
+      .map(
+        l =>
+          `${toNumber(l.functionId)}:${toNumber(l.line)}:${toNumber(l.column)}`
+      )
+      .join(';');
+    let id = this.locationIds.get(keyStr);
+    if (id !== undefined) {
+      return id;
+    }
+    // id is index+1, since 0 is not valid id.
+    id = this.locations.length + 1;
+    this.locationIds.set(keyStr, id);
+    this.locations.push(
+      new perftools.profiles.Location({
+        id,
+        line: lines.map(l => new perftools.profiles.Line(l)),
+      })
+    );
+    return id;
+  }
+
+  /**
+   * Adds the functions and locations of profile to this builder.
+   * @return map from location ids in profile to location ids in this builder.
+   */
+  addLocationsOf(profile: perftools.profiles.IProfile): Map<number, number> {
+    const functionIds = new Map<number, number>();
+    for (const f of profile.function || []) {
+      functionIds.set(
+        toNumber(f.id),
+        this.addFunction(
+          getString(profile, f.name),
+          getString(profile, f.systemName),
+          getString(profile, f.filename),
+          toNumber(f.startLine)
+        )
+      );
+    }
+    const locationIds = new Map<number, number>();
+    for (const loc of profile.location || []) {
+      const lines = (loc.line || []).map(l => ({
+        functionId: functionIds.get(toNumber(l.functionId)) || 0,
+        line: toNumber(l.line),
+        column: toNumber(l.column) || undefined,
+      }));
+      locationIds.set(toNumber(loc.id), this.addLocation(lines));
+    }
+    return locationIds;
+  }
+
+  /**
+   * Appends a copy of sample, which belongs to profile, with the given
+   * values. Location ids are translated with locationIds and label strings
+   * are re-interned into this builder's string table.
+   */
+  addSample(
+    profile: perftools.profiles.IProfile,
+    sample: perftools.profiles.ISample,
+    locationIds: Map<number, number>,
+    values: number[]
+  ) {
+    this.samples.push(this.copySample(profile, sample, locationIds, values));
+  }
+
+  /**
+   * Like addSample(), but if a sample with the same stack and labels was
+   * previously added with mergeSample(), adds values to that sample instead
+   * of appending a new one.
+   */
+  mergeSample(
+    profile: perftools.profiles.IProfile,
+    sample: perftools.profiles.ISample,
+    locationIds: Map<number, number>,
+    values: number[]
+  ) {
+    const copy = this.copySample(profile, sample, locationIds, values);
+    const labels = copy.label.map(
+      l => `${l.key}:${l.str}:${l.num}:${l.numUnit}`
+    );
+    const keyStr = `${copy.locationId.join(',')}|${labels.join(',')}`;
+    const idx = this.sampleIdxs.get(keyStr);
+    if (idx === undefined) {
+      this.sampleIdxs.set(keyStr, this.samples.push(copy) - 1);
+      return;
+    }
+    const existing = this.samples[idx].value;
+    values.forEach((v, i) => {
+      existing[i] = toNumber(existing[i]) + v;
+    });
+  }
+
+  private copySample(
+    profile: perftools.profiles.IProfile,
+    sample: perftools.profiles.ISample,
+    locationIds: Map<number, number>,
+    values: number[]
+  ): perftools.profiles.Sample {
+    const label = (sample.label || []).map(
+      l =>
+        new perftools.profiles.Label({
+          key: this.addString(getString(profile, l.key)),
+          str: l.str ? this.addString(getString(profile, l.str)) : 0,
+          num: toNumber(l.num),
+          numUnit: l.numUnit
+            ? this.addString(getString(profile, l.numUnit))
+            : 0,
+        })
+    );
+    return new perftools.profiles.Sample({
+      locationId: (sample.locationId || []).map(
+        id => locationIds.get(toNumber(id)) || 0
+      ),
+      value: values,
+      label,
+    });
+  }
+
+  /**
+   * @return value type with the given type and unit, with strings added to
+   * this builder's string table.
+   */
+  valueType(type: string, unit: string): perftools.profiles.ValueType {
+    return new perftools.profiles.ValueType({
+      type: this.addString(type),
+      unit: this.addString(unit),
+    });
+  }
+}
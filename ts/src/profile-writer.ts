@@ -0,0 +1,304 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import {
+  existsSync,
+  readdirSync,
+  readFileSync,
+  renameSync,
+  unlinkSync,
+  writeFileSync,
+} from 'fs';
+import { basename, join } from 'path';
+
+import { perftools } from '../../proto/profile';
+import * as heapProfiler from './heap-profiler';
+import { getSampleTypes, mergeProfiles } from './profile-combiner';
+import { decodeSync, encodeSync } from './profile-encoder';
+import { getRevision } from './profile-metadata';
+import { getString, toNumber } from './profile-utils';
+import * as timeProfiler from './time-profiler';
+
+const DEFAULT_HEAP_INTERVAL_BYTES = 512 * 1024;
+const DEFAULT_HEAP_STACK_DEPTH = 64;
+
+export type ExitProfileType = 'time' | 'heap';
+
+export interface ProfileOnExitOptions extends timeProfiler.StartOptions {
+  /** Directory to which the profile is written. Defaults to the cwd. */
+  dir?: string;
+  /** Type of profile to collect. Defaults to 'time'. */
+  type?: ExitProfileType;
+  /** Heap profiles only. Average number of bytes between samples. */
+  intervalBytes?: number;
+  /** Heap profiles only. Maximum stack depth for samples collected. */
+  stackDepth?: number;
+}
+
+export interface ProfileToFileOptions extends timeProfiler.StartOptions {
+  /** Path of the file to which the profile is written. */
+  path: string;
+  /** Time in milliseconds between writes of the profile collected so far. */
+  flushIntervalMillis: number;
+  /**
+   * Called when the profile cannot be collected or written at a flush, after
+   * which profiling continues. Defaults to console.error.
+   */
+  onError?: (err: Error) => void;
+}
+
+export interface WriteProfileOptions {
+  /**
+   * Largest number of profiles with the same prefix kept in the directory.
+   * When a profile is written, the oldest ones are deleted beyond it. By
+   * default, no profile is deleted.
+   */
+  maxFiles?: number;
+  /** Start of the names of the files. Defaults to "pprof-profile-". */
+  prefix?: string;
+  /**
+   * When true, a JSON file describing the profile is written next to it, at
+   * its path followed by ".json", for tools which do not read profiles.
+   */
+  sidecar?: boolean;
+  /** Name of the profiled service, recorded in the sidecar. */
+  service?: string;
+  /**
+   * Version of the profiled service, recorded in the sidecar. Defaults to
+   * the revision recorded in the profile, if any.
+   */
+  version?: string;
+  /** Labels describing the profile, e.g. the zone, recorded in the sidecar. */
+  labels?: { [key: string]: string };
+}
+
+/** Contents of the sidecar of a profile written by writeProfile(). */
+export interface ProfileSidecar {
+  /** Name of the profile file, in the same directory. */
+  file: string;
+  service?: string;
+  version?: string;
+  /** 'time', 'heap', or the sample types of other profiles. */
+  type: string;
+  durationMillis: number;
+  sampleCount: number;
+  labels: { [key: string]: string };
+}
+
+const PROFILE_SUFFIX = '.pb.gz';
+const SIDECAR_SUFFIX = '.json';
+
+// Time used in the name of the last profile written by writeProfile(), so
+// that names of profiles written by this process sort in order of writing.
+let lastWriteMillis = 0;
+
+/**
+ * Writes contents to path such that readers of path never observe a
+ * partially written file.
+ */
+function writeFileAtomicSync(path: string, contents: Buffer) {
+  const tmpPath = `${path}.${process.pid}.tmp`;
+  writeFileSync(tmpPath, contents);
+  renameSync(tmpPath, path);
+}
+
+/**
+ * Merges profile into the profile stored in the file at path, e.g. to
+ * accumulate time profiles across restarts of a process, and replaces the
+ * file atomically. When there is no file at path, profile is written as is.
+ * The file is not locked, so only one process may append to a given path at a
+ * time: with concurrent writers, the last to replace the file drops the
+ * profiles merged by the others.
+ *
+ * @return the profile written to path.
+ */
+export function appendProfile(
+  path: string,
+  profile: perftools.profiles.IProfile
+): perftools.profiles.IProfile {
+  const merged = existsSync(path)
+    ? mergeProfiles([decodeSync(readFileSync(path)), profile])
+    : profile;
+  writeFileAtomicSync(path, encodeSync(merged));
+  return merged;
+}
+
+/**
+ * Writes profile to a new file in dir named after the time at which it is
+ * written, e.g. from a periodic or signal triggered dumper. With maxFiles,
+ * only the most recent profiles are kept, which bounds the disk space used.
+ *
+ * @return path of the file written.
+ */
+export function writeProfile(
+  dir: string,
+  profile: perftools.profiles.IProfile,
+  options: WriteProfileOptions = {}
+): string {
+  const prefix = options.prefix || 'pprof-profile-';
+  const maxFiles = options.maxFiles;
+  if (maxFiles !== undefined && !(maxFiles >= 1)) {
+    throw new Error(`maxFiles must be at least 1, got ${maxFiles}.`);
+  }
+  lastWriteMillis = Math.max(Date.now(), lastWriteMillis + 1);
+  // Colons are not allowed in file names on Windows.
+  const time = new Date(lastWriteMillis).toISOString().replace(/:/g, '');
+  const file = join(dir, `${prefix}${time}-${process.pid}${PROFILE_SUFFIX}`);
+  writeFileAtomicSync(file, encodeSync(profile));
+  if (options.sidecar) {
+    const sidecar = profileSidecar(basename(file), profile, options);
+    writeFileAtomicSync(
+      file + SIDECAR_SUFFIX,
+      Buffer.from(JSON.stringify(sidecar, null, 2))
+    );
+  }
+
+  if (maxFiles !== undefined) {
+    const files = readdirSync(dir);
+    const profiles = files
+      .filter(f => f.startsWith(prefix) && f.endsWith(PROFILE_SUFFIX))
+      .sort();
+    for (const old of profiles.slice(0, profiles.length - maxFiles)) {
+      unlinkSync(join(dir, old));
+      if (files.indexOf(old + SIDECAR_SUFFIX) !== -1) {
+        unlinkSync(join(dir, old + SIDECAR_SUFFIX));
+      }
+    }
+  }
+  return file;
+}
+
+function profileSidecar(
+  file: string,
+  profile: perftools.profiles.IProfile,
+  options: WriteProfileOptions
+): ProfileSidecar {
+  const sampleTypes = getSampleTypes(profile).map(st => st.type);
+  let type = sampleTypes.join(',');
+  if (sampleTypes.indexOf('wall') !== -1) {
+    type = 'time';
+  } else if (sampleTypes.indexOf('space') !== -1) {
+    type = 'heap';
+  }
+  const comments = (profile.comment || []).map(c => getString(profile, c));
+  return {
+    file,
+    service: options.service,
+    version: options.version || getRevision(comments),
+    type,
+    durationMillis: toNumber(profile.durationNanos) / 1e6,
+    sampleCount: (profile.sample || []).length,
+    labels: options.labels || {},
+  };
+}
+
+/**
+ * Starts a time profile which is written to options.path every
+ * options.flushIntervalMillis, and when the returned function is called.
+ *
+ * At each flush, the V8 profile collected since the previous flush is
+ * stopped and merged into the profile written so far, and a new V8 profile
+ * is started. Memory use is bounded by the number of distinct stacks rather
+ * than by the length of the profile, at the cost of restarting the profiler
+ * at each flush. The file is replaced atomically.
+ *
+ * @return function which stops profiling, writes the final profile and
+ * returns it.
+ */
+export function profileToFile(
+  options: ProfileToFileOptions
+): () => perftools.profiles.IProfile {
+  const { path, flushIntervalMillis, onError, ...startOptions } = options;
+  const reportError = onError || ((err: Error) => console.error(err));
+  let stop = timeProfiler.start(startOptions);
+  let profile: perftools.profiles.IProfile | undefined;
+  const collect = () => {
+    const latest = stop();
+    profile = profile ? mergeProfiles([profile, latest]) : latest;
+    return profile;
+  };
+  const flush = () => {
+    let merged: perftools.profiles.IProfile;
+    try {
+      merged = collect();
+    } finally {
+      // Keep profiling even when the profile cannot be collected.
+      stop = timeProfiler.start(startOptions);
+    }
+    writeFileAtomicSync(path, encodeSync(merged));
+  };
+  const timer = setInterval(() => {
+    try {
+      flush();
+    } catch (err) {
+      reportError(err);
+    }
+  }, flushIntervalMillis);
+  // Profiling should not keep the process alive.
+  timer.unref();
+
+  return () => {
+    clearInterval(timer);
+    const merged = collect();
+    writeFileAtomicSync(path, encodeSync(merged));
+    return merged;
+  };
+}
+
+/**
+ * @return name of the file to which profileOnExit() writes a profile of the
+ * given type for the process with the given pid.
+ */
+export function exitProfileName(type: ExitProfileType, pid: number): string {
+  return type === 'heap'
+    ? `pprof-heap-profile-${pid}.pb.gz`
+    : `pprof-profile-${pid}.pb.gz`;
+}
+
+/**
+ * Starts profiling, and writes the profile when the process exits. A heap
+ * profile requires that the heap profiler is not already started.
+ *
+ * @return path of the file to which the profile will be written.
+ */
+export function profileOnExit(options: ProfileOnExitOptions = {}): string {
+  const type = options.type || 'time';
+  const file = join(options.dir || '', exitProfileName(type, process.pid));
+  let stop: () => perftools.profiles.IProfile;
+  if (type === 'heap') {
+    heapProfiler.start(
+      options.intervalBytes || DEFAULT_HEAP_INTERVAL_BYTES,
+      options.stackDepth || DEFAULT_HEAP_STACK_DEPTH
+    );
+    stop = () => {
+      const profile = heapProfiler.profile({
+        sourceMapper: options.sourceMapper,
+        sourceMap: options.sourceMap,
+        profileMetadata: options.profileMetadata,
+      });
+      heapProfiler.stop();
+      return profile;
+    };
+  } else {
+    stop = timeProfiler.start(options);
+  }
+  process.on('exit', () => {
+    // The process is going to terminate imminently. All work here needs to
+    // be synchronous.
+    writeFileSync(file, encodeSync(stop()));
+  });
+  return file;
+}
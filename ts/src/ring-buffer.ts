@@ -0,0 +1,142 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { mergeProfiles } from './profile-combiner';
+import * as timeProfiler from './time-profiler';
+
+// Number of sub-profiles into which the window is split. The retained
+// profile covers between (SLICES - 1) / SLICES of the window and the whole
+// window.
+const SLICES = 4;
+
+export interface RingBufferOptions extends timeProfiler.StartOptions {
+  /** Time in seconds of the most recent samples to keep. */
+  windowSeconds: number;
+  /**
+   * Called when a sub-profile cannot be collected in the background.
+   * Defaults to console.error.
+   */
+  onError?: (err: Error) => void;
+}
+
+interface Slice {
+  // Time in milliseconds since the epoch at which the sub-profile started.
+  startMillis: number;
+  profile: perftools.profiles.IProfile;
+}
+
+interface RingBuffer {
+  windowMillis: number;
+  startOptions: timeProfiler.StartOptions;
+  startMillis: number;
+  stop: () => perftools.profiles.IProfile;
+  // Completed sub-profiles, from oldest to newest.
+  slices: Slice[];
+  timer: NodeJS.Timer;
+}
+
+let ringBuffer: RingBuffer | undefined;
+
+/**
+ * Stops the current sub-profile of buffer, keeps it as the newest slice and
+ * starts the next one. Slices which started a window or more ago are
+ * discarded, however many slices dumps have added since.
+ */
+function rotate(buffer: RingBuffer) {
+  const now = Date.now();
+  const startMillis = buffer.startMillis;
+  let profile: perftools.profiles.IProfile;
+  try {
+    profile = buffer.stop();
+  } finally {
+    // Keep profiling even when the sub-profile cannot be collected.
+    buffer.startMillis = now;
+    buffer.stop = timeProfiler.start(buffer.startOptions);
+  }
+  buffer.slices.push({ startMillis, profile });
+  while (
+    buffer.slices.length > 1 &&
+    buffer.slices[0].startMillis <= now - buffer.windowMillis
+  ) {
+    buffer.slices.shift();
+  }
+}
+
+/**
+ * Starts a time profile which keeps only the samples of about the last
+ * options.windowSeconds, for dumpRingBuffer() to retrieve on demand, e.g.
+ * when an error occurs.
+ *
+ * The profile is collected as consecutive sub-profiles of a fraction of the
+ * window each, and sub-profiles older than the window are discarded. Other
+ * options apply to each sub-profile.
+ */
+export function startRingBuffer(options: RingBufferOptions) {
+  if (ringBuffer) {
+    throw new Error('Ring buffer profiling is already started.');
+  }
+  const { windowSeconds, onError, ...startOptions } = options;
+  if (!(windowSeconds > 0)) {
+    throw new Error(
+      `windowSeconds must be a positive number, got ${windowSeconds}.`
+    );
+  }
+  const reportError = onError || ((err: Error) => console.error(err));
+  const windowMillis = windowSeconds * 1000;
+  const buffer: RingBuffer = {
+    windowMillis,
+    startOptions,
+    startMillis: Date.now(),
+    stop: timeProfiler.start(startOptions),
+    slices: [],
+    timer: setInterval(() => {
+      try {
+        rotate(buffer);
+      } catch (err) {
+        reportError(err);
+      }
+    }, windowMillis / SLICES),
+  };
+  // Profiling should not keep the process alive.
+  buffer.timer.unref();
+  ringBuffer = buffer;
+}
+
+/**
+ * @return profile of the samples retained by the ring buffer started with
+ * startRingBuffer(), which keeps profiling.
+ */
+export function dumpRingBuffer(): perftools.profiles.IProfile {
+  if (!ringBuffer) {
+    throw new Error('Ring buffer profiling is not started.');
+  }
+  rotate(ringBuffer);
+  return mergeProfiles(ringBuffer.slices.map(s => s.profile));
+}
+
+/**
+ * Stops the ring buffer started with startRingBuffer() and discards its
+ * samples.
+ */
+export function stopRingBuffer() {
+  if (!ringBuffer) {
+    return;
+  }
+  clearInterval(ringBuffer.timer);
+  ringBuffer.stop();
+  ringBuffer = undefined;
+}
@@ -0,0 +1,205 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Synchronous decoder for the "mappings" field of a source map (revision 3).
+// SourceMapConsumer from the source-map package can only be constructed
+// asynchronously, which rules it out for maps parsed on first lookup while a
+// profile is being serialized.
+
+const BASE64_CHARS =
+  'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/';
+const BASE64_VALUES: number[] = [];
+for (let i = 0; i < BASE64_CHARS.length; i++) {
+  BASE64_VALUES[BASE64_CHARS.charCodeAt(i)] = i;
+}
+
+const VLQ_CONTINUATION_BIT = 32;
+const VLQ_VALUE_MASK = 31;
+const VLQ_SHIFT = 5;
+
+// Fields of a decoded segment, stored consecutively in a line's Int32Array.
+const GENERATED_COLUMN = 0;
+const SOURCE = 1;
+const ORIGINAL_LINE = 2;
+const ORIGINAL_COLUMN = 3;
+const NAME = 4;
+const SEGMENT_SIZE = 5;
+
+export interface RawSourceMap {
+  file?: string;
+  sourceRoot?: string;
+  sources: string[];
+  names?: string[];
+  mappings: string;
+}
+
+export interface OriginalPosition {
+  source: string;
+  /** One-based line in source. */
+  line: number;
+  /** Zero-based column in source. */
+  column: number;
+  name?: string;
+}
+
+export class ParsedSourceMap {
+  private readonly sources: string[];
+  private readonly names: string[];
+  // Segments for each generated line, sorted by generated column. Absent
+  // fields are -1.
+  private readonly lines: Int32Array[] = [];
+
+  constructor(map: RawSourceMap) {
+    const root = map.sourceRoot ? map.sourceRoot.replace(/\/?$/, '/') : '';
+    this.sources = map.sources.map(s => root + s);
+    this.names = map.names || [];
+    this.decode(map.mappings);
+  }
+
+  private decode(mappings: string) {
+    let line: number[] = [];
+    const fields: number[] = [];
+    let generatedColumn = 0;
+    let source = 0;
+    let originalLine = 0;
+    let originalColumn = 0;
+    let name = 0;
+
+    const endSegment = () => {
+      if (fields.length === 0) {
+        return;
+      }
+      generatedColumn += fields[0];
+      line.push(generatedColumn);
+      if (fields.length >= 4) {
+        source += fields[1];
+        originalLine += fields[2];
+        originalColumn += fields[3];
+        line.push(source, originalLine, originalColumn);
+      } else {
+        line.push(-1, -1, -1);
+      }
+      if (fields.length >= 5) {
+        name += fields[4];
+        line.push(name);
+      } else {
+        line.push(-1);
+      }
+      fields.length = 0;
+    };
+    const endLine = () => {
+      endSegment();
+      this.lines.push(sortSegments(line));
+      line = [];
+      generatedColumn = 0;
+    };
+
+    let value = 0;
+    let shift = 0;
+    for (let i = 0; i < mappings.length; i++) {
+      const c = mappings.charAt(i);
+      if (c === ';') {
+        endLine();
+      } else if (c === ',') {
+        endSegment();
+      } else {
+        const digit = BASE64_VALUES[mappings.charCodeAt(i)];
+        if (digit === undefined) {
+          throw new Error(`Invalid character "${c}" in source map mappings`);
+        }
+        value += (digit & VLQ_VALUE_MASK) << shift;
+        if (digit & VLQ_CONTINUATION_BIT) {
+          shift += VLQ_SHIFT;
+        } else {
+          // The lowest bit is the sign.
+          fields.push(value & 1 ? -(value >>> 1) : value >>> 1);
+          value = 0;
+          shift = 0;
+        }
+      }
+    }
+    endLine();
+  }
+
+  /**
+   * @param line - one-based line in the generated file.
+   * @param column - zero-based column in the generated file.
+   * @return the original position of the closest segment at or before the
+   * given position on the same line, or null if there is none or it has no
+   * original position.
+   */
+  originalPositionFor(line: number, column: number): OriginalPosition | null {
+    const segments = this.lines[line - 1];
+    if (!segments) {
+      return null;
+    }
+    // Binary search for the last segment with generated column <= column.
+    let lo = 0;
+    let hi = segments.length / SEGMENT_SIZE - 1;
+    let found = -1;
+    while (lo <= hi) {
+      const mid = (lo + hi) >>> 1;
+      if (segments[mid * SEGMENT_SIZE + GENERATED_COLUMN] <= column) {
+        found = mid;
+        lo = mid + 1;
+      } else {
+        hi = mid - 1;
+      }
+    }
+    if (found === -1) {
+      return null;
+    }
+    const offset = found * SEGMENT_SIZE;
+    const source = segments[offset + SOURCE];
+    if (source === -1) {
+      return null;
+    }
+    const name = segments[offset + NAME];
+    return {
+      source: this.sources[source],
+      line: segments[offset + ORIGINAL_LINE] + 1,
+      column: segments[offset + ORIGINAL_COLUMN],
+      name: name === -1 ? undefined : this.names[name],
+    };
+  }
+}
+
+function sortSegments(line: number[]): Int32Array {
+  const segments = new Int32Array(line);
+  let sorted = true;
+  for (let i = SEGMENT_SIZE; i < segments.length; i += SEGMENT_SIZE) {
+    if (segments[i] < segments[i - SEGMENT_SIZE]) {
+      sorted = false;
+      break;
+    }
+  }
+  if (sorted) {
+    return segments;
+  }
+  const order: number[] = [];
+  for (let i = 0; i < segments.length; i += SEGMENT_SIZE) {
+    order.push(i);
+  }
+  order.sort((a, b) => segments[a] - segments[b]);
+  const result = new Int32Array(segments.length);
+  order.forEach((from, i) => {
+    result.set(
+      segments.subarray(from, from + SEGMENT_SIZE),
+      i * SEGMENT_SIZE
+    );
+  });
+  return result;
+}
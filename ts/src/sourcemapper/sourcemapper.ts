@@ -24,6 +24,8 @@ import * as path from 'path';
 import * as sourceMap from 'source-map';
 
 import * as scanner from '../../third_party/cloud-debug-nodejs/src/agent/io/scanner';
+import { currentThreadId } from '../thread-id';
+import { ParsedSourceMap, RawSourceMap } from './mappings';
 
 const pify = require('pify');
 const pLimit = require('p-limit');
@@ -37,6 +39,42 @@ export interface MapInfoCompiled {
   mapConsumer: sourceMap.RawSourceMap;
 }
 
+export interface MapInfoLazy {
+  mapFileDir: string;
+  mapPath: string;
+}
+
+export interface SourceMapperOptions {
+  /**
+   * When set, source maps are only indexed when the SourceMapper is created.
+   * Each map is parsed on the first lookup for its generated file, and at
+   * most maxCachedMaps parsed maps are kept, evicting the least recently used.
+   */
+  maxCachedMaps?: number;
+
+  /**
+   * Directories against which the sources of source maps are resolved, in
+   * order, e.g. the package roots of a monorepo. A source is resolved
+   * against the first root in which it exists, and otherwise against the
+   * directory of its source map.
+   */
+  roots?: string[];
+}
+
+/**
+ * A source map which is already in memory, and the generated file it
+ * describes.
+ */
+export interface SourceMapEntry {
+  /**
+   * Path of the generated file. Relative source paths in the map are
+   * resolved from its directory.
+   */
+  generatedFile: string;
+  /** The source map, as JSON or parsed. */
+  map: string | sourceMap.RawSourceMap;
+}
+
 export interface GeneratedLocation {
   file: string;
   name?: string;
@@ -62,21 +100,58 @@ async function processSourceMap(
   infoMap: Map<string, MapInfoCompiled>,
   mapPath: string
 ): Promise<void> {
+  mapPath = checkMapPath(mapPath);
+  const contents = await readMapFile(mapPath);
+  await processSourceMapContents(infoMap, mapPath, contents);
+}
+
+function checkMapPath(mapPath: string): string {
   // this handles the case when the path is undefined, null, or
   // the empty string
   if (!mapPath || !mapPath.endsWith(MAP_EXT)) {
     throw new Error(`The path "${mapPath}" does not specify a source map file`);
   }
-  mapPath = path.normalize(mapPath);
+  return path.normalize(mapPath);
+}
 
-  let contents;
+async function readMapFile(mapPath: string): Promise<string> {
   try {
-    contents = await readFile(mapPath, 'utf8');
+    return await readFile(mapPath, 'utf8');
   } catch (e) {
     throw new Error('Could not read source map file ' + mapPath + ': ' + e);
   }
+}
+
+/**
+ * @return path of the generated file described by the source map at mapPath.
+ */
+function generatedPathFor(mapPath: string, file?: string): string {
+  /*
+   * If the source map file defines a "file" attribute, use it as
+   * the output file where the path is relative to the directory
+   * containing the map file.  Otherwise, use the name of the output
+   * file (with the .map extension removed) as the output file.
+   */
+  const generatedBase = file ? file : path.basename(mapPath, MAP_EXT);
+  return path.resolve(path.dirname(mapPath), generatedBase);
+}
+
+async function processSourceMapContents(
+  infoMap: Map<string, MapInfoCompiled>,
+  mapPath: string,
+  contents: string
+): Promise<void> {
+  const consumer = await createConsumer(contents, mapPath);
+  infoMap.set(generatedPathFor(mapPath, consumer.file), {
+    mapFileDir: path.dirname(mapPath),
+    mapConsumer: consumer,
+  });
+}
 
-  let consumer: sourceMap.RawSourceMap;
+async function createConsumer(
+  contents: string | sourceMap.RawSourceMap,
+  mapPath: string
+): Promise<sourceMap.RawSourceMap> {
   try {
     // TODO: Determine how to reconsile the type conflict where `consumer`
     //       is constructed as a SourceMapConsumer but is used as a
@@ -84,7 +159,7 @@ async function processSourceMap(
     // TODO: Resolve the cast of `contents as any` (This is needed because the
     //       type is expected to be of `RawSourceMap` but the existing
     //       working code uses a string.)
-    consumer = ((await new sourceMap.SourceMapConsumer(
+    return ((await new sourceMap.SourceMapConsumer(
       (contents as {}) as sourceMap.RawSourceMap
     )) as {}) as sourceMap.RawSourceMap;
   } catch (e) {
@@ -96,26 +171,55 @@ async function processSourceMap(
         e
     );
   }
+}
 
-  /*
-   * If the source map file defines a "file" attribute, use it as
-   * the output file where the path is relative to the directory
-   * containing the map file.  Otherwise, use the name of the output
-   * file (with the .map extension removed) as the output file.
-   */
-  const dir = path.dirname(mapPath);
-  const generatedBase = consumer.file
-    ? consumer.file
-    : path.basename(mapPath, MAP_EXT);
-  const generatedPath = path.resolve(dir, generatedBase);
-
-  infoMap.set(generatedPath, { mapFileDir: dir, mapConsumer: consumer });
+/**
+ * Records the generated file described by the source map at mapPath in
+ * lazyMap, without parsing its mappings. Indexed source maps (which have
+ * sections instead of mappings) are processed eagerly into infoMap.
+ */
+async function indexSourceMap(
+  infoMap: Map<string, MapInfoCompiled>,
+  lazyMap: Map<string, MapInfoLazy>,
+  mapPath: string
+): Promise<void> {
+  mapPath = checkMapPath(mapPath);
+  const contents = await readMapFile(mapPath);
+  let map: { file?: string; sections?: {} };
+  try {
+    map = JSON.parse(contents);
+  } catch (e) {
+    throw new Error(
+      'An error occurred while reading the sourceMap file ' + mapPath + ': ' + e
+    );
+  }
+  if (map.sections) {
+    return processSourceMapContents(infoMap, mapPath, contents);
+  }
+  lazyMap.set(generatedPathFor(mapPath, map.file), {
+    mapFileDir: path.dirname(mapPath),
+    mapPath,
+  });
 }
 
 export class SourceMapper {
   infoMap: Map<string, MapInfoCompiled>;
+  // Source maps which are parsed on first lookup, by generated file.
+  lazyMap: Map<string, MapInfoLazy>;
+  // Parsed source maps from lazyMap, from least to most recently used.
+  parsedMaps: Map<string, ParsedSourceMap>;
+  // Id of the thread in which this was created. Profiles collected in other
+  // threads must not be mapped with this.
+  readonly threadId: number;
+  private readonly maxCachedMaps: number;
+  private readonly roots: string[];
+  // Resolved path of each source, by directory of its map and source.
+  private readonly resolvedSources = new Map<string, string>();
 
-  static async create(searchDirs: string[]): Promise<SourceMapper> {
+  static async create(
+    searchDirs: string[],
+    options: SourceMapperOptions = {}
+  ): Promise<SourceMapper> {
     const mapFiles: string[] = [];
     for (const dir of searchDirs) {
       try {
@@ -127,7 +231,27 @@ export class SourceMapper {
         throw new Error(`failed to get source maps from ${dir}: ${e}`);
       }
     }
-    return createFromMapFiles(mapFiles);
+    return createFromMapFiles(mapFiles, options);
+  }
+
+  /**
+   * @return a SourceMapper for source maps which are already in memory, e.g.
+   * those of a bundler, without reading any files.
+   */
+  static async fromEntries(entries: SourceMapEntry[]): Promise<SourceMapper> {
+    const mapper = new SourceMapper();
+    for (const entry of entries) {
+      const generatedFile = path.resolve(entry.generatedFile);
+      const consumer = await createConsumer(
+        entry.map,
+        `for ${entry.generatedFile}`
+      );
+      mapper.infoMap.set(generatedFile, {
+        mapFileDir: path.dirname(generatedFile),
+        mapConsumer: consumer,
+      });
+    }
+    return mapper;
   }
 
   /**
@@ -138,8 +262,93 @@ export class SourceMapper {
    *  processing the given source map files
    * @constructor
    */
-  constructor() {
+  constructor(options: SourceMapperOptions = {}) {
     this.infoMap = new Map();
+    this.lazyMap = new Map();
+    this.parsedMaps = new Map();
+    this.maxCachedMaps = options.maxCachedMaps || 0;
+    this.roots = options.roots || [];
+    this.threadId = currentThreadId();
+  }
+
+  /**
+   * Releases the source maps held by this mapper, after which locations are
+   * no longer mapped. Memory with which the source-map package parses maps
+   * is only freed by this, so callers which create many mappers should
+   * dispose of each one when it is no longer used.
+   */
+  dispose() {
+    for (const info of this.infoMap.values()) {
+      const consumer = (info.mapConsumer as {}) as sourceMap.SourceMapConsumer;
+      consumer.destroy();
+    }
+    this.infoMap.clear();
+    this.lazyMap.clear();
+    this.parsedMaps.clear();
+    this.resolvedSources.clear();
+  }
+
+  /**
+   * @return path of source, a source of the source map in mapFileDir.
+   */
+  private resolveSource(mapFileDir: string, source: string): string {
+    if (this.roots.length === 0) {
+      return path.resolve(mapFileDir, source);
+    }
+    const key = `${mapFileDir}\0${source}`;
+    let resolved = this.resolvedSources.get(key);
+    if (resolved === undefined) {
+      resolved = path.resolve(mapFileDir, source);
+      for (const root of this.roots) {
+        const file = path.resolve(root, source);
+        if (fs.existsSync(file)) {
+          resolved = file;
+          break;
+        }
+      }
+      this.resolvedSources.set(key, resolved);
+    }
+    return resolved;
+  }
+
+  get lazy(): boolean {
+    return this.maxCachedMaps > 0;
+  }
+
+  /**
+   * @return the parsed source map for the generated file at inputPath,
+   * parsing it if it is not cached, or null if there is no lazily loaded map
+   * for the file.
+   */
+  private getParsedMap(inputPath: string): ParsedSourceMap | null {
+    let parsed = this.parsedMaps.get(inputPath);
+    if (parsed) {
+      // Move to the most recently used position.
+      this.parsedMaps.delete(inputPath);
+      this.parsedMaps.set(inputPath, parsed);
+      return parsed;
+    }
+    const info = this.lazyMap.get(inputPath);
+    if (!info) {
+      return null;
+    }
+    let map: RawSourceMap;
+    try {
+      map = JSON.parse(fs.readFileSync(info.mapPath, 'utf8'));
+      parsed = new ParsedSourceMap(map);
+    } catch (e) {
+      throw new Error(
+        'An error occurred while reading the sourceMap file ' +
+          info.mapPath +
+          ': ' +
+          e
+      );
+    }
+    if (this.parsedMaps.size >= this.maxCachedMaps) {
+      this.parsedMaps.delete(this.parsedMaps.keys().next().value);
+    }
+    this.parsedMaps.set(inputPath, parsed);
+    return parsed;
   }
 
   /**
@@ -174,7 +383,10 @@ export class SourceMapper {
    *  relative to the process's current working directory.
    */
   hasMappingInfo(inputPath: string): boolean {
-    return this.getMappingInfo(inputPath) !== null;
+    return (
+      this.getMappingInfo(inputPath) !== null ||
+      this.lazyMap.has(path.normalize(inputPath))
+    );
   }
 
   /**
@@ -198,6 +410,9 @@ export class SourceMapper {
    */
   mappingInfo(location: GeneratedLocation): SourceLocation {
     const inputPath = path.normalize(location.file);
+    if (this.lazyMap.has(inputPath)) {
+      return this.lazyMappingInfo(inputPath, location);
+    }
     const entry = this.getMappingInfo(inputPath);
     if (entry === null) {
       return location;
@@ -213,7 +428,27 @@ export class SourceMapper {
       return location;
     }
     return {
-      file: path.resolve(entry.mapFileDir, pos.source),
+      file: this.resolveSource(entry.mapFileDir, pos.source),
+      line: pos.line || undefined,
+      name: pos.name || location.name,
+      column: pos.column || undefined,
+    };
+  }
+
+  private lazyMappingInfo(
+    inputPath: string,
+    location: GeneratedLocation
+  ): SourceLocation {
+    const parsed = this.getParsedMap(inputPath)!;
+    const pos = parsed.originalPositionFor(location.line, location.column);
+    if (pos === null) {
+      return location;
+    }
+    return {
+      file: this.resolveSource(
+        this.lazyMap.get(inputPath)!.mapFileDir,
+        pos.source
+      ),
       line: pos.line || undefined,
       name: pos.name || location.name,
       column: pos.column || undefined,
@@ -221,11 +456,18 @@ export class SourceMapper {
   }
 }
 
-async function createFromMapFiles(mapFiles: string[]): Promise<SourceMapper> {
+async function createFromMapFiles(
+  mapFiles: string[],
+  options: SourceMapperOptions = {}
+): Promise<SourceMapper> {
   const limit = pLimit(CONCURRENCY);
-  const mapper = new SourceMapper();
+  const mapper = new SourceMapper(options);
   const promises: Array<Promise<void>> = mapFiles.map(mapPath =>
-    limit(() => processSourceMap(mapper.infoMap, mapPath))
+    limit(() =>
+      mapper.lazy
+        ? indexSourceMap(mapper.infoMap, mapper.lazyMap, mapPath)
+        : processSourceMap(mapper.infoMap, mapPath)
+    )
   );
   try {
     await Promise.all(promises);
@@ -0,0 +1,30 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+let threadId = 0;
+try {
+  threadId = require('worker_threads').threadId;
+} catch (e) {
+  // worker_threads is not available, so this is the only thread.
+}
+
+/**
+ * @return id of the thread, and so of the isolate, in which this module was
+ * loaded. This is 0 for the main thread.
+ */
+export function currentThreadId(): number {
+  return threadId;
+}
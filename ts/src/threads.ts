@@ -0,0 +1,191 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { collectProfile, ControlCommand } from './control-socket';
+import { mergeProfiles } from './profile-combiner';
+import { copyStringTable, toNumber } from './profile-utils';
+import { currentThreadId } from './thread-id';
+
+/** Key of the numeric label holding the id of the thread of a sample. */
+export const THREAD_ID_LABEL = 'thread_id';
+
+/**
+ * One end of a MessageChannel from worker_threads. worker_threads is not
+ * available in all supported versions of Node.js, so only the methods used
+ * are declared.
+ */
+export interface ThreadPort {
+  postMessage(message: unknown): void;
+  // tslint:disable-next-line no-any
+  on(event: string, listener: (message: any) => void): unknown;
+  unref(): void;
+}
+
+interface ProfileRequest {
+  id: number;
+  command: ControlCommand;
+}
+
+interface ProfileResponse {
+  id: number;
+  threadId: number;
+  /** Profile serialized with Profile.encode(), when it was collected. */
+  profile?: Uint8Array;
+  error?: string;
+}
+
+interface PendingRequest {
+  resolve: (profile: perftools.profiles.IProfile) => void;
+  reject: (err: Error) => void;
+}
+
+interface ProfiledThread {
+  pending: Map<number, PendingRequest>;
+}
+
+// Ports of the threads added with addProfiledThread().
+const threads = new Map<ThreadPort, ProfiledThread>();
+let nextRequestId = 0;
+
+/**
+ * Answers requests for profiles of this thread sent on port by the thread
+ * which passed the other end of the channel to addProfiledThread(), e.g.
+ * from a worker with the port received in its workerData. The port does
+ * not keep the thread alive.
+ */
+export function serveThreadProfiles(port: ThreadPort) {
+  port.on('message', (request: ProfileRequest) => {
+    const respond = (response: Partial<ProfileResponse>) =>
+      port.postMessage({
+        id: request.id,
+        threadId: currentThreadId(),
+        ...response,
+      });
+    Promise.resolve()
+      .then(() => collectProfile(request.command))
+      .then(
+        profile =>
+          respond({
+            profile: perftools.profiles.Profile.encode(profile).finish(),
+          }),
+        err => respond({ error: err.message })
+      );
+  });
+  port.unref();
+}
+
+/**
+ * Adds the thread serving profiles on the other end of port, with
+ * serveThreadProfiles(), to those profiled by collectAllThreads(). The
+ * thread is removed when the port is closed, e.g. when the worker exits.
+ */
+export function addProfiledThread(port: ThreadPort) {
+  const thread: ProfiledThread = { pending: new Map() };
+  threads.set(port, thread);
+  port.on('message', (response: ProfileResponse) => {
+    const request = thread.pending.get(response.id);
+    if (!request) {
+      return;
+    }
+    thread.pending.delete(response.id);
+    if (response.profile) {
+      request.resolve(
+        withThreadLabel(
+          perftools.profiles.Profile.decode(response.profile),
+          response.threadId
+        )
+      );
+    } else {
+      request.reject(
+        new Error(
+          `Profiling thread ${response.threadId} failed: ${response.error}`
+        )
+      );
+    }
+  });
+  port.on('close', () => {
+    threads.delete(port);
+    for (const request of thread.pending.values()) {
+      request.reject(new Error('Profiled thread exited.'));
+    }
+    thread.pending.clear();
+  });
+  port.unref();
+}
+
+function requestProfile(
+  port: ThreadPort,
+  thread: ProfiledThread,
+  command: ControlCommand
+): Promise<perftools.profiles.IProfile> {
+  return new Promise((resolve, reject) => {
+    const id = nextRequestId++;
+    thread.pending.set(id, { resolve, reject });
+    port.postMessage({ id, command });
+  });
+}
+
+/**
+ * @return copy of profile with a numeric label THREAD_ID_LABEL holding
+ * threadId on each sample.
+ */
+function withThreadLabel(
+  profile: perftools.profiles.IProfile,
+  threadId: number
+): perftools.profiles.IProfile {
+  const { stringTable, addString } = copyStringTable(profile);
+  const key = addString(THREAD_ID_LABEL);
+  const sample = (profile.sample || []).map(
+    s =>
+      new perftools.profiles.Sample({
+        locationId: s.locationId,
+        value: s.value,
+        label: [
+          ...(s.label || []),
+          new perftools.profiles.Label({ key, num: threadId }),
+        ],
+      })
+  );
+  return { ...profile, stringTable, sample };
+}
+
+/**
+ * Collects the profile requested by command in this thread and, at the same
+ * time, in each thread added with addProfiledThread(), and merges them into
+ * a single profile whose samples are labeled with the id of their thread,
+ * THREAD_ID_LABEL. Rejects if any of the profiles cannot be collected, e.g.
+ * a heap profile of a thread which did not start the heap profiler.
+ *
+ * The duration of the merged profile is the longest of the profiles of the
+ * threads, since they were collected concurrently.
+ */
+export async function collectAllThreads(
+  command: ControlCommand
+): Promise<perftools.profiles.IProfile> {
+  const requests = Array.from(threads.entries()).map(([port, thread]) =>
+    requestProfile(port, thread, command)
+  );
+  const own = collectProfile(command).then(profile =>
+    withThreadLabel(profile, currentThreadId())
+  );
+  const profiles = await Promise.all([own, ...requests]);
+  const merged = mergeProfiles(profiles);
+  merged.durationNanos = Math.max(
+    ...profiles.map(p => toNumber(p.durationNanos))
+  );
+  return merged;
+}
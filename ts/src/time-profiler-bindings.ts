@@ -13,27 +13,42 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
-import * as path from 'path';
+import { loadBinding } from './binding';
+import { currentThreadId } from './thread-id';
 import { TimeProfile } from './v8-types';
 
-const binary = require('node-pre-gyp');
-const bindingPath = binary.find(
-  path.resolve(path.join(__dirname, '../../package.json'))
-);
-const profiler = require(bindingPath);
+const profiler = loadBinding();
 
 // Wrappers around native time profiler functions.
-export function startProfiling(runName: string, includeLineInfo?: boolean) {
-  profiler.timeProfiler.startProfiling(runName, includeLineInfo || false);
+export function startProfiling(
+  runName: string,
+  includeLineInfo?: boolean,
+  recordSamples?: boolean
+) {
+  profiler.timeProfiler.startProfiling(
+    runName,
+    includeLineInfo || false,
+    recordSamples || false
+  );
 }
 
 export function stopProfiling(
   runName: string,
-  includeLineInfo?: boolean
+  includeLineInfo?: boolean,
+  recordSamples?: boolean
 ): TimeProfile {
-  return profiler.timeProfiler.stopProfiling(runName, includeLineInfo || false);
+  const profile: TimeProfile = profiler.timeProfiler.stopProfiling(
+    runName,
+    includeLineInfo || false,
+    recordSamples || false
+  );
+  profile.threadId = currentThreadId();
+  return profile;
 }
 
+// The binding provides setSamplingInterval, which calls the CPU profiler's
+// SetSamplingInterval, for every supported version of Node.js, so there is
+// no need to fall back to setting a V8 flag.
 export function setSamplingInterval(intervalMicros: number) {
   profiler.timeProfiler.setSamplingInterval(intervalMicros);
 }
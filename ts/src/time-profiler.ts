@@ -16,27 +16,126 @@
 
 import delay from 'delay';
 
-import { serializeTimeProfile } from './profile-serializer';
+import { perftools } from '../../proto/profile';
+import { LabelSet, LabelSetter, LabelsProvider } from './label-setter';
+import {
+  MetricsCallback,
+  millisSince,
+  nowMicros,
+  reportMetrics,
+} from './metrics';
+import { checkOptionKeys, OptionKeys } from './options';
+import {
+  loopLagLabelsProvider,
+  LoopLagMonitor,
+  LoopLagReader,
+} from './loop-lag';
+import { loadOtelApi, otelLabelsProvider } from './otel';
+import {
+  markerComment,
+  metadataComments,
+  ProfileMetadata,
+  timeLimitedComment,
+} from './profile-metadata';
+import { mergeProfiles } from './profile-combiner';
+import {
+  NameMapper,
+  serializeTimeProfile,
+  SourceMapStats,
+} from './profile-serializer';
+import { toNumber, withComment } from './profile-utils';
 import { SourceMapper } from './sourcemapper/sourcemapper';
 import {
   setSamplingInterval,
   startProfiling,
   stopProfiling,
 } from './time-profiler-bindings';
+import { TimeProfile, TimeProfileNode } from './v8-types';
+import { WasmFunctionNames } from './wasm';
 
 let profiling = false;
 
+interface Marker {
+  name: string;
+  /** Time in microseconds, on the clock of process.hrtime(). */
+  timestamp: number;
+}
+
+// Markers added during the current profile.
+let markers: Marker[] = [];
+
 const DEFAULT_INTERVAL_MICROS: Microseconds = 1000;
+// Largest sampling interval chosen when targetOverheadPercent is set.
+const MAX_ADAPTIVE_INTERVAL_MICROS: Microseconds = 100 * 1000;
+
+// Shortest time for which a profile with sampleCount set is collected before
+// its samples are counted.
+const MIN_SAMPLE_COUNT_POLL_MILLIS: Milliseconds = 10;
+
+// Time before starting the profiler is first retried, doubled for each
+// further retry.
+const START_RETRY_BACKOFF_MILLIS: Milliseconds = 10;
+
+// Sampling interval for the next profile with targetOverheadPercent set,
+// adjusted after each such profile. Overhead is a property of the process,
+// so the interval is shared by all callers; see resetAdaptiveInterval().
+let adaptiveIntervalMicros: Microseconds | undefined;
 
 type Microseconds = number;
 type Milliseconds = number;
 
 export interface TimeProfilerOptions {
-  /** time in milliseconds for which to collect profile. */
-  durationMillis: Milliseconds;
+  /**
+   * time in milliseconds for which to collect profile. Either this,
+   * deadline or sampleCount must be specified.
+   */
+  durationMillis?: Milliseconds;
+  /** time at which to stop collecting the profile. */
+  deadline?: Date;
+  /**
+   * Number of samples to collect, however long it takes, e.g. for
+   * benchmarks. Since samples cannot be counted while V8 profiles, the
+   * profile is collected in rounds expected to take the remaining samples,
+   * which are merged, so slightly more samples may be collected.
+   */
+  sampleCount?: number;
+  /**
+   * Minimum number of samples of a profile collected for durationMillis or
+   * until deadline. When fewer samples were collected, e.g. because the
+   * process was mostly idle, profiling continues in further rounds, merged
+   * into the profile, until minSamples are collected or the profile has
+   * been collected for maxDurationMillis.
+   */
+  minSamples?: number;
+  /**
+   * Longest time in milliseconds for which a profile with minSamples set is
+   * collected. This defaults to 10 times the requested duration.
+   */
+  maxDurationMillis?: Milliseconds;
+  /**
+   * Number of times starting the profiler is retried, after a short
+   * backoff, when V8 cannot start it because too many profilers are running.
+   * This defaults to 0.
+   */
+  maxRetries?: number;
   /** average time in microseconds between samples */
   intervalMicros?: Microseconds;
   sourceMapper?: SourceMapper;
+
+  /**
+   * When set to false, sourceMapper is not used and locations are recorded
+   * as they are in the generated code, which makes serialization faster.
+   * This defaults to true.
+   */
+  sourceMap?: boolean;
+
+  /**
+   * When true, collecting the profile fails if the leaf frame of a sample is
+   * in a JavaScript file on disk whose location could not be source mapped,
+   * e.g. to check in CI that source maps are deployed.
+   */
+  requireSourceMaps?: boolean;
+
   name?: string;
 
   /**
@@ -46,31 +145,771 @@ export interface TimeProfilerOptions {
    * This defaults to false.
    */
   lineNumbers?: boolean;
+
+  /**
+   * When set to true, the column number of each location is included in
+   * the profile, so that samples can be attributed to a position within a
+   * line. Most useful together with lineNumbers.
+   * This defaults to false.
+   */
+  columnNumbers?: boolean;
+
+  /**
+   * When set to true, the system name of each function records the id of
+   * its script in V8, as "<name> [script <id>]", and relative file names are
+   * resolved to absolute paths, so that symbolizers can tell apart
+   * functions of different files with the same name.
+   * This defaults to false.
+   */
+  scriptIds?: boolean;
+
+  /**
+   * When set to true, frames of Node.js internal modules (those whose file
+   * name starts with "node:" or "internal/") are removed from the profile and
+   * their samples are attributed to the nearest calling frame from user code.
+   * This defaults to false.
+   */
+  stripNodeInternals?: boolean;
+
+  /**
+   * When set, leaf frames with fewer than this many samples of their own are
+   * removed from the profile and their samples are attributed to their
+   * caller, reducing noise from rarely sampled frames.
+   */
+  minSelfSamples?: number;
+
+  /**
+   * When set, samples taken in this many milliseconds after the profile
+   * starts are discarded, e.g. to exclude noise from loading modules at
+   * startup. For time.profile(), this is part of durationMillis. Cannot be
+   * combined with lineNumbers.
+   */
+  skipInitialMillis?: Milliseconds;
+
+  /**
+   * When set, only the samples of the topStacks stacks with the most samples
+   * are kept, and the samples of all other stacks are attributed to a single
+   * "(other)" frame. This bounds the size of profiles with many distinct
+   * stacks without changing their totals.
+   */
+  topStacks?: number;
+
+  /**
+   * When set, only the samples of stacks with at least this percentage of
+   * all samples are kept, and the others are attributed to a single
+   * "(other)" frame, which adapts to the size of the profile.
+   */
+  minCumulativePercent?: number;
+
+  /**
+   * When set, the stack of each sample is truncated to its maxFrames frames
+   * closest to the leaf, and the frames removed are replaced by a single
+   * "(truncated)" frame. This bounds the size of profiles of deeply nested
+   * code.
+   */
+  maxFrames?: number;
+
+  /**
+   * When set to true, each sample is recorded separately in the profile,
+   * with a timestamp_ns label holding the time at which it was taken in
+   * nanoseconds since the epoch. Cannot be combined with lineNumbers.
+   * This defaults to false.
+   */
+  timeline?: boolean;
+
+  /**
+   * With timeline, timestamp_ns labels hold the time since the start of the
+   * profile instead, which makes them smaller and does not reveal the wall
+   * clock time of the samples.
+   */
+  relativeTimestamps?: boolean;
+
+  /**
+   * When set, the sampling interval is adjusted from one profile to the next
+   * to keep the profiler's overhead near this percentage of the profiled
+   * time. The overhead of a profile is estimated as the time spent
+   * collecting and serializing it (as reported to onMetrics) divided by its
+   * duration. When it exceeds the target, the interval of the next profile
+   * is doubled, up to 100ms; when it is below half of the target, the
+   * interval is halved, down to intervalMicros. V8 only applies a new
+   * interval when a profile starts, so adjustments take effect from the next
+   * profile. The adjusted interval is shared by all profiles of the process
+   * with this option, until resetAdaptiveInterval() is called.
+   */
+  targetOverheadPercent?: number;
+
+  /**
+   * Called before and after each asynchronous callback runs, and when the
+   * profile starts, to get the labels for the samples taken until it is next
+   * called. Label values are strings, or numbers with an optional unit such
+   * as {num: 512, unit: 'bytes'}. Cannot be combined with lineNumbers.
+   */
+  labels?: LabelsProvider;
+
+  /**
+   * When set to true, samples are labeled with the trace_id and span_id of
+   * the OpenTelemetry span which was active when they were taken. Requires
+   * the application to use the @opentelemetry/api package. Cannot be
+   * combined with lineNumbers.
+   * This defaults to false.
+   */
+  otelContext?: boolean;
+
+  /**
+   * When set, samples are labeled with the event loop lag when they were
+   * taken, as a loop_lag_ms label holding the lower bound of its bucket
+   * (0, 10, 50, 100, 500 or 1000 milliseconds). With true, the lag is
+   * measured with a timer while profiling; otherwise, this function returns
+   * the current lag in milliseconds. Cannot be combined with lineNumbers.
+   */
+  loopLag?: boolean | LoopLagReader;
+
+  /**
+   * Returns names for WebAssembly functions which V8 reports as
+   * wasm-function[<index>], e.g. names read from the module's name section
+   * with parseWasmFunctionNames().
+   */
+  wasmFunctionNames?: WasmFunctionNames;
+
+  /**
+   * Returns the name to record for a function given its name and file, e.g.
+   * to rename helpers emitted by TypeScript or Babel such as __awaiter.
+   * Applied after source mapping.
+   */
+  nameMapper?: NameMapper;
+
+  /** Information about the profiled application to record in the profile. */
+  profileMetadata?: ProfileMetadata;
+
+  /**
+   * Called with measurements of the profiler's own overhead after each
+   * profile is collected. Reporting metrics requires encoding the profile
+   * once, which adds to the overhead.
+   */
+  onMetrics?: MetricsCallback;
+
+  /**
+   * Called with the size of the profile collected by V8 before it is
+   * serialized, e.g. to decide whether to apply topStacks or maxFrames to
+   * later profiles.
+   */
+  onRawProfileSize?: (size: RawProfileSize) => void;
+
+  /**
+   * Time in milliseconds after which the platform may terminate the process,
+   * e.g. the timeout of a serverless function, measured from
+   * lifetimeStartMillis. A profile which would end later is shortened to end
+   * before then, with a warning, and records a "time_limited" comment; see
+   * isTimeLimited(). Once that time has passed, the profile is empty.
+   */
+  maxProcessLifetimeMillis?: Milliseconds;
+
+  /**
+   * Time in milliseconds since the epoch from which maxProcessLifetimeMillis
+   * is measured, e.g. the start of the current invocation of a serverless
+   * function whose process is reused. Defaults to the start of the process.
+   */
+  lifetimeStartMillis?: number;
+}
+
+/** Size of a time profile as collected by V8. */
+export interface RawProfileSize {
+  /** Number of nodes of the tree of the profile, excluding its root. */
+  rawNodeCount: number;
+  /** Number of samples taken, the sum of the hit counts of the nodes. */
+  rawSampleCount: number;
+}
+
+const TIME_PROFILER_OPTION_KEYS: OptionKeys<TimeProfilerOptions> = {
+  durationMillis: true,
+  deadline: true,
+  sampleCount: true,
+  minSamples: true,
+  maxDurationMillis: true,
+  maxRetries: true,
+  intervalMicros: true,
+  sourceMapper: true,
+  sourceMap: true,
+  requireSourceMaps: true,
+  name: true,
+  lineNumbers: true,
+  columnNumbers: true,
+  scriptIds: true,
+  stripNodeInternals: true,
+  minSelfSamples: true,
+  skipInitialMillis: true,
+  topStacks: true,
+  minCumulativePercent: true,
+  maxFrames: true,
+  timeline: true,
+  relativeTimestamps: true,
+  targetOverheadPercent: true,
+  labels: true,
+  otelContext: true,
+  loopLag: true,
+  wasmFunctionNames: true,
+  nameMapper: true,
+  profileMetadata: true,
+  onMetrics: true,
+  onRawProfileSize: true,
+  maxProcessLifetimeMillis: true,
+  lifetimeStartMillis: true,
+};
+
+/**
+ * Options for a time profile which is stopped by calling the function
+ * returned by start().
+ */
+export type StartOptions = Omit<
+  TimeProfilerOptions,
+  | 'durationMillis'
+  | 'deadline'
+  | 'sampleCount'
+  | 'minSamples'
+  | 'maxDurationMillis'
+  | 'maxRetries'
+  | 'maxProcessLifetimeMillis'
+  | 'lifetimeStartMillis'
+>;
+
+/**
+ * Options with which serialize() converts a RawProfile to pprof format. Each
+ * option which is set overrides the one passed to start().
+ */
+export type RawSerializeOptions = Pick<
+  TimeProfilerOptions,
+  | 'sourceMapper'
+  | 'sourceMap'
+  | 'requireSourceMaps'
+  | 'columnNumbers'
+  | 'scriptIds'
+  | 'stripNodeInternals'
+  | 'minSelfSamples'
+  | 'topStacks'
+  | 'minCumulativePercent'
+  | 'maxFrames'
+  | 'timeline'
+  | 'relativeTimestamps'
+  | 'wasmFunctionNames'
+  | 'nameMapper'
+  | 'profileMetadata'
+>;
+
+/**
+ * Time profile as collected by V8, returned by the function returned by
+ * start() when called with {raw: true}. It can be serialized several times
+ * with serialize(), e.g. with different source maps, without collecting it
+ * again. The native profile is deleted once it is copied to JavaScript, so
+ * the memory held is that of the profile tree, released by dispose().
+ */
+export class RawProfile {
+  private v8Profile: TimeProfile | undefined;
+
+  constructor(
+    v8Profile: TimeProfile,
+    readonly intervalMicros: Microseconds,
+    readonly options: StartOptions,
+    readonly markerComments: string[],
+    readonly timeNanos: number,
+    readonly labelsAt?: (timestamp: number) => LabelSet | undefined,
+    readonly cutoffTimestamp?: Microseconds
+  ) {
+    this.v8Profile = v8Profile;
+  }
+
+  /**
+   * @return the profile as collected by V8. Throws once disposed.
+   */
+  get profile(): TimeProfile {
+    if (!this.v8Profile) {
+      throw new Error('The raw profile has been disposed.');
+    }
+    return this.v8Profile;
+  }
+
+  /**
+   * Releases the profile, which can no longer be serialized.
+   */
+  dispose() {
+    this.v8Profile = undefined;
+  }
+}
+
+/**
+ * Function returned by start(), which stops the profile and returns it
+ * serialized in pprof format or, with {raw: true}, as a RawProfile.
+ */
+export interface StopProfiler {
+  (): perftools.profiles.IProfile;
+  (stopOptions: { raw: true }): RawProfile;
+}
+
+/**
+ * @return time in milliseconds for which to collect the profile described by
+ * options. Throws if the duration cannot be determined or is not positive.
+ */
+function profileDurationMillis(options: TimeProfilerOptions): Milliseconds {
+  if (options.deadline !== undefined) {
+    if (options.durationMillis !== undefined) {
+      throw new Error('Only one of durationMillis and deadline may be set.');
+    }
+    const remainingMillis = options.deadline.getTime() - Date.now();
+    if (!(remainingMillis > 0)) {
+      throw new Error(
+        `Profile deadline ${options.deadline.toISOString()} has passed.`
+      );
+    }
+    return remainingMillis;
+  }
+  if (options.durationMillis === undefined) {
+    throw new Error(
+      'One of durationMillis, deadline and sampleCount must be set.'
+    );
+  }
+  return options.durationMillis;
+}
+
+// Message of the error thrown by the binding when V8 cannot start another
+// profiler, which is the failure that starting again may recover from.
+const TOO_MANY_PROFILERS_MESSAGE = 'Too many profilers are running.';
+
+/** Error of V8 starting the profiler which may succeed when retried. */
+class StartProfilingError extends Error {}
+
+/**
+ * Starts a time profile as start() does, retrying up to options.maxRetries
+ * times if V8 fails to start the profiler.
+ */
+async function startWithRetries(
+  options: TimeProfilerOptions
+): Promise<() => perftools.profiles.IProfile> {
+  const maxRetries = options.maxRetries || 0;
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return start(options);
+    } catch (err) {
+      if (!(err instanceof StartProfilingError) || attempt >= maxRetries) {
+        throw err;
+      }
+      await delay(START_RETRY_BACKOFF_MILLIS * Math.pow(2, attempt));
+    }
+  }
+}
+
+/**
+ * @return size of prof, a time profile as collected by V8.
+ */
+function rawProfileSize(prof: TimeProfile): RawProfileSize {
+  let rawNodeCount = 0;
+  let rawSampleCount = 0;
+  const nodes = [...prof.topDownRoot.children] as TimeProfileNode[];
+  while (nodes.length > 0) {
+    const node = nodes.pop()!;
+    rawNodeCount++;
+    rawSampleCount += node.hitCount;
+    nodes.push(...(node.children as TimeProfileNode[]));
+  }
+  return { rawNodeCount, rawSampleCount };
+}
+
+/**
+ * @return number of samples of profile, a time profile.
+ */
+function countSamples(profile: perftools.profiles.IProfile): number {
+  return (profile.sample || []).reduce(
+    (count, s) => count + toNumber((s.value || [])[0]),
+    0
+  );
+}
+
+/**
+ * Collects a time profile until options.sampleCount samples are collected.
+ */
+async function profileSampleCount(
+  options: TimeProfilerOptions
+): Promise<perftools.profiles.IProfile> {
+  const sampleCount = options.sampleCount!;
+  if (options.durationMillis !== undefined || options.deadline !== undefined) {
+    throw new Error(
+      'Only one of durationMillis, deadline and sampleCount may be set.'
+    );
+  }
+  if (!(sampleCount > 0)) {
+    throw new Error(
+      `sampleCount must be a positive number, got ${sampleCount}.`
+    );
+  }
+  if (options.skipInitialMillis !== undefined) {
+    throw new Error('skipInitialMillis cannot be combined with sampleCount.');
+  }
+  if (options.maxProcessLifetimeMillis !== undefined) {
+    throw new Error(
+      'maxProcessLifetimeMillis cannot be combined with sampleCount.'
+    );
+  }
+  const intervalMicros = options.intervalMicros || DEFAULT_INTERVAL_MICROS;
+  let result: perftools.profiles.IProfile | undefined;
+  let collected = 0;
+  while (collected < sampleCount) {
+    const stop = await startWithRetries(options);
+    await delay(
+      Math.max(
+        MIN_SAMPLE_COUNT_POLL_MILLIS,
+        ((sampleCount - collected) * intervalMicros) / 1000
+      )
+    );
+    const latest = stop();
+    const count = countSamples(latest);
+    if (count === 0) {
+      throw new Error('No samples were collected.');
+    }
+    collected += count;
+    result = result ? mergeProfiles([result, latest]) : latest;
+  }
+  return result!;
+}
+
+/**
+ * Collects further rounds of profile, collected for durationMillis, until
+ * options.minSamples samples are collected or maxDurationMillis elapse.
+ */
+async function extendToMinSamples(
+  profile: perftools.profiles.IProfile,
+  durationMillis: Milliseconds,
+  options: TimeProfilerOptions
+): Promise<perftools.profiles.IProfile> {
+  const minSamples = options.minSamples!;
+  const maxDurationMillis =
+    options.maxDurationMillis === undefined
+      ? 10 * durationMillis
+      : options.maxDurationMillis;
+  const intervalMicros = options.intervalMicros || DEFAULT_INTERVAL_MICROS;
+  // Only the first round skips its initial samples.
+  const roundOptions = { ...options, skipInitialMillis: undefined };
+  let result = profile;
+  let collected = countSamples(profile);
+  let elapsedMillis = durationMillis;
+  while (collected < minSamples && elapsedMillis < maxDurationMillis) {
+    const roundMillis = Math.min(
+      maxDurationMillis - elapsedMillis,
+      Math.max(
+        MIN_SAMPLE_COUNT_POLL_MILLIS,
+        ((minSamples - collected) * intervalMicros) / 1000
+      )
+    );
+    const stop = await startWithRetries(roundOptions);
+    await delay(roundMillis);
+    const latest = stop();
+    collected += countSamples(latest);
+    elapsedMillis += roundMillis;
+    result = mergeProfiles([result, latest]);
+  }
+  return result;
 }
 
 export async function profile(options: TimeProfilerOptions) {
-  const stop = start(
-    options.intervalMicros || DEFAULT_INTERVAL_MICROS,
-    options.name,
-    options.sourceMapper,
-    options.lineNumbers
+  checkOptionKeys(options, TIME_PROFILER_OPTION_KEYS, 'time.profile()');
+  if (options.sampleCount !== undefined) {
+    if (options.minSamples !== undefined) {
+      throw new Error('minSamples cannot be combined with sampleCount.');
+    }
+    return profileSampleCount(options);
+  }
+  const requestedMillis = profileDurationMillis(options);
+  const durationMillis = clampToLifetime(requestedMillis, options);
+  const timeLimited = durationMillis < requestedMillis;
+  if (options.minSamples !== undefined && !(options.minSamples > 0)) {
+    throw new Error(
+      `minSamples must be a positive number, got ${options.minSamples}.`
+    );
+  }
+  if (
+    options.maxDurationMillis !== undefined &&
+    !(options.maxDurationMillis >= requestedMillis)
+  ) {
+    throw new Error(
+      `maxDurationMillis (${options.maxDurationMillis}) must be at least ` +
+        `the profile duration (${requestedMillis}).`
+    );
+  }
+  if (
+    options.skipInitialMillis !== undefined &&
+    options.skipInitialMillis >= durationMillis
+  ) {
+    throw new Error(
+      `skipInitialMillis (${options.skipInitialMillis}) must be less than ` +
+        `the profile duration (${durationMillis}).`
+    );
+  }
+  const stop = await startWithRetries(options);
+  await delay(durationMillis);
+  const result = stop();
+  if (timeLimited) {
+    // There is no time left to extend the profile to minSamples.
+    return withComment(result, timeLimitedComment(requestedMillis));
+  }
+  if (options.minSamples === undefined) {
+    return result;
+  }
+  return extendToMinSamples(result, durationMillis, options);
+}
+
+/**
+ * @return durationMillis, shortened so that the profile ends before
+ * options.maxProcessLifetimeMillis have passed since
+ * options.lifetimeStartMillis, if set, or 0 if they have already passed.
+ */
+function clampToLifetime(
+  durationMillis: Milliseconds,
+  options: TimeProfilerOptions
+): Milliseconds {
+  const lifetimeMillis = options.maxProcessLifetimeMillis;
+  if (lifetimeMillis === undefined) {
+    return durationMillis;
+  }
+  const startMillis =
+    options.lifetimeStartMillis === undefined
+      ? Date.now() - process.uptime() * 1000
+      : options.lifetimeStartMillis;
+  const remainingMillis = Math.max(
+    startMillis + lifetimeMillis - Date.now(),
+    0
+  );
+  if (durationMillis <= remainingMillis) {
+    return durationMillis;
+  }
+  console.warn(
+    `Time profile of ${durationMillis}ms shortened to ` +
+      `${Math.floor(remainingMillis)}ms by maxProcessLifetimeMillis.`
   );
-  await delay(options.durationMillis);
-  return stop();
+  return remainingMillis;
+}
+
+/**
+ * @return comments recording the markers added since the start of the
+ * profile, which is startTime or cutoffTimestamp if later.
+ */
+function markerComments(
+  profileMarkers: Marker[],
+  startTime: Microseconds,
+  cutoffTimestamp?: Microseconds
+): string[] {
+  const start =
+    cutoffTimestamp === undefined
+      ? startTime
+      : Math.max(startTime, cutoffTimestamp);
+  return profileMarkers
+    .filter(m => m.timestamp >= start)
+    .map(m =>
+      markerComment({
+        name: m.name,
+        offsetMillis: (m.timestamp - start) / 1000,
+      })
+    );
+}
+
+export interface RequireProfile {
+  /** Time profile of loading the module. */
+  profile: perftools.profiles.IProfile;
+  /** Exports of the module, unless loading it threw. */
+  // tslint:disable-next-line no-any
+  module?: any;
+  /** Error thrown while loading the module, if any. */
+  error?: Error;
 }
 
+/**
+ * Collects a time profile of loading the module at modulePath with
+ * require(), e.g. to attribute the startup cost of a heavy dependency.
+ * Relative paths and module names are resolved from the working directory.
+ * Modules already loaded are not loaded again, so their profile is empty.
+ *
+ * When loading the module throws, the profile collected until then is
+ * returned along with the error.
+ */
+export function profileRequire(
+  modulePath: string,
+  options: StartOptions = {}
+): RequireProfile {
+  const resolved = require.resolve(modulePath, { paths: [process.cwd()] });
+  const stop = start(options);
+  // tslint:disable-next-line no-any
+  let loaded: any;
+  let error: Error | undefined;
+  try {
+    loaded = require(resolved);
+  } catch (err) {
+    error = err;
+  }
+  return { profile: stop(), module: loaded, error };
+}
+
+export interface PromiseProfile<T> {
+  /** Time profile from the call of profilePromise() until promise settled. */
+  profile: perftools.profiles.IProfile;
+  /** Value with which promise resolved, unless it was rejected. */
+  result?: T;
+  /** Reason with which promise was rejected, if it was. */
+  error?: Error;
+}
+
+/**
+ * Collects a wall time profile from now until promise settles, e.g. to find
+ * where the time of a slow asynchronous operation goes. The profile covers
+ * all work done in the process meanwhile, including the callbacks of the
+ * operation, which can be attributed to it by labeling samples, e.g. with
+ * otelContext.
+ *
+ * @return the profile along with the result of promise, or the reason with
+ * which it was rejected.
+ */
+export async function profilePromise<T>(
+  promise: Promise<T>,
+  options: StartOptions = {}
+): Promise<PromiseProfile<T>> {
+  const stop = start(options);
+  let result: T | undefined;
+  let error: Error | undefined;
+  try {
+    result = await promise;
+  } catch (err) {
+    error = err;
+  }
+  return { profile: stop(), result, error };
+}
+
+/**
+ * Adds a marker named name at the current time to the time profile being
+ * collected, e.g. when a deploy or a feature flag flips. Markers are recorded
+ * as profile comments of the form "marker=<offset>ms:<name>", where offset is
+ * the time since the start of the profile; see getMarkers(). Does nothing
+ * when no time profile is being collected.
+ */
+export function addMarker(name: string) {
+  if (profiling) {
+    markers.push({ name, timestamp: nowMicros() });
+  }
+}
+
+/**
+ * Serializes raw in pprof format, with options overriding those passed to
+ * start(). raw can be serialized again until it is disposed.
+ */
+export function serialize(
+  raw: RawProfile,
+  options: RawSerializeOptions = {},
+  onSourceMapStats?: (stats: SourceMapStats) => void
+): perftools.profiles.IProfile {
+  const prof = raw.profile;
+  const merged = { ...raw.options, ...definedOptions(options) };
+  const mapper = merged.sourceMap === false ? undefined : merged.sourceMapper;
+  return serializeTimeProfile(prof, raw.intervalMicros, mapper, {
+    columnNumbers: merged.columnNumbers,
+    scriptIds: merged.scriptIds,
+    stripNodeInternals: merged.stripNodeInternals,
+    minSelfSamples: merged.minSelfSamples,
+    topStacks: merged.topStacks,
+    minCumulativePercent: merged.minCumulativePercent,
+    maxFrames: merged.maxFrames,
+    comments: [
+      ...metadataComments(merged.profileMetadata),
+      ...raw.markerComments,
+    ],
+    labelsAt: raw.labelsAt,
+    cutoffTimestamp: raw.cutoffTimestamp,
+    timeNanos: raw.timeNanos,
+    timeline: merged.timeline,
+    relativeTimestamps: merged.relativeTimestamps,
+    wasmFunctionNames: merged.wasmFunctionNames,
+    nameMapper: merged.nameMapper,
+    requireSourceMaps: merged.requireSourceMaps,
+    onSourceMapStats: mapper ? onSourceMapStats : undefined,
+  });
+}
+
+/**
+ * @return copy of options without the options which are undefined.
+ */
+function definedOptions(options: RawSerializeOptions): RawSerializeOptions {
+  const defined: RawSerializeOptions = {};
+  for (const key of Object.keys(options) as Array<keyof RawSerializeOptions>) {
+    if (options[key] !== undefined) {
+      // tslint:disable-next-line no-any
+      (defined as any)[key] = options[key];
+    }
+  }
+  return defined;
+}
+
+/**
+ * Starts a time profile.
+ * @return function which stops the profile and returns it serialized in
+ * pprof format, or as a RawProfile when called with {raw: true}.
+ */
+export function start(options?: StartOptions): StopProfiler;
+export function start(
+  intervalMicros?: Microseconds,
+  name?: string,
+  sourceMapper?: SourceMapper,
+  lineNumbers?: boolean
+): StopProfiler;
 export function start(
-  intervalMicros: Microseconds = DEFAULT_INTERVAL_MICROS,
+  intervalMicrosOrOptions: Microseconds | StartOptions = {},
   name?: string,
   sourceMapper?: SourceMapper,
   lineNumbers?: boolean
-) {
+): StopProfiler {
+  const options: StartOptions =
+    typeof intervalMicrosOrOptions === 'number'
+      ? {
+          intervalMicros: intervalMicrosOrOptions,
+          name,
+          sourceMapper,
+          lineNumbers,
+        }
+      : intervalMicrosOrOptions;
   if (profiling) {
     throw new Error('already profiling');
   }
 
+  const labelsProviders: LabelsProvider[] = [];
+  if (options.labels) {
+    labelsProviders.push(options.labels);
+  }
+  if (options.otelContext) {
+    labelsProviders.push(otelLabelsProvider(loadOtelApi()));
+  }
+  const loopLag = options.loopLag;
+  let loopLagMonitor: LoopLagMonitor | undefined;
+  if (typeof loopLag === 'function') {
+    labelsProviders.push(loopLagLabelsProvider(loopLag));
+  } else if (loopLag) {
+    const monitor = new LoopLagMonitor();
+    loopLagMonitor = monitor;
+    labelsProviders.push(loopLagLabelsProvider(() => monitor.lagMillis()));
+  }
+  const labelSetter =
+    labelsProviders.length > 0 ? new LabelSetter(labelsProviders) : undefined;
+  const skipInitial = options.skipInitialMillis !== undefined;
+  // Labels, timelines and skipping early samples all use the timestamps of
+  // samples.
+  const recordSamples = !!labelSetter || skipInitial || !!options.timeline;
+  if (recordSamples && options.lineNumbers) {
+    throw new Error(
+      'Sample labels, timeline and skipInitialMillis cannot be combined ' +
+        'with lineNumbers.'
+    );
+  }
+
   profiling = true;
-  const runName = name || `pprof-${Date.now()}-${Math.random()}`;
+  const requestedIntervalMicros =
+    options.intervalMicros || DEFAULT_INTERVAL_MICROS;
+  const adaptive = options.targetOverheadPercent !== undefined;
+  const intervalMicros =
+    adaptive && adaptiveIntervalMicros !== undefined
+      ? Math.max(adaptiveIntervalMicros, requestedIntervalMicros)
+      : requestedIntervalMicros;
+  const runName = options.name || `pprof-${Date.now()}-${Math.random()}`;
   console.log('Setting sampling interval');
   setSamplingInterval(intervalMicros);
   // Node.js contains an undocumented API for reporting idle status to V8.
@@ -82,17 +921,128 @@ export function start(
   console.log('Ensure idle time reported to V8');
   (process as any)._startProfilerIdleNotifier();
   console.log('Starting profile collection');
-  startProfiling(runName, lineNumbers);
-  return function stop() {
+  if (loopLagMonitor) {
+    loopLagMonitor.start();
+  }
+  if (labelSetter) {
+    labelSetter.start();
+  }
+  const cutoffTimestamp = skipInitial
+    ? nowMicros() + options.skipInitialMillis! * 1000
+    : undefined;
+  markers = [];
+  try {
+    startProfiling(runName, options.lineNumbers, recordSamples);
+  } catch (err) {
+    // Undo the above so that profiling can be started again.
     profiling = false;
+    if (labelSetter) {
+      labelSetter.stop();
+    }
+    if (loopLagMonitor) {
+      loopLagMonitor.stop();
+    }
+    // tslint:disable-next-line no-any
+    (process as any)._stopProfilerIdleNotifier();
+    throw err.message === TOO_MANY_PROFILERS_MESSAGE
+      ? new StartProfilingError(err.message)
+      : err;
+  }
+  function stop(): perftools.profiles.IProfile;
+  function stop(stopOptions: { raw: true }): RawProfile;
+  function stop(stopOptions?: {
+    raw?: boolean;
+  }): perftools.profiles.IProfile | RawProfile {
+    profiling = false;
+    const profileMarkers = markers;
+    markers = [];
     console.log('Stopping profile collection');
-    const result = stopProfiling(runName, lineNumbers);
+    const collectStart = process.hrtime();
+    const result = stopProfiling(runName, options.lineNumbers, recordSamples);
+    // Serialization may be deferred with {raw: true}, so record the time at
+    // which the profile was collected now.
+    const timeNanos = Date.now() * 1000 * 1000;
+    if (labelSetter) {
+      labelSetter.stop();
+    }
+    if (loopLagMonitor) {
+      loopLagMonitor.stop();
+    }
+    const collectMillis = millisSince(collectStart);
     console.log('Stop reporting idle time to V8');
     // tslint:disable-next-line no-any
     (process as any)._stopProfilerIdleNotifier();
+    if (options.onRawProfileSize) {
+      options.onRawProfileSize(rawProfileSize(result));
+    }
+    const raw = new RawProfile(
+      result,
+      intervalMicros,
+      options,
+      markerComments(profileMarkers, result.startTime, cutoffTimestamp),
+      timeNanos,
+      labelSetter ? t => labelSetter.labelsAt(t) : undefined,
+      cutoffTimestamp
+    );
+    if (stopOptions && stopOptions.raw) {
+      return raw;
+    }
     console.log('Serialize profile');
-    const profile = serializeTimeProfile(result, intervalMicros, sourceMapper);
+    const serializeStart = process.hrtime();
+    let sourceMapStats: SourceMapStats | undefined;
+    const profile = serialize(raw, {}, stats => (sourceMapStats = stats));
+    raw.dispose();
+    const serializeMillis = millisSince(serializeStart);
     console.log('Finished profile serialization');
+    if (options.onMetrics) {
+      reportMetrics(
+        options.onMetrics,
+        profile,
+        collectMillis,
+        serializeMillis,
+        sourceMapStats
+      );
+    }
+    if (adaptive) {
+      const durationMillis = (result.endTime - result.startTime) / 1000;
+      const overheadPercent =
+        ((collectMillis + serializeMillis) / durationMillis) * 100;
+      adaptiveIntervalMicros = nextAdaptiveInterval(
+        intervalMicros,
+        requestedIntervalMicros,
+        overheadPercent,
+        options.targetOverheadPercent!
+      );
+    }
     return profile;
-  };
+  }
+  return stop;
+}
+
+/**
+ * Forgets the sampling interval adjusted for targetOverheadPercent, so that
+ * the next profile with it set starts from its intervalMicros, e.g. after
+ * the workload of the process changed.
+ */
+export function resetAdaptiveInterval() {
+  adaptiveIntervalMicros = undefined;
+}
+
+/**
+ * @return sampling interval for the profile after one collected with
+ * currentMicros and the given overhead, to approach targetPercent.
+ */
+function nextAdaptiveInterval(
+  currentMicros: Microseconds,
+  minMicros: Microseconds,
+  overheadPercent: number,
+  targetPercent: number
+): Microseconds {
+  if (overheadPercent > targetPercent) {
+    return Math.min(currentMicros * 2, MAX_ADAPTIVE_INTERVAL_MICROS);
+  }
+  if (overheadPercent < targetPercent / 2) {
+    return Math.max(currentMicros / 2, minMicros);
+  }
+  return currentMicros;
 }
@@ -0,0 +1,183 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import * as heapProfiler from './heap-profiler';
+import * as timeProfiler from './time-profiler';
+
+export interface TriggeredProfilerOptions {
+  /** Returns whether a profile should be collected, e.g. on many errors. */
+  shouldStart: () => boolean;
+  /** Time in milliseconds between calls of shouldStart. */
+  pollMillis: number;
+  /** Time in milliseconds for which to collect each profile. */
+  durationMillis: number;
+  /** Called with each collected profile. */
+  onProfile: (profile: perftools.profiles.IProfile) => void;
+  /**
+   * Called when a profile cannot be collected or shouldStart throws.
+   * Defaults to console.error.
+   */
+  onError?: (err: Error) => void;
+  /** Options for the collected time profiles. */
+  timeOptions?: timeProfiler.StartOptions;
+}
+
+/**
+ * Polls options.shouldStart() and collects a time profile each time it
+ * returns true. shouldStart() is not polled while a profile is collected,
+ * and after a profile another is only collected once shouldStart() has
+ * returned false, so a condition which persists yields a single profile.
+ *
+ * @return function which stops polling. A profile being collected is still
+ * passed to onProfile.
+ */
+export function triggeredProfiler(
+  options: TriggeredProfilerOptions
+): () => void {
+  const onError = options.onError || ((err: Error) => console.error(err));
+  let armed = true;
+  let profiling = false;
+  const poll = () => {
+    if (profiling) {
+      return;
+    }
+    let shouldStart: boolean;
+    try {
+      shouldStart = options.shouldStart();
+    } catch (err) {
+      // Keep polling, as the condition may be computed on the next poll.
+      onError(err);
+      return;
+    }
+    if (!shouldStart) {
+      armed = true;
+      return;
+    }
+    if (!armed) {
+      return;
+    }
+    armed = false;
+    profiling = true;
+    timeProfiler
+      .profile({
+        ...options.timeOptions,
+        durationMillis: options.durationMillis,
+      })
+      .then(options.onProfile)
+      .catch(onError)
+      .then(() => {
+        profiling = false;
+      });
+  };
+  const timer = setInterval(poll, options.pollMillis);
+  // Polling should not keep the process alive.
+  timer.unref();
+  return () => clearInterval(timer);
+}
+
+const DEFAULT_MEMORY_POLL_MILLIS = 1000;
+const DEFAULT_MEMORY_DEBOUNCE_MILLIS = 60 * 1000;
+const DEFAULT_MEMORY_DURATION_MILLIS = 10 * 1000;
+
+export interface MemoryTriggerOptions {
+  /** Resident set size, in bytes, above which a profile is collected. */
+  rssBytes: number;
+  /**
+   * Type of profile to collect, 'heap' (the default) or 'time'. Heap
+   * profiles are only collected once the heap profiler is started with
+   * heap.start().
+   */
+  type?: 'heap' | 'time';
+  /** Called with each collected profile. */
+  onProfile: (profile: perftools.profiles.IProfile) => void;
+  /** Time in milliseconds between readings of the RSS. Defaults to 1000. */
+  pollMillis?: number;
+  /**
+   * Shortest time in milliseconds between the starts of two profiles, so
+   * that an RSS which stays above rssBytes does not yield a profile at each
+   * poll. Defaults to 60000.
+   */
+  debounceMillis?: number;
+  /**
+   * Time in milliseconds for which to collect each time profile. Defaults to
+   * 10000.
+   */
+  durationMillis?: number;
+  /** Called when a profile cannot be collected. Defaults to console.error. */
+  onError?: (err: Error) => void;
+  /** Options for the collected heap profiles. */
+  heapOptions?: heapProfiler.HeapProfileOptions;
+  /** Options for the collected time profiles. */
+  timeOptions?: timeProfiler.StartOptions;
+}
+
+/**
+ * Polls process.memoryUsage() and collects a profile when the RSS exceeds
+ * options.rssBytes, e.g. to see what allocates memory before the process
+ * runs out of it. Profiles are collected at most once per debounceMillis.
+ *
+ * @return function which stops polling. A profile being collected is still
+ * passed to onProfile.
+ */
+export function enableMemoryTrigger(
+  options: MemoryTriggerOptions
+): () => void {
+  const onError = options.onError || ((err: Error) => console.error(err));
+  const debounceMillis =
+    options.debounceMillis === undefined
+      ? DEFAULT_MEMORY_DEBOUNCE_MILLIS
+      : options.debounceMillis;
+  let lastStartMillis: number | undefined;
+  let profiling = false;
+  const collect = async () => {
+    if (options.type === 'time') {
+      return timeProfiler.profile({
+        ...options.timeOptions,
+        durationMillis:
+          options.durationMillis || DEFAULT_MEMORY_DURATION_MILLIS,
+      });
+    }
+    return heapProfiler.profile(options.heapOptions);
+  };
+  const poll = () => {
+    if (profiling || process.memoryUsage().rss <= options.rssBytes) {
+      return;
+    }
+    const now = Date.now();
+    if (
+      lastStartMillis !== undefined &&
+      now - lastStartMillis < debounceMillis
+    ) {
+      return;
+    }
+    lastStartMillis = now;
+    profiling = true;
+    collect()
+      .then(options.onProfile)
+      .catch(onError)
+      .then(() => {
+        profiling = false;
+      });
+  };
+  const timer = setInterval(
+    poll,
+    options.pollMillis || DEFAULT_MEMORY_POLL_MILLIS
+  );
+  // Polling should not keep the process alive.
+  timer.unref();
+  return () => clearInterval(timer);
+}
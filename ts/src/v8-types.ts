@@ -22,6 +22,18 @@ export interface TimeProfile {
   topDownRoot: TimeProfileNode;
   /** Time in nanoseconds at which profile was started. */
   startTime: number;
+  /** Id of the thread in which the profile was collected. */
+  threadId?: number;
+  /**
+   * Ids of the nodes of the samples, in the order in which they were taken.
+   * Only present when samples were recorded.
+   */
+  samples?: number[];
+  /**
+   * Time at which each sample was taken, in microseconds, on the clock used
+   * by process.hrtime(). Only present when samples were recorded.
+   */
+  timestamps?: number[];
 }
 
 export interface ProfileNode {
@@ -36,10 +48,17 @@ export interface ProfileNode {
 
 export interface TimeProfileNode extends ProfileNode {
   hitCount: number;
+  /** Id of the node, which identifies it in TimeProfile.samples. */
+  id?: number;
 }
 
 export interface AllocationProfileNode extends ProfileNode {
   allocations: Allocation[];
+  /**
+   * Id of the thread in which the profile was collected. Only set on the
+   * root node.
+   */
+  threadId?: number;
 }
 
 export interface Allocation {
@@ -0,0 +1,125 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Support for naming WebAssembly frames, which V8 reports as
+// wasm-function[<index>] when it does not use the module's name section.
+
+/**
+ * Returns the name of the function with the given index in the WebAssembly
+ * module with the given script name, or undefined if it is not known.
+ */
+export type WasmFunctionNames = (
+  scriptName: string,
+  functionIndex: number
+) => string | undefined;
+
+const WASM_FUNCTION_NAME = /^wasm-function\[(\d+)\]$/;
+
+const WASM_MAGIC = [0x00, 0x61, 0x73, 0x6d];
+const CUSTOM_SECTION_ID = 0;
+const FUNCTION_NAMES_SUBSECTION_ID = 1;
+
+/**
+ * @return index of the WebAssembly function with the name which V8 gives
+ * functions without a name, or undefined if name is not such a name.
+ */
+export function wasmFunctionIndex(name: string): number | undefined {
+  const match = WASM_FUNCTION_NAME.exec(name);
+  return match ? Number(match[1]) : undefined;
+}
+
+/** Reads values from a WebAssembly module in its binary format. */
+class WasmReader {
+  offset = 0;
+
+  constructor(private readonly bytes: Uint8Array) {}
+
+  get done(): boolean {
+    return this.offset >= this.bytes.length;
+  }
+
+  byte(): number {
+    if (this.done) {
+      throw new Error('Unexpected end of WebAssembly module.');
+    }
+    return this.bytes[this.offset++];
+  }
+
+  /** Reads an unsigned LEB128 integer of at most 32 bits. */
+  u32(): number {
+    let result = 0;
+    for (let shift = 0; shift < 35; shift += 7) {
+      const b = this.byte();
+      result += (b & 0x7f) * Math.pow(2, shift);
+      if ((b & 0x80) === 0) {
+        return result;
+      }
+    }
+    throw new Error('Invalid LEB128 integer in WebAssembly module.');
+  }
+
+  name(): string {
+    const length = this.u32();
+    const end = this.offset + length;
+    const name = Buffer.from(
+      this.bytes.buffer,
+      this.bytes.byteOffset + this.offset,
+      length
+    ).toString('utf8');
+    this.offset = end;
+    return name;
+  }
+}
+
+/**
+ * @return map from function index to name, read from the function names in
+ * the "name" custom section of a WebAssembly module. The map is empty if the
+ * module has no name section.
+ */
+export function parseWasmFunctionNames(
+  bytes: Uint8Array
+): Map<number, string> {
+  const names = new Map<number, string>();
+  const reader = new WasmReader(bytes);
+  for (const b of WASM_MAGIC) {
+    if (reader.byte() !== b) {
+      throw new Error('Not a WebAssembly module.');
+    }
+  }
+  reader.offset += 4; // version
+  while (!reader.done) {
+    const id = reader.byte();
+    const size = reader.u32();
+    const end = reader.offset + size;
+    if (id === CUSTOM_SECTION_ID && reader.name() === 'name') {
+      while (reader.offset < end) {
+        const subsectionId = reader.byte();
+        const subsectionSize = reader.u32();
+        const subsectionEnd = reader.offset + subsectionSize;
+        if (subsectionId === FUNCTION_NAMES_SUBSECTION_ID) {
+          const count = reader.u32();
+          for (let i = 0; i < count; i++) {
+            const index = reader.u32();
+            names.set(index, reader.name());
+          }
+        }
+        reader.offset = subsectionEnd;
+      }
+    }
+    reader.offset = end;
+  }
+  return names;
+}
@@ -20,7 +20,50 @@ import { SourceMapGenerator } from 'source-map';
 import * as tmp from 'tmp';
 
 import { perftools } from '../../proto/profile';
-import { TimeProfile } from '../src/v8-types';
+import { TimeProfile, TimeProfileNode } from '../src/v8-types';
+
+/** Location fields shared by the nodes built by timeNode(). */
+export const script1Frame = Object.freeze({
+  scriptName: 'script1',
+  scriptId: 1,
+  columnNumber: 0,
+});
+
+/**
+ * @return node of a V8 time profile in script1 at line 1, with fields
+ * overriding these defaults.
+ */
+export function timeNode(
+  name: string,
+  hitCount = 0,
+  children: TimeProfileNode[] = [],
+  fields: Partial<TimeProfileNode> = {}
+): TimeProfileNode {
+  return {
+    ...script1Frame,
+    name,
+    lineNumber: 1,
+    hitCount,
+    children,
+    ...fields,
+  };
+}
+
+/**
+ * @return V8 time profile of 1ms whose root, with id 1, has the given
+ * children, with fields overriding these defaults.
+ */
+export function v8TimeProfileOf(
+  children: TimeProfileNode[],
+  fields: Partial<TimeProfile> = {}
+): TimeProfile {
+  return {
+    startTime: 0,
+    endTime: 1000,
+    topDownRoot: timeNode('(root)', 0, children, { id: 1, lineNumber: 0 }),
+    ...fields,
+  };
+}
 
 const timeLeaf1 = {
   name: 'function1',
@@ -0,0 +1,94 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import delay from 'delay';
+
+import { perftools } from '../../proto/profile';
+import * as asyncResources from '../src/async-resources';
+import { getString, toNumber } from '../src/profile-utils';
+
+const assert = require('assert');
+
+/**
+ * @return number of resources of the given type counted in profile whose
+ * creation stack starts with the function named creator.
+ */
+function countCreatedBy(
+  profile: perftools.profiles.IProfile,
+  creator: string,
+  type: string
+): number {
+  const functionNames = new Map<number, string>();
+  for (const f of profile.function!) {
+    functionNames.set(toNumber(f.id), getString(profile, f.name));
+  }
+  const leafNames = new Map<number, string>();
+  for (const loc of profile.location!) {
+    leafNames.set(
+      toNumber(loc.id),
+      functionNames.get(toNumber(loc.line![0].functionId))!
+    );
+  }
+  let count = 0;
+  for (const s of profile.sample!) {
+    const label = s.label![0];
+    if (
+      leafNames.get(toNumber(s.locationId![0])) === creator &&
+      getString(profile, label.str) === type
+    ) {
+      count += toNumber(s.value![0]);
+    }
+  }
+  return count;
+}
+
+describe('async-resources', () => {
+  const timers: Array<ReturnType<typeof setTimeout>> = [];
+  function createTimers(n: number) {
+    for (let i = 0; i < n; i++) {
+      timers.push(setTimeout(() => undefined, 100000));
+    }
+  }
+
+  afterEach(() => {
+    timers.forEach(clearTimeout);
+    timers.length = 0;
+  });
+
+  it('should count the resources created at each site', () => {
+    const stop = asyncResources.start();
+    createTimers(50);
+    const profile = stop();
+    assert.deepStrictEqual(
+      profile.sampleType!.map(st => [
+        getString(profile, st.type),
+        getString(profile, st.unit),
+      ]),
+      [['async_resources', 'count']]
+    );
+    assert.strictEqual(countCreatedBy(profile, 'createTimers', 'Timeout'), 50);
+  });
+
+  it('should only count resources which are alive with live', async () => {
+    const stop = asyncResources.start({ live: true });
+    createTimers(50);
+    timers.slice(0, 20).forEach(clearTimeout);
+    // Destroy hooks run asynchronously.
+    await delay(20);
+    const profile = stop();
+    assert.strictEqual(countCreatedBy(profile, 'createTimers', 'Timeout'), 30);
+  });
+});
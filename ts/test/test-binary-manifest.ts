@@ -0,0 +1,120 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as fs from 'fs';
+import * as tmp from 'tmp';
+
+import {
+  availablePrebuilds,
+  currentTarget,
+  parseTarget,
+  readManifest,
+  resolveBinary,
+  verifyChecksum,
+} from '../src/binary-manifest';
+
+const assert = require('assert');
+
+const manifest = {
+  'node-v72-linux-x64-glibc': {
+    url: 'https://example.com/pprof/v2.0.0/node-v72-linux-x64-glibc.tar.gz',
+    sha256: 'aaaa',
+  },
+  'node-v72-linux-x64-musl': {
+    url: 'https://example.com/pprof/v2.0.0/node-v72-linux-x64-musl.tar.gz',
+    sha256: 'bbbb',
+  },
+};
+
+describe('binary-manifest', () => {
+  let manifestPath: string;
+  before(() => {
+    manifestPath = tmp.fileSync({ postfix: '.json' }).name;
+    fs.writeFileSync(manifestPath, JSON.stringify(manifest));
+  });
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  describe('resolveBinary', () => {
+    it('should resolve the URL pinned for the target', () => {
+      const entry = resolveBinary(
+        readManifest(manifestPath),
+        'node-v72-linux-x64-musl'
+      );
+      assert.strictEqual(
+        entry.url,
+        'https://example.com/pprof/v2.0.0/node-v72-linux-x64-musl.tar.gz'
+      );
+      assert.strictEqual(entry.sha256, 'bbbb');
+    });
+
+    it('should throw when target is not in the manifest', () => {
+      assert.throws(
+        () => resolveBinary(readManifest(manifestPath), 'node-v64-win32-x64'),
+        /Binary manifest has no entry for target node-v64-win32-x64/
+      );
+    });
+  });
+
+  describe('availablePrebuilds', () => {
+    it('should list the targets of the manifest', () => {
+      assert.deepStrictEqual(availablePrebuilds(manifestPath), [
+        { platform: 'linux', arch: 'x64', abi: 72, libc: 'glibc' },
+        { platform: 'linux', arch: 'x64', abi: 72, libc: 'musl' },
+      ]);
+    });
+
+    it('should list the target of the installed binary', () => {
+      const current = parseTarget(currentTarget());
+      assert.ok(current, `invalid target ${currentTarget()}`);
+      assert.strictEqual(current!.abi, Number(process.versions.modules));
+      assert.ok(
+        availablePrebuilds().some(
+          p => JSON.stringify(p) === JSON.stringify(current)
+        ),
+        `expected ${currentTarget()} to be installed`
+      );
+    });
+  });
+
+  describe('readManifest', () => {
+    it('should throw when manifest cannot be read', () => {
+      assert.throws(
+        () => readManifest(`${manifestPath}.missing`),
+        /Could not read binary manifest/
+      );
+    });
+  });
+
+  describe('verifyChecksum', () => {
+    // SHA-256 digest of 'pprof'.
+    const digest =
+      '137a5d59256c9738cc9c854fcce790757623d7ce2df7bbafe972d45dbd46ee80';
+
+    it('should accept matching checksum', () => {
+      verifyChecksum(Buffer.from('pprof'), digest);
+    });
+
+    it('should throw on checksum mismatch', () => {
+      assert.throws(
+        () => verifyChecksum(Buffer.from('not pprof'), digest),
+        /Checksum mismatch/
+      );
+    });
+  });
+});
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as path from 'path';
+import * as tmp from 'tmp';
+
+import { bindingLoadError } from '../src/binding';
+
+const assert = require('assert');
+
+describe('bindingLoadError', () => {
+  const running = process.versions.modules;
+  const other = String(Number(running) - 10);
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should report the ABI of a binary built for another Node.js', () => {
+    const bindingPath = tmp.fileSync({ postfix: '.node' }).name;
+    const err = new Error(
+      `The module '${bindingPath}' was compiled against a different ` +
+        `Node.js version using NODE_MODULE_VERSION ${other}. This version ` +
+        `of Node.js requires NODE_MODULE_VERSION ${running}.`
+    );
+    const message = bindingLoadError(err, bindingPath, []).message;
+    assert.strictEqual(
+      message,
+      `pprof binary ${bindingPath} was built for Node ABI ${other}, ` +
+        `running ${running} (Node.js ${process.version}); ` +
+        'run npm rebuild pprof.'
+    );
+  });
+
+  it('should report the ABI of the installed binaries when none matches', () => {
+    const buildDir = tmp.dirSync().name;
+    const bindingPath = path.join(
+      buildDir,
+      `node-v${running}-linux-x64-glibc`,
+      'pprof.node'
+    );
+    const err = new Error(`Cannot find module '${bindingPath}'`);
+    const message = bindingLoadError(err, bindingPath, [
+      `node-v${other}-linux-x64-glibc`,
+    ]).message;
+    assert.strictEqual(
+      message,
+      `pprof binary built for Node ABI ${other}, running ${running} ` +
+        `(Node.js ${process.version}); run npm rebuild pprof.`
+    );
+  });
+
+  it('should include the original error otherwise', () => {
+    const err = new Error('libstdc++.so.6: cannot open shared object file');
+    const message = bindingLoadError(err, '/no/such/pprof.node', []).message;
+    assert.ok(/run npm rebuild pprof/.test(message), message);
+    assert.ok(message.endsWith(err.message), message);
+  });
+});
@@ -0,0 +1,52 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as fs from 'fs';
+import * as tmp from 'tmp';
+
+import { profileChildProcess } from '../src/child-process';
+
+const assert = require('assert');
+
+const CHILD_SCRIPT = `
+function busyChildFunction() {
+  const end = Date.now() + 1000;
+  while (Date.now() < end) {}
+}
+busyChildFunction();
+`;
+
+describe('profileChildProcess', () => {
+  let scriptPath: string;
+  before(() => {
+    scriptPath = tmp.fileSync({ postfix: '.js' }).name;
+    fs.writeFileSync(scriptPath, CHILD_SCRIPT);
+  });
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should return the profile of the child process', async () => {
+    const profile = await profileChildProcess(process.execPath, [scriptPath], {
+      stdio: 'ignore',
+    });
+    assert.notStrictEqual(
+      profile.stringTable!.indexOf('busyChildFunction'),
+      -1
+    );
+  }).timeout(10000);
+});
@@ -0,0 +1,121 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { spawnSync } from 'child_process';
+import * as fs from 'fs';
+import * as path from 'path';
+import * as tmp from 'tmp';
+
+import { decodeSync, encodeSync } from '../src/profile-encoder';
+import {
+  serializeHeapProfile,
+  serializeTimeProfile,
+} from '../src/profile-serializer';
+import { findFunction } from '../src/profile-utils';
+import { TimeProfile } from '../src/v8-types';
+
+import { timeNode, v8TimeProfileOf } from './profiles-for-tests';
+
+const assert = require('assert');
+
+const CLI_PATH = path.join(__dirname, '../src/cli.js');
+
+function v8TimeProfile(hitCounts: { [name: string]: number }): TimeProfile {
+  return v8TimeProfileOf(
+    Object.keys(hitCounts).map((name, i) =>
+      timeNode(name, hitCounts[name], [], { lineNumber: i + 1 })
+    )
+  );
+}
+
+describe('pprof-nodejs CLI', () => {
+  let dir: string;
+  before(() => {
+    dir = tmp.dirSync().name;
+  });
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  function writeProfile(name: string, hitCounts: { [name: string]: number }) {
+    const file = path.join(dir, name);
+    const profile = serializeTimeProfile(v8TimeProfile(hitCounts), 1000);
+    fs.writeFileSync(file, encodeSync(profile));
+    return file;
+  }
+
+  describe('diff', () => {
+    it('should write the change between two profiles', () => {
+      const before = writeProfile('before.pb.gz', { same: 4, faster: 5 });
+      const after = writeProfile('after.pb.gz', { same: 4, faster: 2, new: 3 });
+      const output = path.join(dir, 'delta.pb.gz');
+      const result = spawnSync(process.execPath, [
+        CLI_PATH,
+        'diff',
+        before,
+        after,
+        '-o',
+        output,
+      ]);
+      assert.strictEqual(result.status, 0, `${result.stderr}`);
+
+      const delta = decodeSync(fs.readFileSync(output));
+      assert.deepStrictEqual(findFunction(delta, { name: 'faster' }), {
+        found: true,
+        samples: -3,
+      });
+      assert.deepStrictEqual(findFunction(delta, { name: 'new' }), {
+        found: true,
+        samples: 3,
+      });
+      assert.strictEqual(findFunction(delta, { name: 'same' }).found, false);
+    });
+
+    it('should fail when the sample types differ', () => {
+      const before = writeProfile('time.pb.gz', { fn: 1 });
+      const heap = path.join(dir, 'heap.pb.gz');
+      fs.writeFileSync(
+        heap,
+        encodeSync(
+          serializeHeapProfile(
+            {
+              name: '(root)',
+              scriptName: '(root)',
+              allocations: [],
+              children: [],
+            },
+            0,
+            512 * 1024
+          )
+        )
+      );
+      const result = spawnSync(process.execPath, [
+        CLI_PATH,
+        'diff',
+        before,
+        heap,
+        '-o',
+        path.join(dir, 'mismatch.pb.gz'),
+      ]);
+      assert.strictEqual(result.status, 1);
+      assert.ok(
+        /Cannot diff profiles with sample types/.test(`${result.stderr}`),
+        `${result.stderr}`
+      );
+    });
+  });
+});
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as net from 'net';
+import * as path from 'path';
+import * as tmp from 'tmp';
+
+import { enableControlSocket } from '../src/control-socket';
+import { decode } from '../src/profile-encoder';
+
+const assert = require('assert');
+
+/**
+ * @return everything written back by the control socket at socketPath in
+ * response to request.
+ */
+function request(socketPath: string, req: string): Promise<Buffer> {
+  return new Promise((resolve, reject) => {
+    const chunks: Buffer[] = [];
+    const socket = net.connect(socketPath, () => socket.write(req));
+    socket.on('data', chunk => chunks.push(chunk));
+    socket.on('end', () => resolve(Buffer.concat(chunks)));
+    socket.on('error', reject);
+  });
+}
+
+describe('enableControlSocket', () => {
+  let server: net.Server;
+  let socketPath: string;
+  before(async () => {
+    socketPath = path.join(tmp.dirSync().name, 'pprof.sock');
+    server = await enableControlSocket({ path: socketPath });
+  });
+
+  after(() => {
+    server.close();
+    tmp.setGracefulCleanup();
+  });
+
+  it('should write back a requested time profile', async () => {
+    const response = await request(
+      socketPath,
+      '{"type":"time","durationMillis":100}\n'
+    );
+    const profile = await decode(response);
+    const sampleTypes = profile.sampleType.map(
+      st => profile.stringTable[Number(st.type)]
+    );
+    assert.deepStrictEqual(sampleTypes, ['sample', 'wall']);
+  });
+
+  it('should write back an error for an invalid request', async () => {
+    const response = await request(socketPath, '{"type":"cpu"}\n');
+    assert.strictEqual(
+      response.toString(),
+      'Error: Unknown profile type "cpu".\n'
+    );
+  });
+});
@@ -0,0 +1,105 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { spawnSync } from 'child_process';
+import * as fs from 'fs';
+import * as path from 'path';
+import * as tmp from 'tmp';
+
+const assert = require('assert');
+
+const PACKAGE_ROOT = path.join(__dirname, '../..');
+
+// ES modules can be imported without flags in Node.js 12.17 and later.
+const [major, minor] = process.versions.node.split('.').map(Number);
+const esmSupported = major > 12 || (major === 12 && minor >= 17);
+const describeIfEsm = esmSupported ? describe : describe.skip;
+
+/**
+ * Links the package into node_modules of a new directory, so that it is
+ * loaded by name as applications do, through the exports of package.json.
+ *
+ * @return the directory.
+ */
+function linkPackage(): string {
+  const dir = tmp.dirSync().name;
+  fs.mkdirSync(path.join(dir, 'node_modules'));
+  fs.symlinkSync(
+    PACKAGE_ROOT,
+    path.join(dir, 'node_modules', 'pprof'),
+    'junction'
+  );
+  return dir;
+}
+
+describe('package exports', () => {
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should resolve deep requires through the package name', () => {
+    const dir = linkPackage();
+    for (const [request, file] of [
+      ['pprof/proto/profile', 'proto/profile.js'],
+      ['pprof/proto/profile.js', 'proto/profile.js'],
+      ['pprof/out/src/profile-encoder', 'out/src/profile-encoder.js'],
+      ['pprof/out/src/profile-encoder.js', 'out/src/profile-encoder.js'],
+      ['pprof/package.json', 'package.json'],
+    ]) {
+      const resolved = require.resolve(request, { paths: [dir] });
+      assert.strictEqual(
+        fs.realpathSync(resolved),
+        fs.realpathSync(path.join(PACKAGE_ROOT, file)),
+        request
+      );
+    }
+    const proto = require(require.resolve('pprof/proto/profile', {
+      paths: [dir],
+    }));
+    assert.strictEqual(typeof proto.perftools.profiles.Profile, 'function');
+  });
+});
+
+describeIfEsm('ES module', () => {
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should provide named exports and collect a profile', () => {
+    const dir = linkPackage();
+    const script = `
+      import * as named from 'pprof';
+      import { time } from 'pprof';
+
+      (async () => {
+        const missing = Object.keys(named.default).filter(k => !(k in named));
+        const profile = await time.profile({ durationMillis: 100 });
+        console.log(JSON.stringify({
+          missing,
+          hasSamples: profile.sample.length > 0,
+        }));
+      })();
+    `;
+    const scriptPath = path.join(dir, 'script.mjs');
+    fs.writeFileSync(scriptPath, script);
+    const result = spawnSync(process.execPath, [scriptPath]);
+    assert.strictEqual(result.status, 0, `${result.stderr}`);
+    const lines = `${result.stdout}`.trim().split('\n');
+    const output = JSON.parse(lines[lines.length - 1]);
+    assert.deepStrictEqual(output.missing, []);
+    assert.strictEqual(output.hasSamples, true);
+  }).timeout(10000);
+});
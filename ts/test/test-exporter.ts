@@ -0,0 +1,141 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { collectAndExport, profileSimilarity } from '../src/exporter';
+import { heapProfile, timeProfile } from './profiles-for-tests';
+
+const assert = require('assert');
+
+// timeProfile with one sample slightly heavier than the others.
+const similarTimeProfile: perftools.profiles.IProfile = {
+  ...timeProfile,
+  sample: timeProfile.sample!.map(
+    (sample, i) =>
+      new perftools.profiles.Sample({
+        ...sample,
+        value: sample.value!.map(v => (v as number) * 10 + (i === 3 ? 1 : 0)),
+      })
+  ),
+};
+
+/**
+ * @return profiles exported by collectAndExport() while collecting each of
+ * profiles once.
+ */
+async function exportAll(
+  profiles: perftools.profiles.IProfile[],
+  dedupeWindow?: number
+): Promise<perftools.profiles.IProfile[]> {
+  const exported: perftools.profiles.IProfile[] = [];
+  let collectedAll!: () => void;
+  const done = new Promise<void>(resolve => (collectedAll = resolve));
+  const stop = collectAndExport({
+    collect: async () => {
+      const profile = profiles.shift()!;
+      if (profiles.length === 0) {
+        collectedAll();
+      }
+      return profile;
+    },
+    exportProfile: profile => {
+      exported.push(profile);
+    },
+    dedupeWindow,
+  });
+  await done;
+  await stop();
+  return exported;
+}
+
+describe('collectAndExport', () => {
+  it('should export one of two similar profiles', async () => {
+    const exported = await exportAll(
+      [timeProfile, similarTimeProfile],
+      60 * 1000
+    );
+    assert.deepStrictEqual(exported, [timeProfile]);
+  });
+
+  it('should export profiles which are not similar', async () => {
+    const exported = await exportAll([timeProfile, heapProfile], 60 * 1000);
+    assert.deepStrictEqual(exported, [timeProfile, heapProfile]);
+  });
+
+  it('should export similar profiles without dedupeWindow', async () => {
+    const exported = await exportAll([timeProfile, similarTimeProfile]);
+    assert.deepStrictEqual(exported, [timeProfile, similarTimeProfile]);
+  });
+
+  it('should report errors and keep collecting', async () => {
+    const errors: Error[] = [];
+    let calls = 0;
+    let collectedTwice!: () => void;
+    const done = new Promise<void>(resolve => (collectedTwice = resolve));
+    const stop = collectAndExport({
+      collect: async () => {
+        if (++calls === 1) {
+          throw new Error('collection failed');
+        }
+        collectedTwice();
+        return timeProfile;
+      },
+      exportProfile: () => Promise.resolve(),
+      onError: err => errors.push(err),
+      retryDelayMillis: 1,
+    });
+    await done;
+    await stop();
+    assert.deepStrictEqual(
+      errors.map(err => err.message),
+      ['collection failed']
+    );
+  });
+
+  it('should wait before collecting again after an error', async () => {
+    const errors: Error[] = [];
+    let calls = 0;
+    const stop = collectAndExport({
+      collect: () => {
+        calls++;
+        return Promise.reject(new Error('collection failed'));
+      },
+      exportProfile: () => Promise.resolve(),
+      onError: err => errors.push(err),
+      retryDelayMillis: 60 * 1000,
+    });
+    await new Promise(resolve => setTimeout(resolve, 50));
+    await stop();
+    assert.strictEqual(calls, 1);
+    assert.strictEqual(errors.length, 1);
+  });
+});
+
+describe('profileSimilarity', () => {
+  it('should be 1 for profiles with the same stack shares', () => {
+    const similarity = profileSimilarity(timeProfile, timeProfile);
+    assert.ok(Math.abs(similarity - 1) < 1e-9, `${similarity}`);
+  });
+
+  it('should be 0 for profiles without common stacks', () => {
+    assert.strictEqual(profileSimilarity(timeProfile, heapProfile), 0);
+  });
+
+  it('should be close to 1 for near-identical profiles', () => {
+    const similarity = profileSimilarity(timeProfile, similarTimeProfile);
+    assert.ok(similarity > 0.95 && similarity < 1, `${similarity}`);
+  });
+});
@@ -0,0 +1,55 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { shouldProfile } from '../src/fleet-sampling';
+
+const assert = require('assert');
+
+describe('shouldProfile', () => {
+  it('should return the same decision for the same process', () => {
+    const decision = shouldProfile({ rate: 0.5 });
+    for (let i = 0; i < 10; i++) {
+      assert.strictEqual(shouldProfile({ rate: 0.5 }), decision);
+    }
+  });
+
+  for (const rate of [0.01, 0.1, 0.5]) {
+    it(`should select approximately ${rate} of processes`, () => {
+      // Enough seeds for the relative error of the lowest rate to be small.
+      const seeds = 50000;
+      let selected = 0;
+      for (let pid = 0; pid < seeds; pid++) {
+        if (shouldProfile({ rate, seed: `host-${pid % 100}:${pid}` })) {
+          selected++;
+        }
+      }
+      const fraction = selected / seeds;
+      assert.ok(
+        Math.abs(fraction - rate) < rate * 0.2,
+        `selected ${fraction} of processes`
+      );
+    });
+  }
+
+  it('should select all or no processes for rates 1 and 0', () => {
+    assert.strictEqual(shouldProfile({ rate: 1, seed: 'a' }), true);
+    assert.strictEqual(shouldProfile({ rate: 0, seed: 'a' }), false);
+  });
+
+  it('should throw for a rate outside [0, 1]', () => {
+    assert.throws(() => shouldProfile({ rate: 1.5 }), /rate must be between/);
+  });
+});
@@ -0,0 +1,76 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { perftools } from '../../proto/profile';
+import { toFolded } from '../src/folded';
+
+const assert = require('assert');
+
+// main calls work, which calls helper; helper is also called directly from
+// main. Location ids match function ids.
+const profile: perftools.profiles.IProfile = {
+  sampleType: [
+    { type: 1, unit: 2 },
+    { type: 3, unit: 4 },
+  ],
+  sample: [
+    { locationId: [3, 2, 1], value: [2, 2000] },
+    { locationId: [2, 1], value: [1, 1000] },
+    { locationId: [3, 1], value: [4, 4000] },
+    { locationId: [3, 2, 1], value: [3, 3000] },
+    { locationId: [1], value: [0, 0] },
+  ],
+  location: [1, 2, 3].map(id => ({ id, line: [{ functionId: id }] })),
+  function: [
+    { id: 1, name: 5 },
+    { id: 2, name: 6 },
+    { id: 3, name: 7 },
+  ],
+  stringTable: [
+    '',
+    'sample',
+    'count',
+    'wall',
+    'microseconds',
+    'main',
+    'work',
+    'helper',
+  ],
+};
+
+describe('toFolded', () => {
+  it('should render stacks root first with summed values', () => {
+    assert.strictEqual(
+      toFolded(profile),
+      'main;work;helper 5\nmain;work 1\nmain;helper 4\n'
+    );
+  });
+
+  it('should render stacks leaf first when leafFirst is true', () => {
+    assert.strictEqual(
+      toFolded(profile, { leafFirst: true, valueIndex: 1 }),
+      'helper;work;main 5000\nwork;main 1000\nhelper;main 4000\n'
+    );
+  });
+
+  it('should render large values without exponents', () => {
+    const folded = toFolded({
+      ...profile,
+      sample: [{ locationId: [2, 1], value: [1e21] }],
+    });
+    assert.strictEqual(folded, 'main;work 1000000000000000000000\n');
+  });
+});
@@ -14,10 +14,16 @@
  * limitations under the License.
  */
 
+import { spawnSync } from 'child_process';
+import * as path from 'path';
 import * as sinon from 'sinon';
+import * as v8 from 'v8';
 
 import * as heapProfiler from '../src/heap-profiler';
 import * as v8HeapProfiler from '../src/heap-profiler-bindings';
+import { decodeSync, encodeSync } from '../src/profile-encoder';
+import { getRevision, REVISION_ENV } from '../src/profile-metadata';
+import { SourceMapper } from '../src/sourcemapper/sourcemapper';
 import { AllocationProfileNode } from '../src/v8-types';
 
 import {
@@ -31,16 +37,25 @@ import {
 const copy = require('deep-copy');
 const assert = require('assert');
 
+// Memory usage reported by process.memoryUsage() while profiles are read.
+const MEMORY_USAGE = {
+  external: 0,
+  rss: 2048,
+  heapTotal: 4096,
+  heapUsed: 2048,
+};
+
 describe('HeapProfiler', () => {
   let startStub: sinon.SinonStub<[number, number], void>;
   let stopStub: sinon.SinonStub<[], void>;
-  let profileStub: sinon.SinonStub<[], AllocationProfileNode>;
+  let profileStub: sinon.SinonStub<[], AllocationProfileNode | null>;
   let dateStub: sinon.SinonStub<[], number>;
   let memoryUsageStub: sinon.SinonStub<[], NodeJS.MemoryUsage>;
   beforeEach(() => {
     startStub = sinon.stub(v8HeapProfiler, 'startSamplingHeapProfiler');
     stopStub = sinon.stub(v8HeapProfiler, 'stopSamplingHeapProfiler');
     dateStub = sinon.stub(Date, 'now').returns(0);
+    memoryUsageStub = sinon.stub(process, 'memoryUsage').returns(MEMORY_USAGE);
   });
 
   afterEach(() => {
@@ -56,12 +71,7 @@ describe('HeapProfiler', () => {
       profileStub = sinon
         .stub(v8HeapProfiler, 'getAllocationProfile')
         .returns(copy(v8HeapProfile));
-      memoryUsageStub = sinon.stub(process, 'memoryUsage').returns({
-        external: 1024,
-        rss: 2048,
-        heapTotal: 4096,
-        heapUsed: 2048,
-      });
+      memoryUsageStub.returns({ ...MEMORY_USAGE, external: 1024 });
       const intervalBytes = 1024 * 512;
       const stackDepth = 32;
       heapProfiler.start(intervalBytes, stackDepth);
@@ -73,12 +83,6 @@ describe('HeapProfiler', () => {
       profileStub = sinon
         .stub(v8HeapProfiler, 'getAllocationProfile')
         .returns(copy(v8HeapWithPathProfile));
-      memoryUsageStub = sinon.stub(process, 'memoryUsage').returns({
-        external: 0,
-        rss: 2048,
-        heapTotal: 4096,
-        heapUsed: 2048,
-      });
       const intervalBytes = 1024 * 512;
       const stackDepth = 32;
       heapProfiler.start(intervalBytes, stackDepth);
@@ -90,12 +94,6 @@ describe('HeapProfiler', () => {
       profileStub = sinon
         .stub(v8HeapProfiler, 'getAllocationProfile')
         .returns(copy(v8HeapWithPathProfile));
-      memoryUsageStub = sinon.stub(process, 'memoryUsage').returns({
-        external: 0,
-        rss: 2048,
-        heapTotal: 4096,
-        heapUsed: 2048,
-      });
       const intervalBytes = 1024 * 512;
       const stackDepth = 32;
       heapProfiler.start(intervalBytes, stackDepth);
@@ -103,6 +101,212 @@ describe('HeapProfiler', () => {
       assert.deepEqual(heapProfileExcludePath, profile);
     });
 
+    it('should record the revision from the environment in the profile', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(copy(v8HeapProfile));
+      heapProfiler.start(1024 * 512, 32);
+      process.env[REVISION_ENV] = 'abc123';
+      try {
+        const profile = heapProfiler.profile();
+        const comments = profile.comment!.map(
+          c => profile.stringTable![c as number]
+        );
+        assert.strictEqual(getRevision(comments), 'abc123');
+      } finally {
+        delete process.env[REVISION_ENV];
+      }
+    });
+
+    it('should return heap statistics when includeHeapStats is true', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(copy(v8HeapProfile));
+      memoryUsageStub.returns({ ...MEMORY_USAGE, external: 1024 });
+      heapProfiler.start(1024 * 512, 32);
+      const { profile, heapStats } = heapProfiler.profile({
+        includeHeapStats: true,
+      });
+      assert.deepEqual(profile, heapProfileWithExternal);
+      assert.ok(heapStats.usedHeapSize > 0);
+      assert.ok(heapStats.totalHeapSize >= heapStats.usedHeapSize);
+      assert.strictEqual(heapStats.externalMemory, 1024);
+      assert.strictEqual(heapStats.rss, 2048);
+    });
+
+    it('should report metrics after collection when onMetrics is specified', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(copy(v8HeapProfile));
+      const onMetrics = sinon.spy();
+      heapProfiler.start(1024 * 512, 32);
+      const profile = heapProfiler.profile({ onMetrics });
+      assert.ok(onMetrics.calledOnce, 'expected onMetrics to be called once');
+      const metrics = onMetrics.firstCall.args[0];
+      for (const field of [
+        'collectMillis',
+        'serializeMillis',
+        'encodeMillis',
+        'sampleCount',
+        'bytes',
+      ]) {
+        assert.strictEqual(typeof metrics[field], 'number', field);
+      }
+      assert.strictEqual(metrics.sampleCount, profile.sample!.length);
+      assert.ok(metrics.bytes > 0);
+    });
+
+    it('should return an empty profile when V8 returns no allocation profile', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(null);
+      heapProfiler.start(1024 * 512, 32);
+      const profile = decodeSync(encodeSync(heapProfiler.profile()));
+      const sampleTypes = profile.sampleType.map(st =>
+        [st.type, st.unit].map(i => profile.stringTable[Number(i)]).join('/')
+      );
+      assert.deepStrictEqual(sampleTypes, ['objects/count', 'space/bytes']);
+      assert.deepStrictEqual(profile.sample, []);
+    });
+
+    it('should not use the sourceMapper when sourceMap is false', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(copy(v8HeapProfile));
+      const sourceMapper = new SourceMapper();
+      const mappingInfo = sinon.spy(sourceMapper, 'mappingInfo');
+      heapProfiler.start(1024 * 512, 32);
+      heapProfiler.profile({ sourceMapper, sourceMap: false });
+      assert.ok(mappingInfo.notCalled, 'expected no source mapping');
+
+      heapProfiler.profile({ sourceMapper });
+      assert.ok(mappingInfo.called, 'expected source mapping by default');
+    });
+
+    it('should label samples with the labels for their stacks', () => {
+      profileStub = sinon
+        .stub(v8HeapProfiler, 'getAllocationProfile')
+        .returns(copy(v8HeapProfile));
+      const stacks: string[] = [];
+      heapProfiler.start(1024 * 512, 32);
+      const profile = heapProfiler.profile({
+        labels: stack => {
+          stacks.push(stack.map(f => `${f.name}@${f.file}:${f.line}`).join());
+          return stack.some(f => f.name === 'function1')
+            ? { subsystem: 'cache' }
+            : undefined;
+        },
+      });
+      const leafFirst = 'function3@script1:10,function1@script1:5,main@main:1';
+      assert.notStrictEqual(stacks.indexOf(leafFirst), -1);
+      const labeled = profile.sample!.map(s => {
+        const loc = profile.location![(s.locationId![0] as number) - 1];
+        const fn = profile.function![(loc.line![0].functionId as number) - 1];
+        const labels = s.label!.map(
+          l =>
+            `${profile.stringTable![l.key as number]}=` +
+            `${profile.stringTable![l.str as number]}`
+        );
+        return `${profile.stringTable![fn.name as number]}:${labels}`;
+      });
+      assert.deepStrictEqual(labeled.sort(), [
+        'function2:subsystem=cache',
+        'function3:subsystem=cache',
+        'function3:subsystem=cache',
+        'main:',
+        'main:',
+      ]);
+    });
+
+    describe('forceGc', () => {
+      // tslint:disable-next-line no-any
+      const globalWithGc = global as any;
+      const exposedGc = globalWithGc.gc;
+      afterEach(() => {
+        globalWithGc.gc = exposedGc;
+      });
+
+      it('should collect garbage before reading the profile', () => {
+        profileStub = sinon
+          .stub(v8HeapProfiler, 'getAllocationProfile')
+          .returns(copy(v8HeapProfile));
+        const gc = sinon.spy();
+        globalWithGc.gc = gc;
+        heapProfiler.start(1024 * 512, 32);
+        heapProfiler.profile({ forceGc: true });
+        assert.ok(gc.calledOnce, 'expected a garbage collection');
+        assert.ok(gc.calledBefore(profileStub));
+      });
+
+      it('should drop samples of garbage collected by gc()', () => {
+        const pprofPath = JSON.stringify(path.join(__dirname, '../src/index'));
+        const script = `
+          const pprof = require(${pprofPath});
+          const bytesOf = (profile, name) => {
+            const strings = profile.stringTable;
+            const fns = new Set(
+              profile.function
+                .filter(f => strings[f.name] === name)
+                .map(f => Number(f.id))
+            );
+            const locs = new Set(
+              profile.location
+                .filter(l => fns.has(Number(l.line[0].functionId)))
+                .map(l => Number(l.id))
+            );
+            return profile.sample
+              .filter(s => locs.has(Number(s.locationId[0])))
+              .reduce((sum, s) => sum + Number(s.value[1]), 0);
+          };
+          function allocateGarbage() {
+            const arrays = [];
+            for (let i = 0; i < 10000; i++) {
+              arrays.push(new Array(100).fill(i));
+            }
+            return arrays;
+          }
+          pprof.heap.start(1024, 64);
+          let garbage = allocateGarbage();
+          garbage = null;
+          const before = bytesOf(pprof.heap.profile(), 'allocateGarbage');
+          const after = bytesOf(
+            pprof.heap.profile({forceGc: true}),
+            'allocateGarbage'
+          );
+          console.log(JSON.stringify({before, after}));
+        `;
+        // Sampled allocations are only dropped once collected, so this runs
+        // in a child process in which the profiler and gc() are real.
+        const result = spawnSync(process.execPath, [
+          '--expose-gc',
+          '-e',
+          script,
+        ]);
+        assert.strictEqual(result.status, 0, `${result.stderr}`);
+        const lines = `${result.stdout}`.trim().split('\n');
+        const { before, after } = JSON.parse(lines[lines.length - 1]);
+        assert.ok(before > 0, `expected samples before gc, got ${before}`);
+        assert.ok(after < before / 2, `before: ${before}, after: ${after}`);
+      }).timeout(10000);
+
+      it('should throw when gc is not exposed', () => {
+        globalWithGc.gc = undefined;
+        heapProfiler.start(1024 * 512, 32);
+        assert.throws(
+          () => heapProfiler.profile({ forceGc: true }),
+          /forceGc requires Node.js to be run with --expose-gc/
+        );
+      });
+    });
+
+    it('should throw error for an unknown option', () => {
+      assert.throws(
+        // tslint:disable-next-line no-any
+        () => heapProfiler.profile({ ignoreSamplesPath: 'x' } as any),
+        /Unknown option "ignoreSamplesPath" for heap.profile\(\). Valid options are: .*ignoreSamplePath/
+      );
+    });
+
     it('should throw error when not started', () => {
       assert.throws(
         () => {
@@ -165,6 +369,40 @@ describe('HeapProfiler', () => {
         'expected startSamplingHeapProfiler not to be called second time'
       );
     });
+    it('should clamp an infinite intervalBytes to the maximum interval', () => {
+      profileStub = sinon.stub(v8HeapProfiler, 'getAllocationProfile').returns({
+        name: '(root)',
+        scriptName: '',
+        allocations: [],
+        children: [],
+      });
+      heapProfiler.start(Infinity, 32);
+      assert.ok(startStub.calledWith(heapProfiler.MAX_INTERVAL_BYTES, 32));
+      // The profile is still valid.
+      decodeSync(encodeSync(heapProfiler.profile()));
+    });
+
+    it('should throw error when intervalBytes is zero', () => {
+      assert.throws(
+        () => heapProfiler.start(0, 32),
+        /intervalBytes must be a positive number, got 0/
+      );
+      assert.ok(!startStub.called);
+    });
+    it('should throw error when intervalBytes is negative', () => {
+      assert.throws(
+        () => heapProfiler.start(-1024, 32),
+        /intervalBytes must be a positive number, got -1024/
+      );
+      assert.ok(!startStub.called);
+    });
+    it('should throw error when stackDepth is zero', () => {
+      assert.throws(
+        () => heapProfiler.start(1024 * 512, 0),
+        /stackDepth must be a positive number, got 0/
+      );
+      assert.ok(!startStub.called);
+    });
   });
 
   describe('stop', () => {
@@ -181,4 +419,61 @@ describe('HeapProfiler', () => {
       );
     });
   });
+
+  describe('deterministic', () => {
+    let flagsStub: sinon.SinonStub<[string], void>;
+    beforeEach(() => {
+      flagsStub = sinon.stub(v8, 'setFlagsFromString');
+    });
+    afterEach(() => {
+      flagsStub.restore();
+    });
+
+    it('should set the suppress-randomness flag while profiling', () => {
+      heapProfiler.start({
+        intervalBytes: 1024 * 512,
+        stackDepth: 32,
+        deterministic: true,
+      });
+      assert.ok(
+        startStub.calledWith(1024 * 512, 32),
+        'expected startSamplingHeapProfiler to be called'
+      );
+      assert.deepStrictEqual(flagsStub.args, [
+        ['--sampling-heap-profiler-suppress-randomness'],
+      ]);
+      heapProfiler.stop();
+      assert.deepStrictEqual(flagsStub.args[1], [
+        '--no-sampling-heap-profiler-suppress-randomness',
+      ]);
+    });
+
+    it('should clear the flag when starting the profiler fails', () => {
+      startStub.throws(new RangeError('interval out of range'));
+      assert.throws(
+        () =>
+          heapProfiler.start({
+            intervalBytes: 1024 * 512,
+            stackDepth: 32,
+            deterministic: true,
+          }),
+        /interval out of range/
+      );
+      assert.deepStrictEqual(flagsStub.args, [
+        ['--sampling-heap-profiler-suppress-randomness'],
+        ['--no-sampling-heap-profiler-suppress-randomness'],
+      ]);
+      // Profiling was not started, so it can be started again.
+      startStub.resetBehavior();
+      heapProfiler.start({ intervalBytes: 1024 * 512, stackDepth: 32 });
+      heapProfiler.stop();
+      assert.strictEqual(flagsStub.callCount, 2);
+    });
+
+    it('should not set the flag when deterministic is not set', () => {
+      heapProfiler.start({ intervalBytes: 1024 * 512, stackDepth: 32 });
+      heapProfiler.stop();
+      assert.ok(!flagsStub.called);
+    });
+  });
 });
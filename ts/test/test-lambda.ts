@@ -0,0 +1,125 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as sinon from 'sinon';
+
+import { perftools } from '../../proto/profile';
+import { lambdaProfiler } from '../src/lambda';
+import { toNumber } from '../src/profile-utils';
+import * as time from '../src/time-profiler';
+import { timeProfile } from './profiles-for-tests';
+
+const assert = require('assert');
+
+function totalWall(profile: perftools.profiles.IProfile): number {
+  return profile.sample!.reduce((sum, s) => sum + toNumber(s.value![1]), 0);
+}
+
+describe('lambdaProfiler', () => {
+  let clock: sinon.SinonFakeTimers;
+  let startStub: sinon.SinonStub;
+  beforeEach(() => {
+    clock = sinon.useFakeTimers();
+    startStub = sinon.stub(time, 'start').returns(() => timeProfile);
+  });
+
+  afterEach(() => {
+    startStub.restore();
+    clock.restore();
+  });
+
+  it('should flush a profile merged from several invocations', async () => {
+    const flushed: perftools.profiles.IProfile[] = [];
+    const profiler = lambdaProfiler({
+      flushIntervalMillis: 1000,
+      intervalMicros: 500,
+      sink: profile => {
+        flushed.push(profile);
+      },
+    });
+    const handler = profiler.wrap(async (event: number) => {
+      clock.tick(100);
+      return event * 2;
+    });
+
+    assert.strictEqual(await handler(1, {}), 2);
+    clock.tick(300);
+    assert.strictEqual(await handler(2, {}), 4);
+    assert.strictEqual(flushed.length, 0);
+    clock.tick(600);
+    assert.strictEqual(await handler(3, {}), 6);
+
+    assert.strictEqual(startStub.callCount, 3);
+    assert.deepStrictEqual(startStub.firstCall.args, [{ intervalMicros: 500 }]);
+    assert.strictEqual(flushed.length, 1);
+    assert.strictEqual(totalWall(flushed[0]), 3 * totalWall(timeProfile));
+
+    await profiler.flush();
+    assert.strictEqual(flushed.length, 1, 'expected nothing more to flush');
+  });
+
+  it('should profile invocations which throw', async () => {
+    const flushed: perftools.profiles.IProfile[] = [];
+    const profiler = lambdaProfiler({
+      flushIntervalMillis: 0,
+      sink: profile => {
+        flushed.push(profile);
+      },
+    });
+    const handler = profiler.wrap(async () => {
+      throw new Error('handler failed');
+    });
+    await assert.rejects(handler(undefined, undefined), /handler failed/);
+    assert.strictEqual(flushed.length, 1);
+  });
+
+  it('should run the handler unprofiled when profiling cannot start', async () => {
+    const errors: Error[] = [];
+    const profiler = lambdaProfiler({
+      flushIntervalMillis: 0,
+      sink: () => Promise.resolve(),
+      onError: err => errors.push(err),
+    });
+    const handler = profiler.wrap(async (event: number) => event * 2);
+    startStub.onFirstCall().throws(new Error('cannot start'));
+    assert.strictEqual(await handler(1, {}), 2);
+    assert.deepStrictEqual(
+      errors.map(err => err.message),
+      ['cannot start']
+    );
+    // The next invocation is profiled.
+    assert.strictEqual(await handler(2, {}), 4);
+    assert.strictEqual(startStub.callCount, 2);
+  });
+
+  it('should return the result of the handler when stopping fails', async () => {
+    const errors: Error[] = [];
+    const profiler = lambdaProfiler({
+      flushIntervalMillis: 0,
+      sink: () => Promise.resolve(),
+      onError: err => errors.push(err),
+    });
+    const handler = profiler.wrap(async (event: number) => event * 2);
+    startStub.returns(() => {
+      throw new Error('cannot stop');
+    });
+    assert.strictEqual(await handler(1, {}), 2);
+    assert.deepStrictEqual(
+      errors.map(err => err.message),
+      ['cannot stop']
+    );
+  });
+});
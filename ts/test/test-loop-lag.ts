@@ -0,0 +1,61 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import delay from 'delay';
+
+import {
+  lagBucket,
+  loopLagLabelsProvider,
+  LoopLagMonitor,
+} from '../src/loop-lag';
+
+const assert = require('assert');
+
+describe('loop-lag', () => {
+  describe('lagBucket', () => {
+    it('should return the lower bound of the bucket of a lag', () => {
+      const buckets = [0, 3, 10, 49.9, 75, 100, 600, 5000].map(lagBucket);
+      assert.deepStrictEqual(buckets, [0, 0, 10, 10, 50, 100, 500, 1000]);
+    });
+  });
+
+  describe('loopLagLabelsProvider', () => {
+    it('should return the bucket of the lag as loop_lag_ms', () => {
+      const provider = loopLagLabelsProvider(() => 120);
+      assert.deepStrictEqual(provider(), {
+        loop_lag_ms: { num: 100, unit: 'ms' },
+      });
+    });
+  });
+
+  describe('LoopLagMonitor', () => {
+    it('should measure the lag of a blocked event loop', async () => {
+      const monitor = new LoopLagMonitor(10);
+      monitor.start();
+      try {
+        await delay(50);
+        const end = Date.now() + 100;
+        while (Date.now() < end) {
+          // Block the event loop.
+        }
+        await delay(20);
+        assert.ok(monitor.lagMillis() >= 50, `lag: ${monitor.lagMillis()}`);
+      } finally {
+        monitor.stop();
+      }
+    });
+  });
+});
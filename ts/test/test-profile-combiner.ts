@@ -0,0 +1,166 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { gunzipSync } from 'zlib';
+
+import { perftools } from '../../proto/profile';
+import { combineProfiles, mergeProfiles } from '../src/profile-combiner';
+import { encodeSync } from '../src/profile-encoder';
+import {
+  serializeHeapProfile,
+  serializeTimeProfile,
+} from '../src/profile-serializer';
+import { getString, toNumber } from '../src/profile-utils';
+
+const assert = require('assert');
+
+const v8TimeProfile = {
+  startTime: 0,
+  endTime: 1000,
+  topDownRoot: {
+    name: '(root)',
+    scriptName: 'root',
+    scriptId: 0,
+    lineNumber: 0,
+    columnNumber: 0,
+    hitCount: 0,
+    children: [
+      {
+        name: 'timeFunction',
+        scriptName: 'script1',
+        scriptId: 1,
+        lineNumber: 3,
+        columnNumber: 1,
+        hitCount: 2,
+        children: [],
+      },
+    ],
+  },
+};
+
+const v8HeapProfile = {
+  name: '(root)',
+  scriptName: '(root)',
+  scriptId: 10000,
+  lineNumber: 0,
+  columnNumber: 5,
+  allocations: [],
+  children: [
+    {
+      name: 'heapFunction',
+      scriptName: 'script2',
+      scriptId: 2,
+      lineNumber: 7,
+      columnNumber: 1,
+      allocations: [{ count: 3, sizeBytes: 64 }],
+      children: [],
+    },
+  ],
+};
+
+/**
+ * @return values of the sample whose leaf location belongs to the function
+ * with the given name.
+ */
+function valuesForFunction(
+  profile: perftools.profiles.IProfile,
+  name: string
+): number[] {
+  const fn = profile.function!.find(f => getString(profile, f.name) === name);
+  assert.ok(fn, `function ${name} not found`);
+  const loc = profile.location!.find(
+    l => toNumber(l.line![0].functionId) === toNumber(fn!.id)
+  );
+  const sample = profile.sample!.find(
+    s => toNumber(s.locationId![0]) === toNumber(loc!.id)
+  );
+  return sample!.value!.map(toNumber);
+}
+
+describe('profile-combiner', () => {
+  describe('combineProfiles', () => {
+    it('should place time and heap samples in their own columns', () => {
+      const time = serializeTimeProfile(v8TimeProfile, 1000);
+      const heap = serializeHeapProfile(v8HeapProfile, 0, 512 * 1024);
+      const combined = combineProfiles(time, heap);
+      const decoded = perftools.profiles.Profile.decode(
+        gunzipSync(encodeSync(combined))
+      );
+
+      const sampleTypes = decoded.sampleType.map(
+        st => `${getString(decoded, st.type)}/${getString(decoded, st.unit)}`
+      );
+      assert.deepStrictEqual(sampleTypes, [
+        'sample/count',
+        'wall/microseconds',
+        'objects/count',
+        'space/bytes',
+      ]);
+      assert.deepStrictEqual(valuesForFunction(decoded, 'timeFunction'), [
+        2,
+        2000,
+        0,
+        0,
+      ]);
+      assert.deepStrictEqual(valuesForFunction(decoded, 'heapFunction'), [
+        0,
+        0,
+        3,
+        192,
+      ]);
+    });
+
+    it('should order sample types canonically regardless of argument order', () => {
+      const time = serializeTimeProfile(v8TimeProfile, 1000);
+      const heap = serializeHeapProfile(v8HeapProfile, 0, 512 * 1024);
+      const combined = combineProfiles(heap, time);
+      const sampleTypes = combined.sampleType!.map(st =>
+        getString(combined, st.type)
+      );
+      assert.deepStrictEqual(sampleTypes, [
+        'sample',
+        'wall',
+        'objects',
+        'space',
+      ]);
+    });
+  });
+
+  describe('mergeProfiles', () => {
+    it('should sum values of samples with the same stack', () => {
+      const time = serializeTimeProfile(v8TimeProfile, 1000);
+      const merged = mergeProfiles([time, time]);
+      assert.strictEqual(merged.sample!.length, time.sample!.length);
+      assert.deepStrictEqual(valuesForFunction(merged, 'timeFunction'), [
+        4,
+        4000,
+      ]);
+      assert.strictEqual(
+        toNumber(merged.durationNanos),
+        2 * toNumber(time.durationNanos)
+      );
+    });
+
+    it('should throw for profiles with different sample types', () => {
+      const time = serializeTimeProfile(v8TimeProfile, 1000);
+      const heap = serializeHeapProfile(v8HeapProfile, 0, 512 * 1024);
+      assert.throws(
+        () => mergeProfiles([time, heap]),
+        /Cannot merge profiles with sample types/
+      );
+    });
+  });
+});
@@ -18,9 +18,26 @@ import * as pify from 'pify';
 import { gunzip as gunzipPromise, gunzipSync } from 'zlib';
 
 import { perftools } from '../../proto/profile';
-import { encode, encodeSync } from '../src/profile-encoder';
+import { combineProfiles, mergeProfiles } from '../src/profile-combiner';
+import {
+  decode,
+  decodeSync,
+  encode,
+  encodeSync,
+  profileHash,
+} from '../src/profile-encoder';
+import { getSourceMapBaseUrl } from '../src/profile-metadata';
+import { serializeTimeProfile } from '../src/profile-serializer';
+import { getString, withComment } from '../src/profile-utils';
+import { SourceMapper } from '../src/sourcemapper/sourcemapper';
 
-import { decodedTimeProfile, timeProfile } from './profiles-for-tests';
+import {
+  decodedTimeProfile,
+  heapProfile,
+  mapDirPath,
+  timeProfile,
+  v8TimeGeneratedProfile,
+} from './profiles-for-tests';
 
 const assert = require('assert');
 const gunzip = pify(gunzipPromise);
@@ -42,4 +59,239 @@ describe('profile-encoded', () => {
       assert.deepEqual(decoded, decodedTimeProfile);
     });
   });
+  describe('encode with target cloud-profiler', () => {
+    function sampleTypes(profile: perftools.profiles.IProfile) {
+      return profile.sampleType!.map(
+        st => `${getString(profile, st.type)}/${getString(profile, st.unit)}`
+      );
+    }
+
+    it('should encode a time profile with the Cloud Profiler wall schema', async () => {
+      const encoded = await encode(timeProfile, { target: 'cloud-profiler' });
+      const decoded = perftools.profiles.Profile.decode(await gunzip(encoded));
+      assert.deepStrictEqual(sampleTypes(decoded), [
+        'sample/count',
+        'wall/microseconds',
+      ]);
+      assert.strictEqual(getString(decoded, decoded.periodType!.type), 'wall');
+    });
+
+    it('should encode a heap profile with the Cloud Profiler heap schema', () => {
+      const encoded = encodeSync(heapProfile, { target: 'cloud-profiler' });
+      const decoded = perftools.profiles.Profile.decode(gunzipSync(encoded));
+      assert.deepStrictEqual(sampleTypes(decoded), [
+        'objects/count',
+        'space/bytes',
+      ]);
+      assert.strictEqual(getString(decoded, decoded.periodType!.type), 'space');
+    });
+
+    it('should throw for a profile with several profile types', () => {
+      const combined = combineProfiles(timeProfile, heapProfile);
+      assert.throws(
+        () => encodeSync(combined, { target: 'cloud-profiler' }),
+        /Cloud Profiler does not accept sample types \[sample\/count, wall/
+      );
+    });
+
+    it('should throw for a label without a key', () => {
+      const profile = {
+        ...timeProfile,
+        sample: [{ locationId: [], value: [1, 1000], label: [{ str: 1 }] }],
+      };
+      assert.throws(
+        () => encodeSync(profile, { target: 'cloud-profiler' }),
+        /labels without keys/
+      );
+    });
+  });
+
+  describe('encode with algorithm br', () => {
+    it('should encode a profile which decode() reads', async () => {
+      const encoded = await encode(timeProfile, { algorithm: 'br' });
+      assert.notDeepStrictEqual(encoded.slice(0, 2), Buffer.from([0x1f, 0x8b]));
+      assert.deepEqual(await decode(encoded), decodedTimeProfile);
+    });
+
+    it('should encode a profile which decodeSync() reads', () => {
+      const encoded = encodeSync(timeProfile, { algorithm: 'br' });
+      assert.deepEqual(decodeSync(encoded), decodedTimeProfile);
+      assert.deepEqual(
+        decodeSync(encodeSync(timeProfile, { algorithm: 'gzip' })),
+        decodedTimeProfile
+      );
+    });
+  });
+
+  describe('encode with dropFrames and keepFrames', () => {
+    it('should record the regular expressions in the profile', () => {
+      const dropFrames = '^(express|koa)\\.';
+      const keepFrames = 'handler';
+      const decoded = decodeSync(
+        encodeSync(timeProfile, { dropFrames, keepFrames })
+      );
+      assert.strictEqual(getString(decoded, decoded.dropFrames), dropFrames);
+      assert.strictEqual(getString(decoded, decoded.keepFrames), keepFrames);
+      assert.strictEqual(decoded.sample.length, timeProfile.sample!.length);
+    });
+
+    it('should only set the specified field', () => {
+      const decoded = decodeSync(
+        encodeSync(timeProfile, { dropFrames: 'node_modules' })
+      );
+      assert.strictEqual(
+        getString(decoded, decoded.dropFrames),
+        'node_modules'
+      );
+      assert.strictEqual(Number(decoded.keepFrames), 0);
+    });
+  });
+
+  describe('encode with transform', () => {
+    it('should encode the transformed profile', async () => {
+      const transform = (p: perftools.profiles.IProfile) => {
+        const stringTable = [...p.stringTable!, 'scrubbed'];
+        return {
+          ...p,
+          stringTable,
+          comment: [...(p.comment || []), stringTable.length - 1],
+        };
+      };
+      const decoded = await decode(await encode(timeProfile, { transform }));
+      assert.deepStrictEqual(
+        decoded.comment.map(c => getString(decoded, c)),
+        ['scrubbed']
+      );
+      assert.strictEqual(timeProfile.comment, undefined);
+    });
+
+    it('should surface errors thrown by the transform', async () => {
+      const transform = () => {
+        throw new Error('no labels');
+      };
+      await assert.rejects(
+        encode(timeProfile, { transform }),
+        /Profile transform failed: no labels/
+      );
+      assert.throws(
+        () => encodeSync(timeProfile, { transform }),
+        /Profile transform failed: no labels/
+      );
+    });
+  });
+
+  describe('profileHash', () => {
+    it('should hash encodings of the same profile identically', async () => {
+      const hash = profileHash(timeProfile);
+      assert.ok(/^[0-9a-f]{64}$/.test(hash), hash);
+      const encodings = [
+        encodeSync(timeProfile),
+        await encode(timeProfile),
+        encodeSync(timeProfile, { algorithm: 'br' }),
+      ];
+      for (const encoded of encodings) {
+        assert.strictEqual(profileHash(decodeSync(encoded)), hash);
+      }
+      assert.notStrictEqual(profileHash(heapProfile), hash);
+    });
+  });
+
+  describe('encode with a buffer', () => {
+    it('should throw a TypeError for an encoded profile', async () => {
+      const encoded = encodeSync(timeProfile);
+      assert.throws(
+        () => encodeSync(encoded),
+        (err: Error) =>
+          err instanceof TypeError && /got a gzipped buffer/.test(err.message)
+      );
+      await assert.rejects(encode(encoded), TypeError);
+    });
+
+    it('should gzip the buffer again with reGzip', () => {
+      const encoded = encodeSync(timeProfile);
+      const reGzipped = encodeSync(encoded, { reGzip: true });
+      assert.deepStrictEqual(gunzipSync(reGzipped), encoded);
+    });
+  });
+
+  describe('encode with mainMapping', () => {
+    it('should record the main mapping', () => {
+      const mainMapping = {
+        filename: '/usr/local/bin/node',
+        buildId: 'f3a1c5d2',
+        start: 0x400000,
+        limit: 0x2a00000,
+      };
+      const decoded = decodeSync(encodeSync(timeProfile, { mainMapping }));
+      assert.strictEqual(decoded.mapping.length, 1);
+      const mapping = decoded.mapping[0];
+      assert.deepStrictEqual(
+        {
+          filename: getString(decoded, mapping.filename),
+          buildId: getString(decoded, mapping.buildId),
+          start: Number(mapping.memoryStart),
+          limit: Number(mapping.memoryLimit),
+        },
+        mainMapping
+      );
+      assert.strictEqual(Number(mapping.id), 1);
+      assert.deepStrictEqual(
+        decoded.stringTable.slice(0, timeProfile.stringTable!.length),
+        timeProfile.stringTable
+      );
+    });
+  });
+
+  describe('encode with deferSourceMap', () => {
+    it('should record the source map base URL without mapping', () => {
+      const mapBaseUrl = 'https://example.com/maps/build-1234/';
+      const decoded = decodeSync(
+        encodeSync(timeProfile, { deferSourceMap: { mapBaseUrl } })
+      );
+      const comments = decoded.comment.map(c => getString(decoded, c));
+      assert.strictEqual(getSourceMapBaseUrl(comments), mapBaseUrl);
+      // Locations are encoded as collected, for the server to map.
+      assert.deepStrictEqual(
+        decoded.stringTable.slice(0, timeProfile.stringTable!.length),
+        timeProfile.stringTable
+      );
+      assert.deepStrictEqual(decoded.function, decodedTimeProfile.function);
+      assert.deepStrictEqual(decoded.location, decodedTimeProfile.location);
+    });
+
+    describe('with a profile of generated code', () => {
+      const mapBaseUrl = 'https://example.com/maps/build-1234/';
+      let sourceMapper: SourceMapper;
+      before(async () => {
+        sourceMapper = await SourceMapper.create([mapDirPath]);
+      });
+
+      it('should throw for a profile which was source mapped', () => {
+        const mapped = serializeTimeProfile(
+          v8TimeGeneratedProfile,
+          1000,
+          sourceMapper
+        );
+        for (const profile of [
+          mapped,
+          withComment(mapped, 'revision=abc123'),
+          mergeProfiles([mapped]),
+        ]) {
+          assert.throws(
+            () => encodeSync(profile, { deferSourceMap: { mapBaseUrl } }),
+            /^Error: deferSourceMap requires a profile which is not source mapped/
+          );
+        }
+      });
+
+      it('should encode the profile when it was not source mapped', () => {
+        const generated = serializeTimeProfile(v8TimeGeneratedProfile, 1000);
+        const decoded = decodeSync(
+          encodeSync(generated, { deferSourceMap: { mapBaseUrl } })
+        );
+        const comments = decoded.comment.map(c => getString(decoded, c));
+        assert.strictEqual(getSourceMapBaseUrl(comments), mapBaseUrl);
+      });
+    });
+  });
 });
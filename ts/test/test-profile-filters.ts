@@ -0,0 +1,99 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { gunzipSync } from 'zlib';
+
+import { perftools } from '../../proto/profile';
+import { encodeSync } from '../src/profile-encoder';
+import { stripLabels } from '../src/profile-filters';
+import { getString, toNumber } from '../src/profile-utils';
+
+const assert = require('assert');
+
+// Two samples with the same stack which differ only in their labels.
+const labeledProfile: perftools.profiles.IProfile = {
+  sampleType: [{ type: 1, unit: 2 }],
+  sample: [
+    {
+      locationId: [1],
+      value: [3],
+      label: [
+        { key: 3, str: 4 },
+        { key: 5, str: 6 },
+      ],
+    },
+    {
+      locationId: [1],
+      value: [4],
+      label: [
+        { key: 3, str: 7 },
+        { key: 5, str: 6 },
+      ],
+    },
+  ],
+  location: [{ id: 1, line: [{ functionId: 1, line: 2 }] }],
+  function: [{ id: 1, name: 8, systemName: 8, filename: 9 }],
+  stringTable: [
+    '',
+    'sample',
+    'count',
+    'user',
+    'alice',
+    'region',
+    'us-east1',
+    'bob',
+    'handler',
+    'server.js',
+  ],
+  periodType: { type: 1, unit: 2 },
+  period: 1,
+};
+
+function totalValue(profile: perftools.profiles.IProfile): number {
+  return (profile.sample || []).reduce(
+    (sum, s) => sum + toNumber(s.value![0]),
+    0
+  );
+}
+
+describe('profile-filters', () => {
+  describe('stripLabels', () => {
+    it('should remove all labels and unused strings', () => {
+      const stripped = stripLabels(labeledProfile);
+      const decoded = perftools.profiles.Profile.decode(
+        gunzipSync(encodeSync(stripped))
+      );
+      assert.strictEqual(decoded.sample.length, 1);
+      assert.deepStrictEqual(decoded.sample[0].label, []);
+      assert.strictEqual(totalValue(decoded), 7);
+      for (const s of ['user', 'alice', 'bob', 'region', 'us-east1']) {
+        assert.strictEqual(decoded.stringTable.indexOf(s), -1, s);
+      }
+      assert.notStrictEqual(decoded.stringTable.indexOf('handler'), -1);
+    });
+
+    it('should keep labels in the allowlist', () => {
+      const stripped = stripLabels(labeledProfile, { keep: ['region'] });
+      assert.strictEqual(stripped.sample!.length, 1);
+      const labels = stripped.sample![0].label!.map(
+        l => `${getString(stripped, l.key)}=${getString(stripped, l.str)}`
+      );
+      assert.deepStrictEqual(labels, ['region=us-east1']);
+      assert.strictEqual(totalValue(stripped), 7);
+      assert.strictEqual(stripped.stringTable!.indexOf('alice'), -1);
+    });
+  });
+});
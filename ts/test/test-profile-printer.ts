@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as sinon from 'sinon';
+
+import { decodeSync } from '../src/profile-encoder';
+import { printProfile } from '../src/profile-printer';
+
+import { decodedTimeProfile, timeProfile } from './profiles-for-tests';
+
+const assert = require('assert');
+
+describe('printProfile', () => {
+  let writeStub: sinon.SinonStub;
+  let restored: boolean;
+  beforeEach(() => {
+    writeStub = sinon.stub(process.stdout, 'write');
+    restored = false;
+  });
+
+  afterEach(() => {
+    if (!restored) {
+      writeStub.restore();
+    }
+  });
+
+  function printed(): string {
+    // Restore before asserting so that mocha can report failures.
+    writeStub.restore();
+    restored = true;
+    assert.strictEqual(writeStub.callCount, 1);
+    return writeStub.firstCall.args[0];
+  }
+
+  it('should print a single line which decodes to the profile', () => {
+    printProfile(timeProfile);
+    const line = printed();
+    assert.ok(line.endsWith('\n'));
+    assert.strictEqual(line.indexOf('\n'), line.length - 1);
+
+    const [prefix, encoded] = line.trim().split(' ');
+    assert.strictEqual(prefix, 'PPROF_PROFILE');
+    const decoded = decodeSync(Buffer.from(encoded, 'base64'));
+    assert.deepEqual(decoded, decodedTimeProfile);
+  });
+
+  it('should start the line with the specified prefix', () => {
+    printProfile(timeProfile, { prefix: 'my-service-profile' });
+    assert.ok(printed().startsWith('my-service-profile '));
+  });
+});
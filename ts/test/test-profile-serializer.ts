@@ -13,14 +13,20 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
+import * as path from 'path';
 import * as sinon from 'sinon';
 import * as tmp from 'tmp';
 
+import { perftools } from '../../proto/profile';
+import { decodeSync, encodeSync } from '../src/profile-encoder';
 import {
+  CustomProfileNode,
+  serializeCustomProfile,
   serializeHeapProfile,
   serializeTimeProfile,
 } from '../src/profile-serializer';
 import { SourceMapper } from '../src/sourcemapper/sourcemapper';
+import { AllocationProfileNode, TimeProfileNode } from '../src/v8-types';
 
 import {
   anonymousFunctionHeapProfile,
@@ -28,6 +34,8 @@ import {
   heapProfile,
   heapSourceProfile,
   mapDirPath,
+  script1Frame,
+  timeNode,
   timeProfile,
   timeSourceProfile,
   v8AnonymousFunctionHeapProfile,
@@ -36,6 +44,7 @@ import {
   v8HeapProfile,
   v8TimeGeneratedProfile,
   v8TimeProfile,
+  v8TimeProfileOf,
 } from './profiles-for-tests';
 
 const assert = require('assert');
@@ -62,6 +71,427 @@ describe('profile-serializer', () => {
       );
       assert.deepEqual(timeProfileOut, anonymousFunctionTimeProfile);
     });
+    it('should record distinct columns for calls on the same line when columnNumbers is true', () => {
+      const v8Profile = v8TimeProfileOf(
+        [5, 20].map(columnNumber =>
+          timeNode('callee', 1, [], { lineNumber: 10, columnNumber })
+        )
+      );
+      const withColumns = serializeTimeProfile(v8Profile, 1000, undefined, {
+        columnNumbers: true,
+      });
+      const columns = withColumns
+        .location!.map(l => Number(l.line![0].column))
+        .sort((a, b) => a - b);
+      assert.deepStrictEqual(columns, [5, 20]);
+
+      const withoutColumns = serializeTimeProfile(v8Profile, 1000);
+      for (const loc of withoutColumns.location!) {
+        assert.strictEqual(loc.line![0].hasOwnProperty('column'), false);
+      }
+    });
+    it('should prune leaf frames with fewer than minSelfSamples samples', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('main', 0, [
+          timeNode('hot', 10, [], { lineNumber: 5 }),
+          timeNode('tiny', 1, [], { lineNumber: 9 }),
+        ]),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        minSelfSamples: 2,
+      });
+      const leafNames = profile.sample!.map(s => {
+        const loc = profile.location![(s.locationId![0] as number) - 1];
+        const fn = profile.function![(loc.line![0].functionId as number) - 1];
+        return `${profile.stringTable![fn.name as number]}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(leafNames.sort(), ['hot:10', 'main:1']);
+      assert.strictEqual(profile.stringTable!.indexOf('tiny'), -1);
+    });
+    it('should remove Node.js internal frames when stripNodeInternals is true', () => {
+      const node = (
+        name: string,
+        scriptName: string,
+        hitCount: number,
+        children: TimeProfileNode[] = []
+      ) => timeNode(name, hitCount, children, { scriptName });
+      const v8Profile = v8TimeProfileOf([
+        node('main', '/app/main.js', 1, [
+          node('readFileSync', 'node:fs', 3, [
+            node('getOptions', 'internal/fs/utils.js', 2),
+          ]),
+          node('inspect', 'node:util', 0, [
+            node('formatter', '/app/format.js', 4),
+          ]),
+        ]),
+        node('processTicksAndRejections', 'node:internal/process', 1, [
+          node('callback', '/app/main.js', 5),
+        ]),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        stripNodeInternals: true,
+      });
+      const stacks = profile.sample!.map(s => {
+        const names = s.locationId!.map(id => {
+          const loc = profile.location![(id as number) - 1];
+          const fn = profile.function![(loc.line![0].functionId as number) - 1];
+          return profile.stringTable![fn.name as number];
+        });
+        return `${names.reverse().join(';')}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(stacks.sort(), [
+        'callback:5',
+        'main:6',
+        'main;formatter:4',
+        'processTicksAndRejections:1',
+      ]);
+    });
+
+    it('should keep only the topStacks hottest stacks', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('a', 10),
+        timeNode('b', 7),
+        timeNode('c', 2),
+        timeNode('d', 1),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        topStacks: 2,
+      });
+      const leafNames = profile.sample!.map(s => {
+        const loc = profile.location![(s.locationId![0] as number) - 1];
+        const fn = profile.function![(loc.line![0].functionId as number) - 1];
+        return `${profile.stringTable![fn.name as number]}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(leafNames.sort(), ['(other):3', 'a:10', 'b:7']);
+      const total = profile.sample!.reduce(
+        (sum, s) => sum + (s.value![1] as number),
+        0
+      );
+      assert.strictEqual(total, 20 * 1000);
+    });
+
+    it('should keep only stacks with at least minCumulativePercent of samples', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('a', 60),
+        timeNode('b', 25),
+        timeNode('c', 10),
+        timeNode('d', 5),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        minCumulativePercent: 10,
+      });
+      const leafNames = profile.sample!.map(s => {
+        const loc = profile.location![(s.locationId![0] as number) - 1];
+        const fn = profile.function![(loc.line![0].functionId as number) - 1];
+        return `${profile.stringTable![fn.name as number]}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(leafNames.sort(), [
+        '(other):5',
+        'a:60',
+        'b:25',
+        'c:10',
+      ]);
+      assert.throws(
+        () =>
+          serializeTimeProfile(v8Profile, 1000, undefined, {
+            minCumulativePercent: 120,
+          }),
+        /minCumulativePercent must be between 0 and 100, got 120/
+      );
+    });
+
+    it('should attribute stacks dropped by topStacks and minCumulativePercent to one (other) frame', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('a', 60),
+        timeNode('b', 25),
+        timeNode('c', 10),
+        timeNode('d', 5),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        minCumulativePercent: 10,
+        topStacks: 2,
+      });
+      const names = profile.function!.map(
+        f => profile.stringTable![f.name as number]
+      );
+      assert.deepStrictEqual(names.sort(), ['(other)', 'a', 'b']);
+      assert.strictEqual(profile.location!.length, 3);
+      const other = profile.sample!.find(s => s.value![0] === 15);
+      assert.ok(other, 'expected one (other) sample with c and d');
+    });
+
+    it('should truncate stacks to maxFrames frames', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('main', 2, [
+          timeNode('a', 0, [timeNode('parse', 0, [timeNode('hot', 3)])]),
+          timeNode('b', 0, [timeNode('parse', 0, [timeNode('hot', 1)])]),
+          timeNode('c', 5),
+        ]),
+      ]);
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        maxFrames: 2,
+      });
+      const stacks = profile.sample!.map(s => {
+        const names = s.locationId!.map(id => {
+          const loc = profile.location![(id as number) - 1];
+          const fn = profile.function![(loc.line![0].functionId as number) - 1];
+          return profile.stringTable![fn.name as number];
+        });
+        return `${names.reverse().join(';')}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(stacks.sort(), [
+        '(truncated);parse;hot:4',
+        'main:2',
+        'main;c:5',
+      ]);
+      assert.throws(
+        () =>
+          serializeTimeProfile(v8Profile, 1000, undefined, { maxFrames: 0 }),
+        /maxFrames must be a positive integer, got 0/
+      );
+    });
+
+    it('should exclude samples taken before cutoffTimestamp', () => {
+      const v8Profile = v8TimeProfileOf(
+        [
+          timeNode('steady', 2, [], { id: 2 }),
+          timeNode('startup', 1, [], { id: 3, lineNumber: 2 }),
+        ],
+        { endTime: 100, samples: [2, 3, 2], timestamps: [5, 8, 25] }
+      );
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        cutoffTimestamp: 10,
+      });
+      const leafNames = profile.sample!.map(s => {
+        const loc = profile.location![(s.locationId![0] as number) - 1];
+        const fn = profile.function![(loc.line![0].functionId as number) - 1];
+        return `${profile.stringTable![fn.name as number]}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(leafNames, ['steady:1']);
+      assert.strictEqual(profile.durationNanos, 90 * 1000);
+    });
+    it('should split samples of a node by the labels at their timestamps', () => {
+      const v8Profile = v8TimeProfileOf(
+        [timeNode('handler', 3, [], { id: 2 })],
+        { samples: [2, 2, 2], timestamps: [10, 20, 30] }
+      );
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        labelsAt: t => (t < 15 ? undefined : { span_id: t < 25 ? 'a' : 'b' }),
+      });
+      const samples = profile.sample!.map(s => {
+        const labels = s.label!.map(
+          l =>
+            `${profile.stringTable![l.key as number]}=` +
+            `${profile.stringTable![l.str as number]}`
+        );
+        return `${labels.join(',')}:${s.value![0]}`;
+      });
+      assert.deepStrictEqual(samples.sort(), [
+        ':1',
+        'span_id=a:1',
+        'span_id=b:1',
+      ]);
+    });
+
+    it('should record script ids when scriptIds is true', () => {
+      const v8Profile = v8TimeProfileOf(
+        [1, 2].map(scriptId =>
+          timeNode('handler', 1, [], { scriptName: 'index.js', scriptId })
+        )
+      );
+      const functionsOf = (profile: perftools.profiles.IProfile) =>
+        profile.function!.map(f =>
+          [f.systemName, f.filename]
+            .map(i => profile.stringTable![i as number])
+            .join(' in ')
+        );
+      assert.deepStrictEqual(
+        functionsOf(serializeTimeProfile(v8Profile, 1000)),
+        ['handler in index.js', 'handler in index.js']
+      );
+      const absolute = path.resolve('index.js');
+      assert.deepStrictEqual(
+        functionsOf(
+          serializeTimeProfile(v8Profile, 1000, undefined, { scriptIds: true })
+        ).sort(),
+        [
+          `handler [script 1] in ${absolute}`,
+          `handler [script 2] in ${absolute}`,
+        ]
+      );
+    });
+
+    it('should rename functions with nameMapper', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('__awaiter', 1, [
+          timeNode('handler', 2, [], { lineNumber: 2 }),
+        ]),
+      ]);
+      const nameMapper = sinon.spy((name: string) =>
+        name === '__awaiter' ? 'async-helper' : name
+      );
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        nameMapper,
+      });
+      const names = profile.function!.map(
+        f => profile.stringTable![f.name as number]
+      );
+      assert.deepStrictEqual(names.sort(), ['async-helper', 'handler']);
+      assert.ok(nameMapper.calledWith('__awaiter', 'script1'));
+    });
+
+    it('should sanitize control characters and unpaired surrogates in names', () => {
+      const v8Profile = v8TimeProfileOf([
+        timeNode('bad\u0000name\n\ud800\ud83d\ude00', 1),
+      ]);
+      const profile = decodeSync(
+        encodeSync(serializeTimeProfile(v8Profile, 1000))
+      );
+      const names = profile.function.map(
+        f => profile.stringTable[Number(f.name)]
+      );
+      assert.deepStrictEqual(names, ['bad\\x00name\\x0a\ufffd\ud83d\ude00']);
+      for (const str of profile.stringTable) {
+        assert.strictEqual(Buffer.from(str, 'utf8').toString('utf8'), str);
+      }
+    });
+
+    it('should intern multibyte names once and decode them identically', () => {
+      const scriptName = '/srv/アプリ/服务.js';
+      const v8Profile = v8TimeProfileOf(
+        ['処理', '처리'].map((name, i) =>
+          timeNode(name, 1, [], { scriptName, lineNumber: i + 1 })
+        )
+      );
+      const profile = decodeSync(
+        encodeSync(serializeTimeProfile(v8Profile, 1000))
+      );
+      assert.strictEqual(
+        profile.stringTable.filter(str => str === scriptName).length,
+        1
+      );
+      const functions = profile.function.map(f => [
+        profile.stringTable[Number(f.name)],
+        profile.stringTable[Number(f.filename)],
+      ]);
+      assert.deepStrictEqual(functions, [
+        ['処理', scriptName],
+        ['처리', scriptName],
+      ]);
+    });
+
+    it('should serialize trees with cycles and children which are not nodes', () => {
+      const a = timeNode('a', 1);
+      const b = timeNode('b', 2, [a], { lineNumber: 2 });
+      // tslint:disable-next-line no-any
+      a.children.push(b, null as any);
+      const v8Profile = v8TimeProfileOf([a]);
+      const profile = serializeTimeProfile(v8Profile, 1000);
+      const stacks = profile.sample!.map(s =>
+        s.locationId!.map(id => {
+          const loc = profile.location!.find(l => l.id === id)!;
+          const fn = profile.function!.find(
+            f => f.id === loc.line![0].functionId
+          )!;
+          return profile.stringTable![Number(fn.name)];
+        })
+      );
+      assert.deepStrictEqual(stacks.sort(), [['a'], ['b', 'a']]);
+      // The tree from V8 is left as it was.
+      assert.strictEqual(a.children[0], b);
+    });
+
+    describe('timeline', () => {
+      const v8Profile = v8TimeProfileOf(
+        [
+          timeNode('a', 2, [], { id: 2 }),
+          timeNode('b', 1, [], { id: 3, lineNumber: 2 }),
+        ],
+        {
+          startTime: 1000,
+          endTime: 1100,
+          samples: [2, 3, 2],
+          timestamps: [1005, 1010, 1030],
+        }
+      );
+
+      function timelineOf(profile: perftools.profiles.IProfile) {
+        const timeline = profile.sample!.map(s => {
+          assert.strictEqual(s.value![0], 1);
+          const [label] = s.label!;
+          assert.strictEqual(
+            profile.stringTable![label.key as number],
+            'timestamp_ns'
+          );
+          assert.strictEqual(
+            profile.stringTable![label.numUnit as number],
+            'nanoseconds'
+          );
+          const loc = profile.location![(s.locationId![0] as number) - 1];
+          const fn = profile.function![(loc.line![0].functionId as number) - 1];
+          return {
+            name: profile.stringTable![fn.name as number],
+            timestamp: label.num as number,
+          };
+        });
+        return timeline.sort((x, y) => x.timestamp - y.timestamp);
+      }
+
+      it('should record when each sample was taken', () => {
+        // The profile ends when it is serialized, at 1s after the epoch.
+        const dateStub = sinon.stub(Date, 'now').returns(1000);
+        let profile: perftools.profiles.IProfile;
+        try {
+          profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+            timeline: true,
+          });
+        } finally {
+          dateStub.restore();
+        }
+        assert.deepStrictEqual(timelineOf(profile), [
+          { name: 'a', timestamp: 1e9 - 95000 },
+          { name: 'b', timestamp: 1e9 - 90000 },
+          { name: 'a', timestamp: 1e9 - 70000 },
+        ]);
+      });
+
+      it('should record timestamps relative to the profile start', () => {
+        const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+          timeline: true,
+          relativeTimestamps: true,
+        });
+        assert.deepStrictEqual(timelineOf(profile), [
+          { name: 'a', timestamp: 5000 },
+          { name: 'b', timestamp: 10000 },
+          { name: 'a', timestamp: 30000 },
+        ]);
+      });
+    });
+
+    it('should write numeric labels with their units', () => {
+      const v8Profile = v8TimeProfileOf(
+        [timeNode('handler', 2, [], { id: 2 })],
+        { samples: [2, 2], timestamps: [10, 20] }
+      );
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, {
+        labelsAt: () => ({
+          route: '/upload',
+          request_bytes: { num: 512, unit: 'bytes' },
+        }),
+      });
+      const decoded = decodeSync(encodeSync(profile));
+      assert.strictEqual(decoded.sample.length, 1);
+      const labels = decoded.sample[0].label.map(l => ({
+        key: decoded.stringTable[Number(l.key)],
+        str: decoded.stringTable[Number(l.str)],
+        num: Number(l.num),
+        numUnit: decoded.stringTable[Number(l.numUnit)],
+      }));
+      assert.deepStrictEqual(labels, [
+        { key: 'route', str: '/upload', num: 0, numUnit: '' },
+        { key: 'request_bytes', str: '', num: 512, numUnit: 'bytes' },
+      ]);
+    });
   });
 
   describe('serializeHeapProfile', () => {
@@ -69,6 +499,47 @@ describe('profile-serializer', () => {
       const heapProfileOut = serializeHeapProfile(v8HeapProfile, 0, 512 * 1024);
       assert.deepEqual(heapProfileOut, heapProfile);
     });
+    it('should remove zero-value samples and what only they reference', () => {
+      const frame = { scriptId: 1, lineNumber: 1, columnNumber: 0 };
+      const v8Profile: AllocationProfileNode = {
+        ...frame,
+        name: '(root)',
+        scriptName: '',
+        allocations: [],
+        children: [
+          {
+            ...frame,
+            name: 'main',
+            scriptName: 'main.js',
+            allocations: [{ count: 1, sizeBytes: 16 }],
+            children: [
+              {
+                ...frame,
+                scriptId: 2,
+                name: 'unused',
+                scriptName: 'unused.js',
+                allocations: [{ count: 0, sizeBytes: 8 }],
+                children: [],
+              },
+            ],
+          },
+        ],
+      };
+      const profile = serializeHeapProfile(v8Profile, 0, 512 * 1024);
+      assert.strictEqual(profile.sample!.length, 1);
+      assert.deepStrictEqual(profile.location!.map(l => l.id), [1]);
+      assert.deepStrictEqual(
+        profile.function!.map(f => profile.stringTable![f.name as number]),
+        ['main']
+      );
+      assert.strictEqual(profile.stringTable!.indexOf('unused'), -1);
+      assert.strictEqual(profile.stringTable!.indexOf('unused.js'), -1);
+      const decoded = decodeSync(encodeSync(profile));
+      const sampleTypes = decoded.sampleType.map(st =>
+        [st.type, st.unit].map(i => decoded.stringTable[Number(i)]).join('/')
+      );
+      assert.deepStrictEqual(sampleTypes, ['objects/count', 'space/bytes']);
+    });
     it('should produce expected profile when there is anyonmous function', () => {
       const heapProfileOut = serializeHeapProfile(
         v8AnonymousFunctionHeapProfile,
@@ -79,6 +550,78 @@ describe('profile-serializer', () => {
     });
   });
 
+  describe('serializeCustomProfile', () => {
+    const sampleTypes = [
+      { type: 'requests', unit: 'count' },
+      { type: 'cpu', unit: 'nanoseconds' },
+      { type: 'bytes_read', unit: 'bytes' },
+    ];
+    const customRoot = (values: number[]): CustomProfileNode => ({
+      ...script1Frame,
+      name: '(root)',
+      lineNumber: 0,
+      values: [0, 0, 0],
+      children: [
+        {
+          ...script1Frame,
+          name: 'handler',
+          lineNumber: 1,
+          values: [0, 0, 0],
+          children: [
+            {
+              ...script1Frame,
+              name: 'read',
+              lineNumber: 2,
+              values,
+              labels: { route: '/users' },
+              children: [],
+            },
+          ],
+        },
+      ],
+    });
+
+    it('should serialize a profile with three sample types', () => {
+      const serialized = serializeCustomProfile(
+        customRoot([3, 2000, 512]),
+        sampleTypes
+      );
+      const profile = decodeSync(encodeSync(serialized));
+      const strings = profile.stringTable;
+      assert.deepStrictEqual(
+        profile.sampleType.map(st => ({
+          type: strings[Number(st.type)],
+          unit: strings[Number(st.unit)],
+        })),
+        sampleTypes
+      );
+      assert.strictEqual(profile.sample.length, 1);
+      const sample = profile.sample[0];
+      assert.deepStrictEqual(sample.value.map(Number), [3, 2000, 512]);
+      assert.deepStrictEqual(
+        sample.locationId.map(id => {
+          const loc = profile.location.find(l => Number(l.id) === Number(id))!;
+          const fn = profile.function.find(
+            f => Number(f.id) === Number(loc.line[0].functionId)
+          )!;
+          return strings[Number(fn.name)];
+        }),
+        ['read', 'handler']
+      );
+      assert.deepStrictEqual(
+        sample.label.map(l => [strings[Number(l.key)], strings[Number(l.str)]]),
+        [['route', '/users']]
+      );
+    });
+
+    it('should throw when a node has the wrong number of values', () => {
+      assert.throws(
+        () => serializeCustomProfile(customRoot([3, 2000]), sampleTypes),
+        /Node read has 2 values, but the profile has 3 sample types/
+      );
+    });
+  });
+
   describe('source map specified', () => {
     let sourceMapper: SourceMapper;
     before(async () => {
@@ -108,6 +651,84 @@ describe('profile-serializer', () => {
         );
         assert.deepEqual(timeProfileOut, timeSourceProfile);
       });
+
+      it('should produce expected profile when collected in the same thread', () => {
+        const timeProfileOut = serializeTimeProfile(
+          { ...v8TimeGeneratedProfile, threadId: sourceMapper.threadId },
+          1000,
+          sourceMapper
+        );
+        assert.deepEqual(timeProfileOut, timeSourceProfile);
+      });
+
+      it('should serialize with requireSourceMaps when leaves are mapped', () => {
+        const timeProfileOut = serializeTimeProfile(
+          v8TimeGeneratedProfile,
+          1000,
+          sourceMapper,
+          { requireSourceMaps: true }
+        );
+        assert.deepEqual(timeProfileOut, timeSourceProfile);
+      });
+
+      it('should report the number of frames which were source mapped', () => {
+        // bar.js has no source map.
+        const onSourceMapStats = sinon.spy();
+        serializeTimeProfile(v8TimeGeneratedProfile, 1000, sourceMapper, {
+          onSourceMapStats,
+        });
+        assert.ok(onSourceMapStats.calledOnce);
+        assert.deepStrictEqual(onSourceMapStats.firstCall.args[0], {
+          mappedFrames: 3,
+          unmappedFrames: 1,
+        });
+      });
+
+      it('should throw with requireSourceMaps when a leaf is not mapped', () => {
+        const barFile = path.join(mapDirPath, 'bar.js');
+        const barLeaf = {
+          name: 'barLeaf',
+          scriptName: barFile,
+          scriptId: 2,
+          lineNumber: 12,
+          columnNumber: 2,
+          hitCount: 3,
+          children: [],
+        };
+        const root = v8TimeGeneratedProfile.topDownRoot;
+        const profile = {
+          ...v8TimeGeneratedProfile,
+          topDownRoot: {
+            ...root,
+            children: [...root.children, barLeaf],
+          },
+        };
+        assert.throws(
+          () =>
+            serializeTimeProfile(profile, 1000, sourceMapper, {
+              requireSourceMaps: true,
+            }),
+          (err: Error) =>
+            /Source maps are required, but samples in 1 file\(s\) could not be mapped/.test(
+              err.message
+            ) && err.message.indexOf(barFile) !== -1
+        );
+        // Without requireSourceMaps, the frame keeps its generated location.
+        serializeTimeProfile(profile, 1000, sourceMapper);
+      });
+
+      it('should throw when profile was collected in a different thread', () => {
+        const otherThreadId = sourceMapper.threadId + 1;
+        assert.throws(
+          () =>
+            serializeTimeProfile(
+              { ...v8TimeGeneratedProfile, threadId: otherThreadId },
+              1000,
+              sourceMapper
+            ),
+          /Profile collected in thread \d+ cannot be serialized with a SourceMapper created in thread/
+        );
+      });
     });
 
     after(() => {
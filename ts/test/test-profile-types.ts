@@ -0,0 +1,27 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { supportedProfileTypes } from '../src/profile-types';
+
+const assert = require('assert');
+
+describe('supportedProfileTypes', () => {
+  it('should include time and heap profiles', () => {
+    const types = supportedProfileTypes();
+    assert.notStrictEqual(types.indexOf('time'), -1);
+    assert.notStrictEqual(types.indexOf('heap'), -1);
+  });
+});
@@ -0,0 +1,141 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { serializeTimeProfile } from '../src/profile-serializer';
+import {
+  copyStringTable,
+  findFunction,
+  formatNumber,
+  top,
+} from '../src/profile-utils';
+import * as time from '../src/time-profiler';
+import { TimeProfileNode } from '../src/v8-types';
+
+const assert = require('assert');
+
+function busyFindFunctionTest() {
+  const end = Date.now() + 300;
+  while (Date.now() < end) {
+    // Busy wait, so that this function is sampled.
+  }
+}
+
+describe('findFunction', () => {
+  it('should find a busy function in a collected profile', () => {
+    const stop = time.start({ intervalMicros: 1000 });
+    busyFindFunctionTest();
+    const profile = stop();
+
+    const busy = findFunction(profile, {
+      name: 'busyFindFunctionTest',
+      file: 'test-profile-utils.js',
+    });
+    assert.strictEqual(busy.found, true);
+    assert.ok(busy.samples > 0, `expected samples, got ${busy.samples}`);
+
+    assert.deepStrictEqual(
+      findFunction(profile, {
+        name: 'busyFindFunctionTest',
+        file: 'other-file.js',
+      }),
+      { found: false, samples: 0 }
+    );
+    assert.deepStrictEqual(findFunction(profile, { name: 'noSuchFunction' }), {
+      found: false,
+      samples: 0,
+    });
+  });
+});
+
+describe('top', () => {
+  const node = (
+    name: string,
+    hitCount: number,
+    children: TimeProfileNode[] = []
+  ): TimeProfileNode => ({
+    name,
+    scriptName: 'app.js',
+    scriptId: 1,
+    lineNumber: 1,
+    columnNumber: 0,
+    hitCount,
+    children,
+  });
+  const profile = serializeTimeProfile(
+    {
+      startTime: 0,
+      endTime: 1000,
+      topDownRoot: node('(root)', 0, [
+        node('main', 1, [node('a', 5), node('b', 2, [node('c', 3)])]),
+      ]),
+    },
+    1000
+  );
+
+  it('should rank functions by self value', () => {
+    assert.deepStrictEqual(top(profile, { n: 3 }), [
+      { function: 'a', file: 'app.js', self: 5, cumulative: 5 },
+      { function: 'c', file: 'app.js', self: 3, cumulative: 3 },
+      { function: 'b', file: 'app.js', self: 2, cumulative: 5 },
+    ]);
+  });
+
+  it('should rank functions by cumulative value', () => {
+    assert.deepStrictEqual(
+      top(profile, { by: 'cumulative', valueIndex: 1 }).map(
+        f => `${f.function}:${f.cumulative}`
+      ),
+      ['main:11000', 'a:5000', 'b:5000', 'c:3000']
+    );
+  });
+
+  it('should break ties by name independently of the locale', () => {
+    const tied = serializeTimeProfile(
+      {
+        startTime: 0,
+        endTime: 1000,
+        topDownRoot: node('(root)', 0, [
+          node('b', 1),
+          node('B', 1),
+          node('a', 1),
+        ]),
+      },
+      1000
+    );
+    // Upper case letters come before lower case ones in UTF-16.
+    assert.deepStrictEqual(top(tied).map(f => f.function), ['B', 'a', 'b']);
+  });
+});
+
+describe('formatNumber', () => {
+  it('should not use exponents', () => {
+    assert.strictEqual(formatNumber(1e21), '1000000000000000000000');
+    assert.strictEqual(formatNumber(-2.5e21), '-2500000000000000000000');
+    assert.strictEqual(formatNumber(1.25e-7), '0.000000125');
+    assert.strictEqual(formatNumber(1234.5), '1234.5');
+  });
+});
+
+describe('copyStringTable', () => {
+  it('should add missing strings to a copy of the string table', () => {
+    const profile = { stringTable: ['', 'main'] };
+    const { stringTable, addString } = copyStringTable(profile);
+    assert.strictEqual(addString('main'), 1);
+    assert.strictEqual(addString('comment'), 2);
+    assert.deepStrictEqual(stringTable, ['', 'main', 'comment']);
+    assert.deepStrictEqual(profile.stringTable, ['', 'main']);
+  });
+});
@@ -0,0 +1,206 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { spawnSync } from 'child_process';
+import delay from 'delay';
+import * as fs from 'fs';
+import * as path from 'path';
+import * as tmp from 'tmp';
+
+import { decodeSync } from '../src/profile-encoder';
+import { getString, toNumber } from '../src/profile-utils';
+import {
+  appendProfile,
+  ExitProfileType,
+  exitProfileName,
+  profileToFile,
+  writeProfile,
+} from '../src/profile-writer';
+
+import { timeProfile } from './profiles-for-tests';
+
+const assert = require('assert');
+
+const PPROF_PATH = path.join(__dirname, '../src/index');
+
+/**
+ * Runs a script which calls time.profileOnExit() and then exits.
+ * @return pid of the process which ran the script.
+ */
+function runExitingScript(dir: string, type: ExitProfileType): number {
+  const script = `
+    const pprof = require(${JSON.stringify(PPROF_PATH)});
+    pprof.time.profileOnExit(${JSON.stringify({ dir, type })});
+    const end = Date.now() + 200;
+    const arrays = [];
+    while (Date.now() < end) {
+      arrays.push(new Array(100));
+    }
+    process.exit(0);
+  `;
+  const result = spawnSync(process.execPath, ['-e', script]);
+  assert.strictEqual(result.status, 0, `${result.stderr}`);
+  return result.pid;
+}
+
+describe('profileOnExit', () => {
+  let dir: string;
+  beforeEach(() => {
+    dir = tmp.dirSync().name;
+  });
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should write a time profile when the process exits', () => {
+    const pid = runExitingScript(dir, 'time');
+    const file = path.join(dir, exitProfileName('time', pid));
+    const profile = decodeSync(fs.readFileSync(file));
+    assert.notStrictEqual(profile.stringTable.indexOf('wall'), -1);
+  }).timeout(10000);
+
+  it('should write a heap profile when the process exits', () => {
+    const pid = runExitingScript(dir, 'heap');
+    const file = path.join(dir, exitProfileName('heap', pid));
+    const profile = decodeSync(fs.readFileSync(file));
+    assert.notStrictEqual(profile.stringTable.indexOf('space'), -1);
+  }).timeout(10000);
+});
+
+describe('profileToFile', () => {
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  function busyLoop(durationMillis: number) {
+    const end = Date.now() + durationMillis;
+    let x = 0;
+    while (Date.now() < end) {
+      x = Math.sqrt(x + 1);
+    }
+    return x;
+  }
+
+  it('should write intermediate and final profiles', async () => {
+    const file = path.join(tmp.dirSync().name, 'wall.pb.gz');
+    const stop = profileToFile({ path: file, flushIntervalMillis: 100 });
+    for (let i = 0; i < 3; i++) {
+      busyLoop(50);
+      await delay(100);
+    }
+    const intermediate = decodeSync(fs.readFileSync(file));
+    assert.ok(intermediate.sample.length > 0);
+
+    busyLoop(50);
+    const final = stop();
+    const decoded = decodeSync(fs.readFileSync(file));
+    assert.deepStrictEqual(
+      decoded.sampleType.map(st => getString(decoded, st.type)),
+      ['sample', 'wall']
+    );
+    assert.notStrictEqual(decoded.stringTable.indexOf('busyLoop'), -1);
+    assert.ok(
+      toNumber(decoded.durationNanos) > toNumber(intermediate.durationNanos)
+    );
+    assert.strictEqual(decoded.sample.length, final.sample!.length);
+  }).timeout(10000);
+
+  it('should report errors writing the profile and keep profiling', async () => {
+    const dir = path.join(tmp.dirSync().name, 'missing');
+    const file = path.join(dir, 'wall.pb.gz');
+    const errors: Error[] = [];
+    const stop = profileToFile({
+      path: file,
+      flushIntervalMillis: 100,
+      onError: err => errors.push(err),
+    });
+    await delay(150);
+    assert.ok(errors.length > 0, 'expected the write to fail');
+    fs.mkdirSync(dir);
+    busyLoop(50);
+    await delay(150);
+    assert.ok(decodeSync(fs.readFileSync(file)).sample.length > 0);
+    stop();
+  }).timeout(10000);
+});
+
+describe('appendProfile', () => {
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should accumulate sample values across appends', () => {
+    const file = path.join(tmp.dirSync().name, 'wall.pb.gz');
+    appendProfile(file, timeProfile);
+    const written = appendProfile(file, timeProfile);
+    const decoded = decodeSync(fs.readFileSync(file));
+    assert.strictEqual(decoded.sample.length, timeProfile.sample!.length);
+    const total = (values: Array<Array<number | Long>>) =>
+      values.reduce((sum, v) => sum + toNumber(v[1]), 0);
+    assert.strictEqual(
+      total(decoded.sample.map(s => s.value)),
+      2 * total(timeProfile.sample!.map(s => s.value!))
+    );
+    assert.strictEqual(
+      toNumber(decoded.durationNanos),
+      2 * toNumber(timeProfile.durationNanos!)
+    );
+    assert.strictEqual(written.sample!.length, decoded.sample.length);
+  });
+});
+
+describe('writeProfile', () => {
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  it('should keep only the maxFiles most recent profiles', () => {
+    const dir = tmp.dirSync().name;
+    fs.writeFileSync(path.join(dir, 'other.txt'), '');
+    const written: string[] = [];
+    for (let i = 0; i < 5; i++) {
+      written.push(writeProfile(dir, timeProfile, { maxFiles: 3 }));
+    }
+    assert.deepStrictEqual(
+      fs.readdirSync(dir).sort(),
+      [...written.slice(2).map(f => path.basename(f)), 'other.txt'].sort()
+    );
+    const decoded = decodeSync(fs.readFileSync(written[4]));
+    assert.strictEqual(decoded.sample.length, timeProfile.sample!.length);
+  });
+
+  it('should write a sidecar describing the profile', () => {
+    const dir = tmp.dirSync().name;
+    const file = writeProfile(dir, timeProfile, {
+      sidecar: true,
+      service: 'checkout',
+      version: '1.2.3',
+      labels: { zone: 'us-east1-b' },
+    });
+    const sidecar = JSON.parse(fs.readFileSync(`${file}.json`, 'utf8'));
+    assert.deepStrictEqual(sidecar, {
+      file: path.basename(file),
+      service: 'checkout',
+      version: '1.2.3',
+      type: 'time',
+      durationMillis: toNumber(timeProfile.durationNanos!) / 1e6,
+      sampleCount: timeProfile.sample!.length,
+      labels: { zone: 'us-east1-b' },
+    });
+    assert.ok(fs.existsSync(file));
+  });
+});
@@ -0,0 +1,136 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as sinon from 'sinon';
+
+import { perftools } from '../../proto/profile';
+import { serializeTimeProfile } from '../src/profile-serializer';
+import {
+  dumpRingBuffer,
+  startRingBuffer,
+  stopRingBuffer,
+} from '../src/ring-buffer';
+import * as time from '../src/time-profiler';
+
+import { timeNode, v8TimeProfileOf } from './profiles-for-tests';
+
+const assert = require('assert');
+
+/**
+ * @return time profile with one sample in a function with the given name.
+ */
+function profileIn(name: string): perftools.profiles.IProfile {
+  return serializeTimeProfile(v8TimeProfileOf([timeNode(name, 1)]), 1000);
+}
+
+function functionNames(profile: perftools.profiles.IProfile): string[] {
+  return profile.function!.map(f => profile.stringTable![f.name as number]);
+}
+
+describe('ring buffer', () => {
+  let clock: sinon.SinonFakeTimers;
+  let startStub: sinon.SinonStub;
+  beforeEach(() => {
+    clock = sinon.useFakeTimers();
+    // Each sub-profile has a sample in a function named after when it
+    // started.
+    startStub = sinon.stub(time, 'start').callsFake(() => {
+      const name = `started${clock.now}`;
+      return () => profileIn(name);
+    });
+  });
+
+  afterEach(() => {
+    stopRingBuffer();
+    startStub.restore();
+    clock.restore();
+  });
+
+  it('should only keep the samples of the window', () => {
+    startRingBuffer({ windowSeconds: 4 });
+    clock.tick(10000);
+    const profile = dumpRingBuffer();
+    assert.deepStrictEqual(functionNames(profile).sort(), [
+      'started10000',
+      'started7000',
+      'started8000',
+      'started9000',
+    ]);
+  });
+
+  it('should keep profiling after a dump', () => {
+    startRingBuffer({ windowSeconds: 4 });
+    clock.tick(1500);
+    assert.deepStrictEqual(functionNames(dumpRingBuffer()).sort(), [
+      'started0',
+      'started1000',
+    ]);
+    clock.tick(500);
+    assert.deepStrictEqual(functionNames(dumpRingBuffer()).sort(), [
+      'started0',
+      'started1000',
+      'started1500',
+      'started2000',
+    ]);
+  });
+
+  it('should keep the samples of the window however often it is dumped', () => {
+    startRingBuffer({ windowSeconds: 4 });
+    clock.tick(3000);
+    dumpRingBuffer();
+    dumpRingBuffer();
+    assert.deepStrictEqual(functionNames(dumpRingBuffer()).sort(), [
+      'started0',
+      'started1000',
+      'started2000',
+      'started3000',
+    ]);
+  });
+
+  it('should report errors of sub-profiles and keep profiling', () => {
+    const onError = sinon.spy();
+    startStub.onSecondCall().returns(() => {
+      throw new Error('cannot stop');
+    });
+    startRingBuffer({ windowSeconds: 4, onError });
+    clock.tick(2000);
+    assert.strictEqual(onError.callCount, 1);
+    assert.strictEqual(onError.firstCall.args[0].message, 'cannot stop');
+    assert.deepStrictEqual(functionNames(dumpRingBuffer()).sort(), [
+      'started0',
+      'started2000',
+    ]);
+  });
+
+  it('should pass options other than windowSeconds to each sub-profile', () => {
+    startRingBuffer({ windowSeconds: 4, intervalMicros: 500 });
+    assert.deepStrictEqual(startStub.firstCall.args, [{ intervalMicros: 500 }]);
+  });
+
+  it('should throw when windowSeconds is not positive', () => {
+    assert.throws(
+      () => startRingBuffer({ windowSeconds: 0 }),
+      /^Error: windowSeconds must be a positive number, got 0\.$/
+    );
+  });
+
+  it('should throw when dumped before it is started', () => {
+    assert.throws(
+      () => dumpRingBuffer(),
+      /^Error: Ring buffer profiling is not started\.$/
+    );
+  });
+});
@@ -0,0 +1,191 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as fs from 'fs';
+import * as path from 'path';
+import { SourceMapGenerator } from 'source-map';
+import * as tmp from 'tmp';
+
+import { SourceMapper } from '../src/sourcemapper/sourcemapper';
+
+const assert = require('assert');
+
+const GENERATED_FILES = ['a.js', 'b.js', 'c.js'];
+
+describe('SourceMapper', () => {
+  let mapDirPath: string;
+  before(() => {
+    mapDirPath = tmp.dirSync().name;
+    GENERATED_FILES.forEach((file, i) => {
+      const map = new SourceMapGenerator({ file });
+      map.addMapping({
+        source: path.join(mapDirPath, file.replace('.js', '.ts')),
+        name: `fn${i}`,
+        generated: { line: 2, column: 4 },
+        original: { line: 10 + i, column: 2 },
+      });
+      fs.writeFileSync(path.join(mapDirPath, `${file}.map`), map.toString());
+    });
+  });
+
+  after(() => {
+    tmp.setGracefulCleanup();
+  });
+
+  describe('maxCachedMaps', () => {
+    it('should only parse maps for files which are looked up', async () => {
+      const mapper = await SourceMapper.create([mapDirPath], {
+        maxCachedMaps: 2,
+      });
+      assert.strictEqual(mapper.lazyMap.size, 3);
+      assert.ok(mapper.hasMappingInfo(path.join(mapDirPath, 'c.js')));
+      assert.strictEqual(mapper.parsedMaps.size, 0);
+
+      const loc = mapper.mappingInfo({
+        file: path.join(mapDirPath, 'b.js'),
+        line: 2,
+        column: 4,
+      });
+      assert.deepStrictEqual(loc, {
+        file: path.join(mapDirPath, 'b.ts'),
+        line: 11,
+        name: 'fn1',
+        column: 2,
+      });
+      assert.deepStrictEqual(Array.from(mapper.parsedMaps.keys()), [
+        path.join(mapDirPath, 'b.js'),
+      ]);
+    });
+
+    it('should evict the least recently used map', async () => {
+      const mapper = await SourceMapper.create([mapDirPath], {
+        maxCachedMaps: 2,
+      });
+      for (const file of ['a.js', 'b.js', 'a.js', 'c.js']) {
+        mapper.mappingInfo({
+          file: path.join(mapDirPath, file),
+          line: 2,
+          column: 4,
+        });
+      }
+      assert.deepStrictEqual(Array.from(mapper.parsedMaps.keys()), [
+        path.join(mapDirPath, 'a.js'),
+        path.join(mapDirPath, 'c.js'),
+      ]);
+    });
+
+    it('should return the location when it has no mapping', async () => {
+      const mapper = await SourceMapper.create([mapDirPath], {
+        maxCachedMaps: 2,
+      });
+      const location = {
+        file: path.join(mapDirPath, 'a.js'),
+        line: 1,
+        column: 0,
+      };
+      assert.strictEqual(mapper.mappingInfo(location), location);
+    });
+  });
+
+  describe('fromEntries', () => {
+    it('should map locations with source maps which are in memory', async () => {
+      const generatedFile = path.resolve('/bundle/out/app.js');
+      const map = new SourceMapGenerator({ file: 'app.js' });
+      map.addMapping({
+        source: '../src/app.ts',
+        name: 'handler',
+        generated: { line: 3, column: 6 },
+        original: { line: 42, column: 2 },
+      });
+      const mapper = await SourceMapper.fromEntries([
+        { generatedFile, map: map.toString() },
+      ]);
+      assert.ok(mapper.hasMappingInfo(generatedFile));
+      assert.deepStrictEqual(
+        mapper.mappingInfo({ file: generatedFile, line: 3, column: 6 }),
+        {
+          file: path.resolve('/bundle/src/app.ts'),
+          line: 42,
+          name: 'handler',
+          column: 2,
+        }
+      );
+    });
+  });
+
+  describe('dispose', () => {
+    it('should release all source maps', async () => {
+      const mapper = await SourceMapper.create([mapDirPath]);
+      assert.strictEqual(mapper.infoMap.size, 3);
+      mapper.dispose();
+      assert.strictEqual(mapper.infoMap.size, 0);
+      const location = {
+        file: path.join(mapDirPath, 'a.js'),
+        line: 2,
+        column: 4,
+      };
+      assert.strictEqual(mapper.mappingInfo(location), location);
+    });
+
+    it('should release lazily parsed source maps', async () => {
+      const mapper = await SourceMapper.create([mapDirPath], {
+        maxCachedMaps: 2,
+      });
+      mapper.mappingInfo({
+        file: path.join(mapDirPath, 'a.js'),
+        line: 2,
+        column: 4,
+      });
+      assert.strictEqual(mapper.parsedMaps.size, 1);
+      mapper.dispose();
+      assert.strictEqual(mapper.lazyMap.size, 0);
+      assert.strictEqual(mapper.parsedMaps.size, 0);
+      assert.ok(!mapper.hasMappingInfo(path.join(mapDirPath, 'a.js')));
+    });
+  });
+
+  describe('roots', () => {
+    it('should resolve sources against each root in order', async () => {
+      const outDir = tmp.dirSync().name;
+      const roots = [tmp.dirSync().name, tmp.dirSync().name];
+      const sources = [path.join('src', 'a.ts'), path.join('lib', 'b.ts')];
+      sources.forEach((source, i) => {
+        fs.mkdirSync(path.join(roots[i], path.dirname(source)));
+        fs.writeFileSync(path.join(roots[i], source), '');
+        const map = new SourceMapGenerator({ file: `out${i}.js` });
+        map.addMapping({
+          source,
+          generated: { line: 1, column: 0 },
+          original: { line: 7, column: 0 },
+        });
+        fs.writeFileSync(path.join(outDir, `out${i}.js.map`), map.toString());
+      });
+      const mapper = await SourceMapper.create([outDir], { roots });
+      const files = [0, 1].map(
+        i =>
+          mapper.mappingInfo({
+            file: path.join(outDir, `out${i}.js`),
+            line: 1,
+            column: 0,
+          }).file
+      );
+      assert.deepStrictEqual(files, [
+        path.join(roots[0], sources[0]),
+        path.join(roots[1], sources[1]),
+      ]);
+    });
+  });
+});
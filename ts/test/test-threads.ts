@@ -0,0 +1,104 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as path from 'path';
+
+import { getString, toNumber } from '../src/profile-utils';
+import { addProfiledThread, collectAllThreads } from '../src/threads';
+
+const assert = require('assert');
+
+// worker_threads is not available in all supported versions of Node.js.
+// tslint:disable-next-line no-any
+let workerThreads: any;
+try {
+  workerThreads = require('worker_threads');
+} catch (e) {
+  // Tests below are skipped.
+}
+
+// Serves profiles while running a busy callback, and signals when ready.
+const WORKER_SCRIPT = `
+const { parentPort, workerData } = require('worker_threads');
+const pprof = require(workerData.pprofPath);
+
+pprof.serveThreadProfiles(workerData.port);
+setInterval(function busyWorker() {
+  const end = Date.now() + 5;
+  while (Date.now() < end) {}
+}, 10);
+parentPort.postMessage('ready');
+`;
+
+const describeIfWorkers = workerThreads ? describe : describe.skip;
+
+describeIfWorkers('collectAllThreads', () => {
+  // tslint:disable-next-line no-any
+  const workers: any[] = [];
+
+  before(async () => {
+    for (let i = 0; i < 2; i++) {
+      const { port1, port2 } = new workerThreads.MessageChannel();
+      const worker = new workerThreads.Worker(WORKER_SCRIPT, {
+        eval: true,
+        workerData: {
+          pprofPath: path.join(__dirname, '../src/index'),
+          port: port2,
+        },
+        transferList: [port2],
+      });
+      workers.push(worker);
+      await new Promise((resolve, reject) => {
+        worker.once('message', resolve);
+        worker.once('error', reject);
+      });
+      addProfiledThread(port1);
+    }
+  });
+
+  after(async () => {
+    await Promise.all(workers.map(w => w.terminate()));
+  });
+
+  it('should merge the profiles of all threads, labeled by thread', async () => {
+    const timer = setInterval(() => {
+      const end = Date.now() + 5;
+      while (Date.now() < end) {
+        // Busy wait, so that the main thread has samples too.
+      }
+    }, 10);
+    const profile = await collectAllThreads({
+      type: 'time',
+      durationMillis: 500,
+    });
+    clearInterval(timer);
+    const threadIds = new Set<number>();
+    for (const sample of profile.sample!) {
+      const labels = (sample.label || []).filter(
+        l => getString(profile, l.key) === 'thread_id'
+      );
+      assert.strictEqual(labels.length, 1);
+      threadIds.add(toNumber(labels[0].num));
+    }
+    const byId = (a: number, b: number) => a - b;
+    const expected = [0, ...workers.map(w => w.threadId)];
+    assert.deepStrictEqual(
+      Array.from(threadIds).sort(byId),
+      expected.sort(byId)
+    );
+    assert.notStrictEqual(profile.stringTable!.indexOf('busyWorker'), -1);
+  }).timeout(10000);
+});
@@ -15,13 +15,48 @@
  */
 
 import delay from 'delay';
+import * as fs from 'fs';
+import * as path from 'path';
 import * as sinon from 'sinon';
+import * as tmp from 'tmp';
+import * as vm from 'vm';
+
+import { perftools } from '../../proto/profile';
+import * as metrics from '../src/metrics';
+import * as otel from '../src/otel';
+import { decodeSync, encodeSync } from '../src/profile-encoder';
+import {
+  getMarkers,
+  getRevision,
+  isTimeLimited,
+} from '../src/profile-metadata';
+import { findFunction } from '../src/profile-utils';
+import { SourceMapper } from '../src/sourcemapper/sourcemapper';
 import * as time from '../src/time-profiler';
 import * as v8TimeProfiler from '../src/time-profiler-bindings';
-import { timeProfile, v8TimeProfile } from './profiles-for-tests';
+import {
+  timeNode,
+  timeProfile,
+  v8TimeProfile,
+  v8TimeProfileOf,
+} from './profiles-for-tests';
 
 const assert = require('assert');
 
+// Busy functions in a script run in a new context, one of them passed to
+// eval() so that its script has no name.
+const VM_SCRIPT = `
+function busyInContext() {
+  const end = Date.now() + 200;
+  while (Date.now() < end) {}
+}
+busyInContext();
+eval(
+  'function busyInEval() { const end = Date.now() + 200; ' +
+  'while (Date.now() < end) {} } busyInEval();'
+);
+`;
+
 const PROFILE_OPTIONS = {
   durationMillis: 500,
   intervalMicros: 1000,
@@ -34,6 +69,289 @@ describe('Time Profiler', () => {
       assert.ok(profile.stringTable);
       assert.notStrictEqual(profile.stringTable!.indexOf('(idle)'), -1);
     });
+
+    it('should attribute samples of scripts run with the vm module', () => {
+      const stop = time.start({ intervalMicros: 1000 });
+      vm.runInNewContext(VM_SCRIPT);
+      const profile = stop();
+      const fileOf = (name: string) => {
+        const index = profile.stringTable!.indexOf(name);
+        const fn = profile.function!.find(f => f.name === index);
+        assert.ok(fn, `expected a function named ${name}`);
+        return profile.stringTable![fn!.filename as number];
+      };
+      assert.strictEqual(fileOf('busyInContext'), 'evalmachine.<anonymous>');
+      assert.ok(/^\(script \d+\)$/.test(fileOf('busyInEval')));
+    });
+
+    describe('with otelContext', () => {
+      const span = {
+        spanContext: () => ({ traceId: 'trace-1', spanId: 'span-1' }),
+      };
+      let loadStub: sinon.SinonStub;
+      before(() => {
+        loadStub = sinon.stub(otel, 'loadOtelApi').returns({
+          context: { active: () => ({}) },
+          trace: { getSpan: () => span },
+        });
+      });
+
+      after(() => {
+        loadStub.restore();
+      });
+
+      it('should label samples with the ids of the active span', async () => {
+        const busy = () => {
+          const end = Date.now() + 5;
+          while (Date.now() < end) {
+            // Busy wait, so that samples are taken in this callback.
+          }
+        };
+        const timer = setInterval(busy, 10);
+        const profile = await time.profile({
+          ...PROFILE_OPTIONS,
+          otelContext: true,
+        });
+        clearInterval(timer);
+        const strings = profile.stringTable!;
+        const labeled = profile.sample!.filter(s =>
+          (s.label || []).some(
+            l =>
+              strings[l.key as number] === 'trace_id' &&
+              strings[l.str as number] === 'trace-1'
+          )
+        );
+        assert.ok(labeled.length > 0, 'expected samples with trace_id');
+        for (const s of labeled) {
+          const keys = s.label!.map(l => strings[l.key as number]).sort();
+          assert.deepStrictEqual(keys, ['span_id', 'trace_id']);
+        }
+      });
+    });
+  });
+
+  describe('profile with sampleCount', () => {
+    it('should collect about sampleCount samples of a busy loop', async () => {
+      const busy = () => {
+        const end = Date.now() + 20;
+        while (Date.now() < end) {
+          // Busy wait, so that samples are taken in this callback.
+        }
+      };
+      const timer = setInterval(busy, 25);
+      const profile = await time.profile({
+        intervalMicros: 1000,
+        sampleCount: 300,
+      });
+      clearInterval(timer);
+      const count = profile.sample!.reduce(
+        (n, s) => n + Number(s.value![0]),
+        0
+      );
+      assert.ok(count >= 300 && count < 450, `collected ${count} samples`);
+    }).timeout(10000);
+
+    it('should reject sampleCount with durationMillis', async () => {
+      await assert.rejects(
+        time.profile({ durationMillis: 100, sampleCount: 10 }),
+        /Only one of durationMillis, deadline and sampleCount may be set/
+      );
+    });
+  });
+
+  describe('profile with onRawProfileSize', () => {
+    it('should report the size of the V8 profile of a busy run', async () => {
+      const onRawProfileSize = sinon.spy();
+      const timer = setInterval(() => {
+        const end = Date.now() + 20;
+        while (Date.now() < end) {
+          // Busy wait, so that samples are taken in this callback.
+        }
+      }, 25);
+      await time.profile({
+        durationMillis: 200,
+        intervalMicros: 1000,
+        onRawProfileSize,
+      });
+      clearInterval(timer);
+      assert.ok(onRawProfileSize.calledOnce);
+      const {
+        rawNodeCount,
+        rawSampleCount,
+      } = onRawProfileSize.firstCall.args[0];
+      assert.ok(rawNodeCount > 0, `rawNodeCount is ${rawNodeCount}`);
+      assert.ok(rawSampleCount > 0, `rawSampleCount is ${rawSampleCount}`);
+    });
+  });
+
+  describe('profile with minSamples', () => {
+    const countSamples = (profile: perftools.profiles.IProfile) =>
+      profile.sample!.reduce((n, s) => n + Number(s.value![0]), 0);
+
+    it('should extend the profile until minSamples are collected', async () => {
+      const busy = () => {
+        const end = Date.now() + 2;
+        while (Date.now() < end) {
+          // Busy wait briefly, so that the process is lightly loaded.
+        }
+      };
+      const timer = setInterval(busy, 50);
+      const profile = await time.profile({
+        durationMillis: 20,
+        intervalMicros: 10000,
+        minSamples: 30,
+        maxDurationMillis: 5000,
+      });
+      clearInterval(timer);
+      const count = countSamples(profile);
+      assert.ok(count >= 30, `collected ${count} samples`);
+    }).timeout(10000);
+
+    it('should stop extending the profile after maxDurationMillis', async () => {
+      const start = Date.now();
+      await time.profile({
+        durationMillis: 20,
+        intervalMicros: 10000,
+        minSamples: 1e6,
+        maxDurationMillis: 200,
+      });
+      const elapsed = Date.now() - start;
+      assert.ok(elapsed < 2000, `profiled for ${elapsed}ms`);
+    });
+
+    it('should reject maxDurationMillis shorter than durationMillis', async () => {
+      await assert.rejects(
+        time.profile({
+          durationMillis: 100,
+          minSamples: 10,
+          maxDurationMillis: 50,
+        }),
+        /maxDurationMillis \(50\) must be at least the profile duration \(100\)/
+      );
+    });
+  });
+
+  describe('profileRequire', () => {
+    const BUSY_MODULE = `
+function busyModuleTopLevel() {
+  const end = Date.now() + 200;
+  while (Date.now() < end) {}
+}
+busyModuleTopLevel();
+module.exports = { loaded: true };
+`;
+    let dir: string;
+    before(() => {
+      dir = tmp.dirSync().name;
+      fs.writeFileSync(path.join(dir, 'busy.js'), BUSY_MODULE);
+      fs.writeFileSync(
+        path.join(dir, 'throws.js'),
+        `${BUSY_MODULE}\nthrow new Error('failed to load');\n`
+      );
+    });
+
+    after(() => {
+      tmp.setGracefulCleanup();
+    });
+
+    it('should profile loading the module and return its exports', () => {
+      const { profile, module, error } = time.profileRequire(
+        path.join(dir, 'busy.js'),
+        { intervalMicros: 1000 }
+      );
+      assert.deepStrictEqual(module, { loaded: true });
+      assert.strictEqual(error, undefined);
+      assert.ok(findFunction(profile, { name: 'busyModuleTopLevel' }).found);
+    });
+
+    it('should return the profile when loading the module throws', () => {
+      const { profile, module, error } = time.profileRequire(
+        path.join(dir, 'throws.js'),
+        { intervalMicros: 1000 }
+      );
+      assert.strictEqual(module, undefined);
+      assert.strictEqual(error!.message, 'failed to load');
+      assert.ok(findFunction(profile, { name: 'busyModuleTopLevel' }).found);
+    });
+  });
+
+  describe('profilePromise', () => {
+    function busyWhilePending() {
+      const end = Date.now() + 300;
+      while (Date.now() < end) {
+        // Busy wait, so that this function is sampled.
+      }
+    }
+
+    it('should profile until the promise resolves', async () => {
+      const promise = delay(100).then(() => {
+        busyWhilePending();
+        return 42;
+      });
+      const { profile, result, error } = await time.profilePromise(promise, {
+        intervalMicros: 1000,
+      });
+      assert.strictEqual(result, 42);
+      assert.strictEqual(error, undefined);
+      assert.ok(findFunction(profile, { name: 'busyWhilePending' }).found);
+    });
+
+    it('should return the profile when the promise is rejected', async () => {
+      const promise = delay(100).then(() => {
+        busyWhilePending();
+        throw new Error('operation failed');
+      });
+      const { profile, result, error } = await time.profilePromise(promise, {
+        intervalMicros: 1000,
+      });
+      assert.strictEqual(result, undefined);
+      assert.strictEqual(error!.message, 'operation failed');
+      assert.ok(findFunction(profile, { name: 'busyWhilePending' }).found);
+    });
+  });
+
+  describe('addMarker', () => {
+    it('should record markers with their time since the profile start', async () => {
+      time.addMarker('before profiling');
+      const stop = time.start({ intervalMicros: 1000 });
+      time.addMarker('start');
+      await delay(200);
+      time.addMarker('flag flipped');
+      await delay(50);
+      const profile = stop();
+      time.addMarker('after profiling');
+
+      const decoded = decodeSync(encodeSync(profile));
+      const comments = decoded.comment.map(c => decoded.stringTable[Number(c)]);
+      const markers = getMarkers(comments);
+      assert.deepStrictEqual(
+        markers.map(m => m.name),
+        ['start', 'flag flipped']
+      );
+      assert.ok(markers[0].offsetMillis < 100, `${markers[0].offsetMillis}`);
+      assert.ok(
+        markers[1].offsetMillis >= 150 && markers[1].offsetMillis < 1000,
+        `${markers[1].offsetMillis}`
+      );
+    });
+  });
+
+  describe('profile with loopLag', () => {
+    it('should label samples with the bucket of the loop lag', async () => {
+      const profile = await time.profile({
+        ...PROFILE_OPTIONS,
+        loopLag: () => 250,
+      });
+      const strings = profile.stringTable!;
+      const lags = profile.sample!.map(s => {
+        const label = (s.label || []).find(
+          l => strings[l.key as number] === 'loop_lag_ms'
+        );
+        return label ? Number(label.num) : undefined;
+      });
+      assert.ok(lags.length > 0);
+      assert.ok(lags.every(lag => lag === 100), `lags: ${lags}`);
+    });
   });
 
   describe('profile (w/ stubs)', () => {
@@ -67,5 +385,291 @@ describe('Time Profiler', () => {
       const profile = await time.profile(PROFILE_OPTIONS);
       assert.deepEqual(timeProfile, profile);
     });
+
+    it('should profile until the deadline', async () => {
+      // Date.now() is stubbed to return 0.
+      const profile = await time.profile({
+        intervalMicros: 1000,
+        deadline: new Date(100),
+      });
+      assert.deepEqual(timeProfile, profile);
+    });
+
+    it('should not use the sourceMapper when sourceMap is false', async () => {
+      const sourceMapper = new SourceMapper();
+      const mappingInfo = sinon.spy(sourceMapper, 'mappingInfo');
+      const profile = await time.profile({
+        ...PROFILE_OPTIONS,
+        sourceMapper,
+        sourceMap: false,
+      });
+      assert.ok(mappingInfo.notCalled, 'expected no source mapping');
+      assert.deepEqual(timeProfile, profile);
+
+      await time.profile({ ...PROFILE_OPTIONS, sourceMapper });
+      assert.ok(mappingInfo.called, 'expected source mapping by default');
+    });
+
+    it('should retry starting the profiler with maxRetries', async () => {
+      const startStub = sinonStubs[0];
+      startStub.resetHistory();
+      startStub
+        .onCall(0)
+        .throws(new Error('Too many profilers are running.'));
+      try {
+        const profile = await time.profile({
+          ...PROFILE_OPTIONS,
+          maxRetries: 2,
+        });
+        assert.deepEqual(timeProfile, profile);
+        assert.strictEqual(startStub.callCount, 2);
+      } finally {
+        startStub.resetBehavior();
+      }
+    });
+
+    it('should only retry starting when too many profilers are running', async () => {
+      const startStub = sinonStubs[0];
+      startStub.resetHistory();
+      startStub.onCall(0).throws(new Error('native failure'));
+      try {
+        await assert.rejects(
+          time.profile({ ...PROFILE_OPTIONS, maxRetries: 2 }),
+          /native failure/
+        );
+        assert.strictEqual(startStub.callCount, 1);
+      } finally {
+        startStub.resetBehavior();
+      }
+    });
+
+    it('should reject when starting the profiler fails without retries', async () => {
+      const startStub = sinonStubs[0];
+      startStub.onCall(startStub.callCount).throws(new Error('native failure'));
+      try {
+        await assert.rejects(time.profile(PROFILE_OPTIONS), /native failure/);
+      } finally {
+        startStub.resetBehavior();
+      }
+      // The failed attempt is torn down, so that profiling can start again.
+      await time.profile(PROFILE_OPTIONS);
+    });
+
+    it('should shorten the profile to end within maxProcessLifetimeMillis', async () => {
+      const uptimeStub = sinon.stub(process, 'uptime').returns(10);
+      const warnStub = sinon.stub(console, 'warn');
+      try {
+        const start = process.hrtime();
+        const profile = await time.profile({
+          ...PROFILE_OPTIONS,
+          durationMillis: 10000,
+          maxProcessLifetimeMillis: 10100,
+        });
+        const [seconds] = process.hrtime(start);
+        assert.ok(seconds < 2, `profiled for ${seconds}s`);
+        assert.ok(warnStub.calledOnce);
+        const decoded = decodeSync(encodeSync(profile));
+        const comments = decoded.comment.map(
+          c => decoded.stringTable[Number(c)]
+        );
+        assert.ok(isTimeLimited(comments), `comments: ${comments}`);
+        assert.strictEqual(decoded.sample.length, timeProfile.sample!.length);
+
+        const unlimited = await time.profile({
+          ...PROFILE_OPTIONS,
+          maxProcessLifetimeMillis: 60000,
+        });
+        assert.deepEqual(timeProfile, unlimited);
+      } finally {
+        uptimeStub.restore();
+        warnStub.restore();
+      }
+    });
+
+    it('should measure maxProcessLifetimeMillis from lifetimeStartMillis', async () => {
+      const warnStub = sinon.stub(console, 'warn');
+      try {
+        const profile = await time.profile({
+          ...PROFILE_OPTIONS,
+          durationMillis: 10000,
+          maxProcessLifetimeMillis: 10000,
+          lifetimeStartMillis: Date.now() - 20000,
+        });
+        // The lifetime has already passed, so the profile is shortened to
+        // nothing instead of failing.
+        assert.ok(
+          warnStub.calledWithMatch(/shortened to 0ms/),
+          `${warnStub.args}`
+        );
+        const decoded = decodeSync(encodeSync(profile));
+        const comments = decoded.comment.map(
+          c => decoded.stringTable[Number(c)]
+        );
+        assert.ok(isTimeLimited(comments), `comments: ${comments}`);
+      } finally {
+        warnStub.restore();
+      }
+    });
+
+    it('should reject an unknown option', async () => {
+      await assert.rejects(
+        // tslint:disable-next-line no-any
+        time.profile({ duration: 100 } as any),
+        /Unknown option "duration" for time.profile\(\). Valid options are: .*durationMillis/
+      );
+    });
+
+    it('should reject when the deadline has passed', async () => {
+      await assert.rejects(
+        time.profile({ intervalMicros: 1000, deadline: new Date(-1000) }),
+        /Profile deadline 1969-12-31T23:59:59.000Z has passed/
+      );
+    });
+
+    it('should record the revision from profileMetadata in the profile', async () => {
+      const profile = await time.profile({
+        ...PROFILE_OPTIONS,
+        profileMetadata: { revision: 'abc123' },
+      });
+      const decoded = decodeSync(encodeSync(profile));
+      const comments = decoded.comment.map(c => decoded.stringTable[Number(c)]);
+      assert.strictEqual(getRevision(comments), 'abc123');
+    });
+
+    it('should grow the interval while overhead exceeds targetOverheadPercent', async () => {
+      const setIntervalStub = v8TimeProfiler.setSamplingInterval as
+        sinon.SinonStub;
+      setIntervalStub.resetHistory();
+      // Collecting and serializing each 10s profile appears to take 12s.
+      const millisStub = sinon.stub(metrics, 'millisSince').returns(6000);
+      try {
+        for (let i = 0; i < 3; i++) {
+          await time.profile({ ...PROFILE_OPTIONS, targetOverheadPercent: 5 });
+        }
+        time.resetAdaptiveInterval();
+        await time.profile({ ...PROFILE_OPTIONS, targetOverheadPercent: 5 });
+      } finally {
+        millisStub.restore();
+        time.resetAdaptiveInterval();
+      }
+      const intervals = setIntervalStub.getCalls().map(c => c.args[0]);
+      assert.deepStrictEqual(intervals, [1000, 2000, 4000, 1000]);
+    });
+
+    it('should adapt the interval when stopping a started profile', () => {
+      const setIntervalStub = v8TimeProfiler.setSamplingInterval as
+        sinon.SinonStub;
+      setIntervalStub.resetHistory();
+      const millisStub = sinon.stub(metrics, 'millisSince').returns(6000);
+      const options = { intervalMicros: 1000, targetOverheadPercent: 5 };
+      try {
+        time.start(options)();
+        time.start(options)();
+        // Collecting and serializing now appears to take no time.
+        millisStub.returns(0);
+        time.start(options)();
+        time.start(options)();
+      } finally {
+        millisStub.restore();
+        time.resetAdaptiveInterval();
+      }
+      const intervals = setIntervalStub.getCalls().map(c => c.args[0]);
+      assert.deepStrictEqual(intervals, [1000, 2000, 4000, 2000]);
+    });
+
+    it('should report metrics after collection when onMetrics is specified', async () => {
+      const onMetrics = sinon.spy();
+      await time.profile({ ...PROFILE_OPTIONS, onMetrics });
+      assert.ok(onMetrics.calledOnce, 'expected onMetrics to be called once');
+      const metrics = onMetrics.firstCall.args[0];
+      for (const field of [
+        'collectMillis',
+        'serializeMillis',
+        'encodeMillis',
+        'sampleCount',
+        'bytes',
+      ]) {
+        assert.strictEqual(typeof metrics[field], 'number', field);
+        assert.ok(metrics[field] >= 0, field);
+      }
+      assert.strictEqual(metrics.sampleCount, timeProfile.sample!.length);
+      assert.ok(metrics.bytes > 0);
+      assert.strictEqual(metrics.mappedFrames, undefined);
+    });
+
+    it('should serialize a raw profile several times', () => {
+      const root = v8TimeProfile.topDownRoot;
+      const stopStub = sinonStubs[1];
+      stopStub.onCall(stopStub.callCount).returns({
+        ...v8TimeProfile,
+        topDownRoot: {
+          ...root,
+          children: [
+            {
+              name: 'processTicksAndRejections',
+              scriptName: 'node:internal/process/task_queues',
+              scriptId: 3,
+              lineNumber: 1,
+              columnNumber: 1,
+              hitCount: 0,
+              children: root.children,
+            },
+          ],
+        },
+      });
+      const raw = time.start({ intervalMicros: 1000 })({ raw: true });
+      try {
+        const full = time.serialize(raw);
+        const stripped = time.serialize(raw, { stripNodeInternals: true });
+        const internal = { name: 'processTicksAndRejections' };
+        assert.ok(findFunction(full, internal).found);
+        assert.ok(!findFunction(stripped, internal).found);
+        assert.deepEqual(timeProfile, stripped);
+      } finally {
+        raw.dispose();
+      }
+      assert.throws(() => time.serialize(raw), /disposed/);
+    });
+
+    it('should record when a raw profile was collected, not serialized', () => {
+      const stopStub = sinonStubs[1];
+      const dateStub = sinonStubs[3];
+      stopStub.onCall(stopStub.callCount).returns(
+        v8TimeProfileOf([timeNode('a', 1, [], { id: 2 })], {
+          startTime: 1000,
+          endTime: 1100,
+          samples: [2],
+          timestamps: [1050],
+        })
+      );
+      const stop = time.start({ intervalMicros: 1000, timeline: true });
+      let profile: perftools.profiles.IProfile;
+      // The profile is collected at 1s after the epoch, and serialized a
+      // minute later.
+      dateStub.returns(1000);
+      const raw = stop({ raw: true });
+      try {
+        dateStub.returns(61000);
+        profile = time.serialize(raw);
+      } finally {
+        dateStub.returns(0);
+        raw.dispose();
+      }
+      assert.strictEqual(profile.timeNanos, 1e9);
+      const [label] = profile.sample![0].label!;
+      assert.strictEqual(label.num, 1e9 - 50000);
+    });
+
+    it('should report source map stats in metrics with a sourceMapper', async () => {
+      const onMetrics = sinon.spy();
+      await time.profile({
+        ...PROFILE_OPTIONS,
+        sourceMapper: new SourceMapper(),
+        onMetrics,
+      });
+      const metrics = onMetrics.firstCall.args[0];
+      assert.strictEqual(metrics.mappedFrames, 0);
+      assert.strictEqual(typeof metrics.unmappedFrames, 'number');
+    });
   });
 });
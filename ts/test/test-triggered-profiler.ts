@@ -0,0 +1,166 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as sinon from 'sinon';
+
+import * as heap from '../src/heap-profiler';
+import * as time from '../src/time-profiler';
+import {
+  enableMemoryTrigger,
+  triggeredProfiler,
+} from '../src/triggered-profiler';
+import { heapProfile, timeProfile } from './profiles-for-tests';
+
+const assert = require('assert');
+
+describe('triggeredProfiler', () => {
+  let clock: sinon.SinonFakeTimers;
+  let profileStub: sinon.SinonStub;
+  beforeEach(() => {
+    clock = sinon.useFakeTimers();
+    profileStub = sinon
+      .stub(time, 'profile')
+      .callsFake(
+        options =>
+          new Promise(resolve =>
+            setTimeout(() => resolve(timeProfile), options.durationMillis)
+          )
+      );
+  });
+
+  afterEach(() => {
+    profileStub.restore();
+    clock.restore();
+  });
+
+  it('should collect one profile when shouldStart becomes true', async () => {
+    let errors = 0;
+    const onProfile = sinon.spy();
+    const stop = triggeredProfiler({
+      shouldStart: () => errors > 10,
+      pollMillis: 100,
+      durationMillis: 1000,
+      onProfile,
+      timeOptions: { intervalMicros: 500 },
+    });
+    await clock.tickAsync(1000);
+    assert.ok(profileStub.notCalled);
+
+    errors = 20;
+    await clock.tickAsync(5000);
+    stop();
+    assert.ok(profileStub.calledOnce, 'expected a single profile');
+    assert.deepStrictEqual(profileStub.firstCall.args, [
+      { intervalMicros: 500, durationMillis: 1000 },
+    ]);
+    assert.ok(onProfile.calledOnceWithExactly(timeProfile));
+  });
+
+  it('should collect another profile after shouldStart was false', async () => {
+    let trigger = true;
+    const onProfile = sinon.spy();
+    const stop = triggeredProfiler({
+      shouldStart: () => trigger,
+      pollMillis: 100,
+      durationMillis: 1000,
+      onProfile,
+    });
+    await clock.tickAsync(2000);
+    trigger = false;
+    await clock.tickAsync(200);
+    trigger = true;
+    await clock.tickAsync(2000);
+    stop();
+    assert.strictEqual(onProfile.callCount, 2);
+  });
+
+  it('should report errors of shouldStart and keep polling', async () => {
+    let polls = 0;
+    const onError = sinon.spy();
+    const onProfile = sinon.spy();
+    const stop = triggeredProfiler({
+      shouldStart: () => {
+        if (++polls === 1) {
+          throw new Error('cannot read metric');
+        }
+        return true;
+      },
+      pollMillis: 100,
+      durationMillis: 1000,
+      onProfile,
+      onError,
+    });
+    await clock.tickAsync(2000);
+    stop();
+    assert.ok(onError.calledOnce);
+    assert.strictEqual(onError.firstCall.args[0].message, 'cannot read metric');
+    assert.ok(onProfile.calledOnceWithExactly(timeProfile));
+  });
+});
+
+describe('enableMemoryTrigger', () => {
+  let clock: sinon.SinonFakeTimers;
+  let rss: number;
+  // tslint:disable-next-line no-any
+  let memoryUsageStub: sinon.SinonStub<any, any>;
+  let heapProfileStub: sinon.SinonStub;
+  beforeEach(() => {
+    clock = sinon.useFakeTimers();
+    rss = 100;
+    memoryUsageStub = sinon
+      .stub(process, 'memoryUsage')
+      .callsFake(() => ({ rss, heapTotal: 0, heapUsed: 0, external: 0 }));
+    heapProfileStub = sinon.stub(heap, 'profile').returns(heapProfile);
+  });
+
+  afterEach(() => {
+    heapProfileStub.restore();
+    memoryUsageStub.restore();
+    clock.restore();
+  });
+
+  it('should collect one heap profile when the RSS crosses rssBytes', async () => {
+    const onProfile = sinon.spy();
+    const stop = enableMemoryTrigger({
+      rssBytes: 1000,
+      type: 'heap',
+      onProfile,
+      pollMillis: 100,
+    });
+    await clock.tickAsync(1000);
+    assert.ok(heapProfileStub.notCalled);
+
+    rss = 2000;
+    await clock.tickAsync(5000);
+    stop();
+    assert.ok(heapProfileStub.calledOnce, 'expected a single profile');
+    assert.ok(onProfile.calledOnceWithExactly(heapProfile));
+  });
+
+  it('should collect another profile after debounceMillis', async () => {
+    rss = 2000;
+    const onProfile = sinon.spy();
+    const stop = enableMemoryTrigger({
+      rssBytes: 1000,
+      onProfile,
+      pollMillis: 100,
+      debounceMillis: 1000,
+    });
+    await clock.tickAsync(1950);
+    stop();
+    assert.strictEqual(onProfile.callCount, 2);
+  });
+});
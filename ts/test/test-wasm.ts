@@ -0,0 +1,120 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import {
+  SerializeOptions,
+  serializeTimeProfile,
+} from '../src/profile-serializer';
+import { parseWasmFunctionNames, wasmFunctionIndex } from '../src/wasm';
+
+import { timeNode, v8TimeProfileOf } from './profiles-for-tests';
+
+const assert = require('assert');
+
+// Module with two empty functions, named add and mul in its name section.
+const NAMED_MODULE = Buffer.from(
+  [
+    '0061736d01000000', // magic and version
+    '010401600000', // type section: () => ()
+    '0303020000', // function section: two functions of type 0
+    '0a070202000b02000b', // code section: two empty bodies
+    '0012046e616d65', // custom section "name"
+    '010b02000361646401036d756c', // function names: 0 add, 1 mul
+  ].join(''),
+  'hex'
+);
+
+// The same module without its name section.
+const UNNAMED_MODULE = NAMED_MODULE.subarray(0, 28);
+
+describe('wasm', () => {
+  describe('parseWasmFunctionNames', () => {
+    it('should return the names in the name section', () => {
+      assert.deepStrictEqual(
+        Array.from(parseWasmFunctionNames(NAMED_MODULE)),
+        [
+          [0, 'add'],
+          [1, 'mul'],
+        ]
+      );
+    });
+
+    it('should return no names when there is no name section', () => {
+      assert.strictEqual(parseWasmFunctionNames(UNNAMED_MODULE).size, 0);
+    });
+
+    it('should throw when bytes are not a WebAssembly module', () => {
+      assert.throws(
+        () => parseWasmFunctionNames(Buffer.from('not wasm')),
+        /^Error: Not a WebAssembly module\.$/
+      );
+    });
+  });
+
+  describe('wasmFunctionIndex', () => {
+    it('should return the index of unnamed WebAssembly functions', () => {
+      assert.strictEqual(wasmFunctionIndex('wasm-function[12]'), 12);
+      assert.strictEqual(wasmFunctionIndex('add'), undefined);
+    });
+  });
+
+  describe('serializeTimeProfile', () => {
+    const wasmFrame = (index: number, columnNumber: number, hits: number) =>
+      timeNode(`wasm-function[${index}]`, hits, [], {
+        scriptName: 'wasm://wasm/8c5a1a3e',
+        scriptId: 3,
+        lineNumber: 0,
+        columnNumber,
+      });
+    const v8Profile = v8TimeProfileOf([
+      wasmFrame(0, 20, 2),
+      wasmFrame(1, 23, 3),
+      wasmFrame(2, 26, 1),
+    ]);
+
+    function functionNames(options: SerializeOptions = {}): string[] {
+      const profile = serializeTimeProfile(v8Profile, 1000, undefined, options);
+      return profile.function!.map(f => profile.stringTable![f.name as number]);
+    }
+
+    it('should name WebAssembly frames from the name section', () => {
+      const names = parseWasmFunctionNames(NAMED_MODULE);
+      const scriptNames: string[] = [];
+      assert.deepStrictEqual(
+        functionNames({
+          wasmFunctionNames: (scriptName, index) => {
+            scriptNames.push(scriptName);
+            return names.get(index);
+          },
+        }).sort(),
+        ['add', 'mul', 'wasm-function[2]']
+      );
+      assert.deepStrictEqual(scriptNames, [
+        frame.scriptName,
+        frame.scriptName,
+        frame.scriptName,
+      ]);
+    });
+
+    it('should keep the names given by V8 by default', () => {
+      assert.deepStrictEqual(functionNames().sort(), [
+        'wasm-function[0]',
+        'wasm-function[1]',
+        'wasm-function[2]',
+      ]);
+    });
+  });
+});
@@ -0,0 +1,72 @@
+/**
+ * Copyright 2020 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import * as path from 'path';
+
+const assert = require('assert');
+
+// worker_threads is not available in all supported versions of Node.js.
+// tslint:disable-next-line no-any
+let Worker: any;
+try {
+  Worker = require('worker_threads').Worker;
+} catch (e) {
+  // Tests below are skipped.
+}
+
+const WORKER_COUNT = 4;
+const ITERATIONS = 5;
+
+// Repeatedly collects time and heap profiles in a worker.
+const WORKER_SCRIPT = `
+const { parentPort, workerData } = require('worker_threads');
+const pprof = require(workerData.pprofPath);
+
+async function run() {
+  pprof.heap.start(1024, 64);
+  for (let i = 0; i < ${ITERATIONS}; i++) {
+    const profile = await pprof.time.profile({ durationMillis: 50 });
+    if (!profile.sample) {
+      throw new Error('time profile has no samples');
+    }
+    pprof.heap.profile();
+  }
+  pprof.heap.stop();
+}
+run().then(() => parentPort.postMessage('done'));
+`;
+
+function runWorker(): Promise<number> {
+  return new Promise((resolve, reject) => {
+    const worker = new Worker(WORKER_SCRIPT, {
+      eval: true,
+      workerData: { pprofPath: path.join(__dirname, '../src/index') },
+    });
+    worker.on('error', reject);
+    worker.on('exit', resolve);
+  });
+}
+
+const describeIfWorkers = Worker ? describe : describe.skip;
+
+describeIfWorkers('worker threads', () => {
+  it('should profile concurrently in several workers', async () => {
+    const exitCodes = await Promise.all(
+      Array.from({ length: WORKER_COUNT }, runWorker)
+    );
+    assert.deepStrictEqual(exitCodes, new Array(WORKER_COUNT).fill(0));
+  }).timeout(30000);
+});